@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//s3yarahunt submits retro-hunts to a running s3yarascanner and reports on them through its feed server
+//  s3yarahunt [-server url] submit [-name n] [-bucket b] [-prefix p] [-type t] [-ttl 24h] rules.yar
+//  s3yarahunt [-server url] status|results|cancel <id>
+func main() {
+	server := flag.String("server", os.Getenv("FEEDSERVERURL"), "feed server url, defaults to FEEDSERVERURL or http://127.0.0.1:31425")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-server url] submit [options] rules.yar | list | status <id> | results <id> | cancel <id>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if len(*server) == 0 {
+		*server = "http://127.0.0.1:31425"
+	}
+	base := strings.TrimSuffix(*server, "/")
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var err error
+	switch command, rest := args[0], args[1:]; {
+	case command == "submit":
+		err = submit(base, rest)
+	case command == "list":
+		err = request("GET", base+"/hunts", nil)
+	case len(rest) != 1:
+		flag.Usage()
+		os.Exit(2)
+	case command == "status":
+		err = request("GET", base+"/hunts/"+rest[0], nil)
+	case command == "results":
+		err = request("GET", base+"/hunts/"+rest[0]+"/results", nil)
+	case command == "cancel":
+		err = request("POST", base+"/hunts/"+rest[0]+"/cancel", nil)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+//submit reads a rules file and submits a hunt with it
+func submit(base string, args []string) error {
+	flags := flag.NewFlagSet("submit", flag.ExitOnError)
+	name := flags.String("name", "", "name of the hunt")
+	bucket := flags.String("bucket", "", "only hunt the binaries synced from this bucket")
+	prefix := flags.String("prefix", "", "only hunt the binaries whose key starts with this prefix")
+	contentType := flags.String("type", "", "only hunt the binaries of this content type")
+	ttl := flags.String("ttl", "", "how long the results are kept, ie 72h")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("submit needs one rules file")
+	}
+	rules, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(*name) == 0 {
+		*name = flags.Arg(0)
+	}
+	body, err := json.Marshal(map[string]string{"name": *name, "rules": string(rules), "bucket": *bucket, "key_prefix": *prefix,
+		"content_type": *contentType, "ttl": *ttl})
+	if err != nil {
+		return err
+	}
+	return request("POST", base+"/hunts", bytes.NewReader(body))
+}
+
+//request sends a request to the feed server and prints its response, failing on an error status
+func request(method, url string, body io.Reader) error {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(strings.TrimSpace(string(data)))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s - %s", method, url, resp.Status)
+	}
+	return nil
+}
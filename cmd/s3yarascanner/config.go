@@ -0,0 +1,249 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hillu/go-yara"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"github.com/zacharyestep/s3yarascanner/pkg/yarascanner"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//envSet returns whether an ENVVAR flag is set, like DISABLESSL any value enables it
+func envSet(name string) bool {
+	return len(os.Getenv(name)) > 0
+}
+
+//envInt returns an integer ENVVAR, or def when it isn't set
+func envInt(name string, def int) int {
+	raw := os.Getenv(name)
+	if len(raw) == 0 {
+		return def
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Fatalf("Error parsing %s %s %v", name, raw, err)
+	}
+	return value
+}
+
+//envFloat returns a float ENVVAR, or def when it isn't set
+func envFloat(name string, def float64) float64 {
+	raw := os.Getenv(name)
+	if len(raw) == 0 {
+		return def
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		log.Fatalf("Error parsing %s %s %v", name, raw, err)
+	}
+	return value
+}
+
+//envDuration returns a duration ENVVAR, or def when it isn't set
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if len(raw) == 0 {
+		return def
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Fatalf("Error parsing %s %s %v", name, raw, err)
+	}
+	return value
+}
+
+//envList returns a comma separated ENVVAR as a list, nil when it isn't set
+func envList(name string) []string {
+	raw := os.Getenv(name)
+	if len(raw) == 0 {
+		return nil
+	}
+	values := make([]string, 0)
+	for _, value := range strings.Split(raw, ",") {
+		if value = strings.TrimSpace(value); len(value) > 0 {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+//envIntMap returns a comma separated list of name=integer pairs from an ENVVAR, ie SCORESEVERITIES=low=20,high=80
+func envIntMap(name string) map[string]int {
+	values := make(map[string]int)
+	for _, pair := range envList(name) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Error parsing %s %s, expected name=value", name, pair)
+		}
+		value, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			log.Fatalf("Error parsing %s %s %v", name, pair, err)
+		}
+		values[strings.TrimSpace(parts[0])] = value
+	}
+	return values
+}
+
+//envFloatMap returns a comma separated list of name=number pairs from an ENVVAR, ie VERDICTWEIGHTS=vendor=0.5
+func envFloatMap(name string) map[string]float64 {
+	values := make(map[string]float64)
+	for _, pair := range envList(name) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Error parsing %s %s, expected name=value", name, pair)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			log.Fatalf("Error parsing %s %s %v", name, pair, err)
+		}
+		values[strings.TrimSpace(parts[0])] = value
+	}
+	return values
+}
+
+//newScanner returns a scanner for the rules in rulesDir. When RULESGITREMOTE is set rulesDir holds a checkout
+//of the git repository, and when RULESS3BUCKET is set it holds a mirror of the rules in the bucket
+func newScanner(binaryDir, rulesDir string, db *gorm.DB, s3svc *s3.S3) (*yarascanner.Scanner, error) {
+	var provider yarascanner.RulesetProvider
+	var err error
+	if gitRemote := os.Getenv("RULESGITREMOTE"); len(gitRemote) > 0 {
+		provider, err = yarascanner.NewGitRulesetProvider(gitRemote, os.Getenv("RULESGITREF"), os.Getenv("RULESGITSUBPATH"), rulesDir, envDuration("RULESGITINTERVAL", 5*time.Minute), db)
+	} else if rulesBucket := os.Getenv("RULESS3BUCKET"); len(rulesBucket) > 0 {
+		provider, err = yarascanner.NewS3RulesetProvider(s3svc, rulesBucket, os.Getenv("RULESS3PREFIX"), rulesDir, envDuration("RULESS3INTERVAL", time.Minute), db)
+	} else {
+		return yarascanner.NewScanner(binaryDir, rulesDir, db)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return yarascanner.NewScannerWithProvider(binaryDir, provider, db)
+}
+
+//promotionPolicy reads the thresholds for promoting staged rulesets, the limits default to none
+func promotionPolicy() yarascanner.PromotionPolicy {
+	return yarascanner.PromotionPolicy{
+		AutoPromote:             envSet("PROMOTEAUTO"),
+		MaxNewlyMatched:         envInt("PROMOTEMAXNEWLYMATCHED", -1),
+		MaxNoLongerMatched:      envInt("PROMOTEMAXNOLONGERMATCHED", -1),
+		MaxNewlyMatchedFraction: envFloat("PROMOTEMAXNEWLYMATCHEDFRACTION", 0),
+		MaxScanErrors:           envInt("PROMOTEMAXSCANERRORS", -1),
+	}
+}
+
+//scanOptions reads the default scan options, SCANFULLMODE disables fast mode, SCANTIMEOUT sets the timeout,
+//SCANFULLRESCAN rescans binaries matching in fast mode in full mode and SCANMAXMATCHES stops scans after that many matches.
+//A rule directory's ScanOptionsFile overrides them
+func scanOptions() yarascanner.ScanOptions {
+	options := yarascanner.DefaultScanOptions
+	if envSet("SCANFULLMODE") {
+		options.Flags &^= yara.ScanFlagsFastMode
+	}
+	options.Timeout = envDuration("SCANTIMEOUT", options.Timeout)
+	options.FullRescanOnMatch = envSet("SCANFULLRESCAN")
+	options.MaxMatches = envInt("SCANMAXMATCHES", options.MaxMatches)
+	return options
+}
+
+//scoringPolicy reads the scoring policy, SCORESEVERITIES adds to or overrides the severity scores, SCORENAMESPACES sets
+//namespace defaults and SCOREDEFAULT, SCOREMIN and SCOREMAX the default score and the feed's range
+func scoringPolicy() yarascanner.ScoringPolicy {
+	policy := yarascanner.DefaultScoringPolicy
+	policy.Severities = make(map[string]int)
+	for severity, score := range yarascanner.DefaultScoringPolicy.Severities {
+		policy.Severities[severity] = score
+	}
+	for severity, score := range envIntMap("SCORESEVERITIES") {
+		policy.Severities[strings.ToLower(severity)] = score
+	}
+	policy.NamespaceDefaults = envIntMap("SCORENAMESPACES")
+	policy.DefaultScore = envInt("SCOREDEFAULT", policy.DefaultScore)
+	policy.MinScore = envInt("SCOREMIN", policy.MinScore)
+	policy.MaxScore = envInt("SCOREMAX", policy.MaxScore)
+	return policy
+}
+
+//verdictPolicy reads the verdict policy, VERDICTFORMULA is max or sum, capped at VERDICTSUMCAP, VERDICTWEIGHTS weighs
+//namespaces and VERDICTSUSPICIOUS and VERDICTMALICIOUS are the verdict thresholds
+func verdictPolicy() yarascanner.VerdictPolicy {
+	policy := yarascanner.DefaultVerdictPolicy
+	if formula := os.Getenv("VERDICTFORMULA"); len(formula) > 0 {
+		if formula != yarascanner.VerdictFormulaMax && formula != yarascanner.VerdictFormulaSum {
+			log.Fatalf("Error parsing VERDICTFORMULA %s, expected max or sum", formula)
+		}
+		policy.Formula = formula
+	}
+	policy.SumCap = envInt("VERDICTSUMCAP", policy.SumCap)
+	policy.NamespaceWeights = envFloatMap("VERDICTWEIGHTS")
+	policy.SuspiciousScore = envInt("VERDICTSUSPICIOUS", policy.SuspiciousScore)
+	policy.MaliciousScore = envInt("VERDICTMALICIOUS", policy.MaliciousScore)
+	return policy
+}
+
+//configureQueue reads the scan queue settings, SCANQUEUEVISIBILITY is how long a scan can run before its binary is handed
+//to another worker, SCANQUEUEMAXATTEMPTS and SCANQUEUEBACKOFF control the retries of failed scans, SCANQUEUEFAILEDRETENTION
+//how long failed scans are kept, 0 keeps them, and SCANQUEUEWEIGHTS overrides the shares of the job classes, ie ingest=8,ondemand=4,rulechange=2,periodic=1
+func configureQueue(queue *yarascanner.ScanQueue) {
+	weights := make(map[string]int)
+	for class, weight := range yarascanner.DefaultScanClassWeights {
+		weights[class] = weight
+	}
+	for class, weight := range envIntMap("SCANQUEUEWEIGHTS") {
+		weights[class] = weight
+	}
+	queue.Weights = weights
+	queue.VisibilityTimeout = envDuration("SCANQUEUEVISIBILITY", queue.VisibilityTimeout)
+	queue.MaxAttempts = envInt("SCANQUEUEMAXATTEMPTS", queue.MaxAttempts)
+	queue.RetryBackoff = envDuration("SCANQUEUEBACKOFF", queue.RetryBackoff)
+	queue.FailedRetention = envDuration("SCANQUEUEFAILEDRETENTION", queue.FailedRetention)
+}
+
+//configureRescans reads the periodic rescan schedules from RESCANSCHEDULES, a JSON list like
+//[{"name":"nightly","cron":"0 2 * * *","max_age":"3d"},{"name":"weekly","cron":"@weekly"}], and RESCANBATCH,
+//how many scans of a rescan are kept queued at once
+func configureRescans(rescans *yarascanner.RescanScheduler) {
+	if raw := os.Getenv("RESCANSCHEDULES"); len(raw) > 0 {
+		schedules, err := yarascanner.ParseRescanSchedules([]byte(raw))
+		if err != nil {
+			log.Fatalf("Error parsing RESCANSCHEDULES - %v", err)
+		}
+		rescans.Schedules = schedules
+	}
+	rescans.BatchSize = envInt("RESCANBATCH", rescans.BatchSize)
+}
+
+//configureIsolation runs the scans in supervised child processes when SCANISOLATION is set. SCANMEMORYLIMITMB caps the
+//memory of a child, SCANCPULIMIT the CPU time of a scan and SCANWATCHDOGGRACE how long a scan may outlast its timeout.
+//Binaries crashing a child are quarantined and moved to QUARANTINEDIR, those outlasting the grace time out and are retried.
+//Hunts, rule profiling and staging scan in children of their own, the children load the rulesets from SCANISOLATIONDIR
+func configureIsolation(scanner *yarascanner.Scanner) {
+	if !envSet("SCANISOLATION") {
+		return
+	}
+	dir := os.Getenv("SCANISOLATIONDIR")
+	if len(dir) == 0 {
+		dir = "./scanchildren"
+	}
+	isolation := yarascanner.NewScanIsolation(dir)
+	isolation.MemoryLimit = uint64(envInt("SCANMEMORYLIMITMB", 0)) << 20
+	isolation.CPULimit = envDuration("SCANCPULIMIT", 0)
+	isolation.WatchdogGrace = envDuration("SCANWATCHDOGGRACE", isolation.WatchdogGrace)
+	isolation.QuarantineDir = os.Getenv("QUARANTINEDIR")
+	scanner.Isolation = isolation
+}
+
+//configureProfiler profiles the rules when RULEPROFILE is set, scanning RULEPROFILESAMPLE binaries with each rule every
+//RULEPROFILEINTERVAL and flagging the rules averaging over RULEPROFILESLOW as slow
+func configureProfiler(scanner *yarascanner.Scanner, binaryDir string, db *gorm.DB) {
+	if !envSet("RULEPROFILE") {
+		return
+	}
+	profiler := yarascanner.NewRuleProfiler(binaryDir, scanner.RulesetProvider, db)
+	profiler.Interval = envDuration("RULEPROFILEINTERVAL", profiler.Interval)
+	profiler.SampleSize = envInt("RULEPROFILESAMPLE", profiler.SampleSize)
+	profiler.Threshold = envDuration("RULEPROFILESLOW", profiler.Threshold)
+	scanner.Profiler = profiler
+}
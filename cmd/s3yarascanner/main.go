@@ -39,6 +39,14 @@ func main() {
 	//yara library's global cleanup routine defer'd to trigger at exit
 	defer yara.Finalize()
 
+	//with SCANISOLATION the scans run in child processes of this same binary, serving them over stdin and stdout
+	if envSet(yarascanner.ScanChildEnv) {
+		if err := yarascanner.RunScanChild(); err != nil {
+			log.Fatalf("Error in scan process %v", err)
+		}
+		return
+	}
+
 	log.Info("Starting s3 yara service")
 	//configure the running log-level
 	configureLogging()
@@ -68,6 +76,12 @@ func main() {
 		rulesDir = os.Args[3]
 	}
 
+	//compiled rulesets are cached here, keyed by a hash of the rule sources
+	rulesCacheDir := os.Getenv("RULESCACHEDIR")
+	if len(rulesCacheDir) == 0 {
+		rulesCacheDir = "./rulecache"
+	}
+
 	db := os.Getenv("SQLITEDB")
 	if len(db) == 0 {
 		db = os.Args[4]
@@ -114,19 +128,46 @@ func main() {
 		log.Fatalf("%s %v",db,err)
 	}
 
-	dbGorm.AutoMigrate(&models.Binary{},&models.Rule{},&models.Result{})
+	models.AutoMigrate(dbGorm)
 
 	syncer, err:= s3sync.NewSyncer(bucket, binaryDir, endpointurl, awsregion, awsaccessid, awsaccesskey, disablessl, s3forcepathstyle)
 
 	if err != nil {
 		log.Fatalf("Error in syncer construction %v",err)
 	}
+	syncer.DB = dbGorm
 
-	scanner, err := yarascanner.NewScanner(binaryDir, rulesDir, dbGorm)
+	scanner, err := newScanner(binaryDir, rulesDir, dbGorm, s3sync.NewS3(endpointurl, awsregion, awsaccessid, awsaccesskey, disablessl, s3forcepathstyle))
 
 	if err != nil { 
 		log.Fatalf("Error in scanner construction %v",err)
 	}
+	scanner.RulesetProvider.CacheDir = rulesCacheDir
+	//with RULESTRUSTEDKEYS, a key file or directory of them, only rule files signed by one of the keys are loaded
+	if trustedKeysPath := os.Getenv("RULESTRUSTEDKEYS"); len(trustedKeysPath) > 0 {
+		trustedKeys, err := yarascanner.LoadTrustedKeys(trustedKeysPath)
+		if err != nil {
+			log.Fatalf("Error loading trusted rule keys %s %v", trustedKeysPath, err)
+		}
+		scanner.RulesetProvider.TrustedKeys = trustedKeys
+	}
+	//RULESEXTERNALMETA lists the S3 user metadata keys exposed to rules as meta_<key> externals
+	scanner.RulesetProvider.ExternalMetaKeys = envList("RULESEXTERNALMETA")
+	scanner.RulesetProvider.ScanOptions = scanOptions()
+	scanner.RulesetProvider.Scoring = scoringPolicy()
+	//RESCANFULL rescans the binaries with the whole ruleset on rule changes rather than with the rules changed
+	scanner.RulesetProvider.DeltaRescans = !envSet("RESCANFULL")
+	//RULESETCLONES caps the copies of the compiled rules the scanning workers hold at once, one per CPU by default
+	scanner.RulesetProvider.MaxRulesetClones = envInt("RULESETCLONES", scanner.RulesetProvider.MaxRulesetClones)
+	scanner.Verdicts = verdictPolicy()
+	configureQueue(scanner.Queue)
+	configureRescans(scanner.Rescans)
+	configureIsolation(scanner)
+	configureProfiler(scanner, binaryDir, dbGorm)
+	//with STAGERULESETS rule changes are evaluated against the stored binaries and promoted per PROMOTE* or through the API
+	if envSet("STAGERULESETS") {
+		yarascanner.NewStager(scanner.RulesetProvider, binaryDir, promotionPolicy())
+	}
 
 	syncer.Start(runtime.NumCPU()/2)
 	scanner.Start(runtime.NumCPU())
@@ -135,6 +176,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error setting up Feed Server %s %v",feedServerTemplateFile,err)
 	}
+	feedrouter.Scanner = scanner
 	srv := &http.Server{
         Handler:      feedrouter.Router,
         Addr:         feedServerHost,
@@ -14,6 +14,8 @@ require (
 	github.com/lib/pq v1.2.0 // indirect
 	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/rcrowley/go-metrics v0.0.0-20181016184325-3113b8401b8a
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/crypto v0.0.0-20190325154230-a5d413f7728c
 	syreclabs.com/go/faker v1.2.0 // indirect
 )
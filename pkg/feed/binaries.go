@@ -0,0 +1,79 @@
+package feed
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"net/http"
+)
+
+//handleBinaries lists the binaries with their last scan, binaries never scanned successfully with ?unscanned=1
+//and those whose last scan ended with an outcome with ?outcome=, paged with ?limit= and ?offset=
+func (fserver *Server) handleBinaries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		binaries := []models.Binary{}
+		params := r.URL.Query()
+		query := fserver.FeedDB
+		if len(params.Get("unscanned")) > 0 {
+			query = query.Where("last_scan_succeeded_at IS NULL")
+		}
+		if outcome := params.Get("outcome"); len(outcome) > 0 {
+			query = query.Where("last_scan_outcome = ?", outcome)
+		}
+		err := query.Order("id").Limit(queryInt(r, "limit", defaultResultsLimit)).Offset(queryInt(r, "offset", 0)).Find(&binaries).Error
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, binaries)
+	}
+}
+
+//handleBinaryScans lists the scan runs of a binary, newest first
+func (fserver *Server) handleBinaryScans() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		runs := []models.ScanRun{}
+		err := fserver.FeedDB.Where("binary_hash = ?", mux.Vars(r)["hash"]).Order("id desc").
+			Limit(queryInt(r, "limit", defaultResultsLimit)).Offset(queryInt(r, "offset", 0)).Find(&runs).Error
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, runs)
+	}
+}
+
+//handleBinaryScan queues a binary to be scanned on demand, ahead of the rescans
+func (fserver *Server) handleBinaryScan() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fserver.Scanner == nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no scanner configured"})
+			return
+		}
+		hash := mux.Vars(r)["hash"]
+		if fserver.FeedDB.Where("hash = ?", hash).First(&models.Binary{}).RecordNotFound() {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such binary"})
+			return
+		}
+		if err := fserver.Scanner.Queue.Enqueue(hash, models.ScanClassOnDemand); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"queued": hash})
+	}
+}
+
+//handleQueue lists the number of scan jobs per class and status
+func (fserver *Server) handleQueue() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fserver.Scanner == nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no scanner configured"})
+			return
+		}
+		stats, err := fserver.Scanner.Queue.Stats()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+	}
+}
@@ -1,12 +1,17 @@
 package feed
 
 import ( 
+	"encoding/json"
+	"fmt"
 	"github.com/jinzhu/gorm"
 	//sqlitedilact for gorm
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/gorilla/mux"
 	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"github.com/zacharyestep/s3yarascanner/pkg/yarascanner"
+	log "github.com/sirupsen/logrus"
 	"net/http"
+	"path/filepath"
 	"text/template"
 	"time"
 )
@@ -15,11 +20,44 @@ type Server struct {
 	FeedDB * gorm.DB
 	Router	*mux.Router
 	Template	*template.Template
+	//Scanner backs the rule management routes, which are unavailable while it is nil
+	Scanner *yarascanner.Scanner
+}
+
+//templateFuncs are the functions feed templates can call, json renders a value as JSON
+var templateFuncs = template.FuncMap{"now": time.Now, "json": func(v interface{}) (string, error) {
+	raw, err := json.Marshal(v)
+	return string(raw), err
+}}
+
+//feedReport is a report of the feed, for a result or a verdict
+type feedReport struct {
+	Timestamp int64             `json:"timestamp"`
+	ID        string            `json:"id"`
+	Link      string            `json:"link"`
+	Title     string            `json:"title"`
+	Score     int               `json:"score"`
+	IOCs      map[string]string `json:"iocs"`
+}
+
+//feedReports returns the reports of the feed, a report per open result followed by one per verdict
+func feedReports(results []models.Result, verdicts []models.Verdict) []feedReport {
+	now := time.Now().Unix()
+	reports := make([]feedReport, 0, len(results)+len(verdicts))
+	for _, result := range results {
+		reports = append(reports, feedReport{Timestamp: now, ID: fmt.Sprint(result.ID), Link: "www.google.com", Title: result.RuleName,
+			Score: result.Score, IOCs: map[string]string{"md5": result.BinaryHash}})
+	}
+	for _, verdict := range verdicts {
+		reports = append(reports, feedReport{Timestamp: now, ID: fmt.Sprintf("verdict-%d", verdict.ID), Link: "www.google.com",
+			Title: fmt.Sprintf("%s (%d rules)", verdict.Verdict, verdict.Matches), Score: verdict.Score, IOCs: map[string]string{"md5": verdict.BinaryHash}})
+	}
+	return reports
 }
 
 //NewServer is a factory method for FeedServer using default gorilla-mux router and the provided * db, temlpate string
 func NewServer(feedTmpl string, fddb * gorm.DB) ( * Server, error) {
-	tmpl, err := template.New("feed").Parse(feedTmpl)
+	tmpl, err := template.New("feed").Funcs(templateFuncs).Parse(feedTmpl)
 	if err != nil { 
 		return nil, err
 	}
@@ -28,9 +66,7 @@ func NewServer(feedTmpl string, fddb * gorm.DB) ( * Server, error) {
 
 //NewServerTmplFile loads a new sever as above except the template arg is a filename with a template content
 func NewServerTmplFile(feedTmplFile string, fddb * gorm.DB) (* Server , error) {
-	funcMap := template.FuncMap{"now":time.Now}
-	
-	tmpl, err := template.New(feedTmplFile).Funcs(funcMap).ParseFiles(feedTmplFile)
+	tmpl, err := template.New(filepath.Base(feedTmplFile)).Funcs(templateFuncs).ParseFiles(feedTmplFile)
 	if err != nil { 
 		return nil, err
 	}
@@ -44,15 +80,51 @@ func NewServerTmplFile(feedTmplFile string, fddb * gorm.DB) (* Server , error) {
 func (fserver * Server)  Routes() {
 	fserver.Router.HandleFunc("/feed.json",fserver.handleFeeds())
 	fserver.Router.HandleFunc("/health/alive",fserver.handleHealth())
+	fserver.Router.HandleFunc("/rules", fserver.handleRules()).Methods("GET")
+	fserver.Router.HandleFunc("/rules/sync", fserver.handleRulesSync()).Methods("POST")
+	fserver.Router.HandleFunc("/rules/profile", fserver.handleRuleProfile()).Methods("GET")
+	fserver.Router.HandleFunc("/rules/coverage", fserver.handleRuleCoverage()).Methods("GET")
+	fserver.Router.HandleFunc("/rulesets", fserver.handleRulesetVersions()).Methods("GET")
+	fserver.Router.HandleFunc("/rules/{id:[0-9]+}/state", fserver.handleRuleStateHistory()).Methods("GET")
+	fserver.Router.HandleFunc("/rules/{id:[0-9]+}/state", fserver.handleRuleState()).Methods("PUT", "POST")
+	fserver.Router.HandleFunc("/results", fserver.handleResults()).Methods("GET")
+	fserver.Router.HandleFunc("/results/{id:[0-9]+}", fserver.handleResult()).Methods("GET")
+	fserver.Router.HandleFunc("/verdicts", fserver.handleVerdicts()).Methods("GET")
+	fserver.Router.HandleFunc("/binaries", fserver.handleBinaries()).Methods("GET")
+	fserver.Router.HandleFunc("/binaries/{hash}/scans", fserver.handleBinaryScans()).Methods("GET")
+	fserver.Router.HandleFunc("/binaries/{hash}/verdict", fserver.handleBinaryVerdict()).Methods("GET")
+	fserver.Router.HandleFunc("/binaries/{hash}/changes", fserver.handleBinaryChanges()).Methods("GET")
+	fserver.Router.HandleFunc("/binaries/{hash}/scan", fserver.handleBinaryScan()).Methods("POST")
+	fserver.Router.HandleFunc("/queue", fserver.handleQueue()).Methods("GET")
+	fserver.Router.HandleFunc("/rescans", fserver.handleRescans()).Methods("GET")
+	fserver.Router.HandleFunc("/rescans/{id:[0-9]+}", fserver.handleRescan()).Methods("GET")
+	fserver.Router.HandleFunc("/rescans/{id:[0-9]+}/cancel", fserver.handleRescanCancel()).Methods("POST")
+	fserver.Router.HandleFunc("/schedules/{name}/run", fserver.handleRescanSchedule()).Methods("POST")
+	fserver.Router.HandleFunc("/hunts", fserver.handleHunts()).Methods("GET")
+	fserver.Router.HandleFunc("/hunts", fserver.handleHuntSubmit()).Methods("POST")
+	fserver.Router.HandleFunc("/hunts/{id:[0-9]+}", fserver.handleHunt()).Methods("GET")
+	fserver.Router.HandleFunc("/hunts/{id:[0-9]+}/results", fserver.handleHuntResults()).Methods("GET")
+	fserver.Router.HandleFunc("/hunts/{id:[0-9]+}/cancel", fserver.handleHuntCancel()).Methods("POST")
+	fserver.Router.HandleFunc("/promotions", fserver.handlePromotions()).Methods("GET")
+	fserver.Router.HandleFunc("/promotions/{id:[0-9]+}", fserver.handlePromotion()).Methods("GET")
+	fserver.Router.HandleFunc("/promotions/{id:[0-9]+}/{decision:approve|reject}", fserver.handlePromotionDecision()).Methods("POST")
 }
 
 
 //handleFeeds is a route-handle for feeds , returning a handler funciton
 func (fserver * Server) handleFeeds() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		 	models := []models.Result{}
-			fserver.FeedDB.Debug().Find(models)
-			fserver.Template.Execute(w,map[string]interface{}{"reports":models})
+		 	results := []models.Result{}
+			//shadow results come from draft and testing rules and never make it to the feed, nor do closed results
+			fserver.FeedDB.Where("shadow = ? AND closed_at IS NULL", false).Find(&results)
+			//verdicts are reported once per binary, clean binaries are left out
+			verdicts := []models.Verdict{}
+			fserver.FeedDB.Where("verdict <> ?", models.VerdictClean).Find(&verdicts)
+			//feed holds the reports ready to render with json, reports and verdicts are kept for templates formatting their own
+			w.Header().Set("Content-Type", "application/json")
+			if err := fserver.Template.Execute(w,map[string]interface{}{"reports":results,"verdicts":verdicts,"feed":feedReports(results, verdicts)}); err != nil {
+				log.Errorf("Error rendering feed %v", err)
+			}
 			return	
     }
 }
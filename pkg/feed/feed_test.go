@@ -0,0 +1,49 @@
+package feed
+
+import (
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//Test the feed renders as JSON with a report per open production result and per verdict that isn't clean
+func TestFeed(t *testing.T) {
+	gdb, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening db for tests ... %v", err)
+	}
+	defer gdb.Close()
+	gdb.DB().SetMaxOpenConns(1)
+	models.AutoMigrate(gdb)
+	closed := time.Now()
+	gdb.Create(&models.Result{BinaryHash: "abc", RuleName: `quoted "rule"`, Score: 80})
+	gdb.Create(&models.Result{BinaryHash: "abc", RuleName: "shadow", Shadow: true})
+	gdb.Create(&models.Result{BinaryHash: "def", RuleName: "closed", ClosedAt: &closed})
+	gdb.Create(&models.Verdict{BinaryHash: "abc", Verdict: models.VerdictMalicious, Score: 80, Matches: 1})
+	gdb.Create(&models.Verdict{BinaryHash: "def", Verdict: models.VerdictClean})
+	server, err := NewServerTmplFile("../../cmd/s3yarascanner/feed.tmpl", gdb)
+	if err != nil {
+		t.Fatalf("Error loading the feed template %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(recorder, httptest.NewRequest("GET", "/feed.json", nil))
+	feed := struct {
+		FeedInfo map[string]string `json:"feedinfo"`
+		Reports  []feedReport      `json:"reports"`
+	}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("Expected the feed to be JSON, got %v\n%s", err, recorder.Body.String())
+	}
+	if len(feed.FeedInfo["name"]) == 0 || len(feed.Reports) != 2 {
+		t.Fatalf("Expected the feed info and 2 reports, got %+v", feed)
+	}
+	if report := feed.Reports[0]; report.Title != `quoted "rule"` || report.Score != 80 || report.IOCs["md5"] != "abc" || report.Timestamp == 0 {
+		t.Fatalf("Expected the report of the open result, got %+v", report)
+	}
+	if report := feed.Reports[1]; report.ID != "verdict-1" || report.Title != "malicious (1 rules)" {
+		t.Fatalf("Expected the report of the malicious verdict, got %+v", report)
+	}
+}
@@ -0,0 +1,122 @@
+package feed
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//huntRequest is the body of a hunt submission, rules is the yara source to hunt with and ttl how long its results are kept
+type huntRequest struct {
+	Name          string     `json:"name"`
+	Rules         string     `json:"rules"`
+	Bucket        string     `json:"bucket"`
+	KeyPrefix     string     `json:"key_prefix"`
+	ContentType   string     `json:"content_type"`
+	CreatedAfter  *time.Time `json:"created_after"`
+	CreatedBefore *time.Time `json:"created_before"`
+	TTL           string     `json:"ttl"`
+}
+
+//handleHuntSubmit queues a hunt over the binaries matching its filters, rules that don't compile are refused
+func (fserver *Server) handleHuntSubmit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fserver.Scanner == nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no scanner configured"})
+			return
+		}
+		req := huntRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		hunt := models.Hunt{Name: req.Name, Rules: req.Rules, Bucket: req.Bucket, KeyPrefix: req.KeyPrefix, ContentType: req.ContentType,
+			CreatedAfter: req.CreatedAfter, CreatedBefore: req.CreatedBefore}
+		if len(req.TTL) > 0 {
+			ttl, err := time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ttl must be a positive duration"})
+				return
+			}
+			hunt.ExpiresAt = time.Now().Add(ttl)
+		}
+		if err := fserver.Scanner.Hunts.Submit(&hunt); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, hunt)
+	}
+}
+
+//handleHunts lists the hunts with their progress, newest first
+func (fserver *Server) handleHunts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hunts := []models.Hunt{}
+		query := fserver.FeedDB
+		if status := r.URL.Query().Get("status"); len(status) > 0 {
+			query = query.Where("status = ?", status)
+		}
+		err := query.Order("id desc").Limit(queryInt(r, "limit", defaultResultsLimit)).Offset(queryInt(r, "offset", 0)).Find(&hunts).Error
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, hunts)
+	}
+}
+
+//handleHunt returns a hunt with its rules and progress
+func (fserver *Server) handleHunt() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hunt := models.Hunt{}
+		if fserver.FeedDB.First(&hunt, mux.Vars(r)["id"]).RecordNotFound() {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such hunt"})
+			return
+		}
+		writeJSON(w, http.StatusOK, hunt)
+	}
+}
+
+//handleHuntResults lists the matches of a hunt with their string matches and tags, filtered by ?binary= and ?rule=, paged
+func (fserver *Server) handleHuntResults() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results := []models.HuntResult{}
+		params := r.URL.Query()
+		query := fserver.FeedDB.Preload("Strings").Preload("Tags").Where("hunt_id = ?", mux.Vars(r)["id"])
+		if binary := params.Get("binary"); len(binary) > 0 {
+			query = query.Where("binary_hash = ?", binary)
+		}
+		if rule := params.Get("rule"); len(rule) > 0 {
+			query = query.Where("rule_name = ?", rule)
+		}
+		err := query.Order("id").Limit(queryInt(r, "limit", defaultResultsLimit)).Offset(queryInt(r, "offset", 0)).Find(&results).Error
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, results)
+	}
+}
+
+//handleHuntCancel cancels a queued or running hunt
+func (fserver *Server) handleHuntCancel() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fserver.Scanner == nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no scanner configured"})
+			return
+		}
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := fserver.Scanner.Hunts.Cancel(uint(id)); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]uint{"cancelled": uint(id)})
+	}
+}
@@ -0,0 +1,86 @@
+package feed
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"net/http"
+	"strconv"
+)
+
+//ruleImpact summarizes a promotion's diff for one rule
+type ruleImpact struct {
+	Namespace       string `json:"namespace"`
+	RuleName        string `json:"rule_name"`
+	NewlyMatched    int    `json:"newly_matched"`
+	NoLongerMatched int    `json:"no_longer_matched"`
+}
+
+//handlePromotions lists the staged ruleset promotions, newest first
+func (fserver *Server) handlePromotions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		promotions := []models.RulesetPromotion{}
+		if err := fserver.FeedDB.Order("id desc").Find(&promotions).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, promotions)
+	}
+}
+
+//handlePromotion returns a promotion with its per rule impact, and every binary level change with ?diffs=1
+func (fserver *Server) handlePromotion() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		promotion := models.RulesetPromotion{}
+		query := fserver.FeedDB
+		if len(r.URL.Query().Get("diffs")) > 0 {
+			query = query.Preload("Diffs")
+		}
+		if query.First(&promotion, mux.Vars(r)["id"]).RecordNotFound() {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no promotion %s", mux.Vars(r)["id"]))
+			return
+		}
+		impact := []ruleImpact{}
+		err := fserver.FeedDB.Table("ruleset_diffs").
+			Select("namespace, rule_name, SUM(CASE WHEN matched THEN 1 ELSE 0 END) AS newly_matched, SUM(CASE WHEN matched THEN 0 ELSE 1 END) AS no_longer_matched").
+			Where("ruleset_promotion_id = ?", promotion.ID).Group("namespace, rule_name").Order("namespace, rule_name").Scan(&impact).Error
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"promotion": promotion, "rules": impact})
+	}
+}
+
+//handlePromotionDecision approves or rejects a staged ruleset
+func (fserver *Server) handlePromotionDecision() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fserver.Scanner == nil || fserver.Scanner.RulesetProvider.Stager == nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "ruleset staging is not enabled"})
+			return
+		}
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		req := struct {
+			Actor string `json:"actor"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&req)
+		stager := fserver.Scanner.RulesetProvider.Stager
+		if mux.Vars(r)["decision"] == "approve" {
+			err = stager.Approve(uint(id), requestActor(r, req.Actor))
+		} else {
+			err = stager.Reject(uint(id), requestActor(r, req.Actor))
+		}
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		promotion := models.RulesetPromotion{}
+		fserver.FeedDB.First(&promotion, id)
+		writeJSON(w, http.StatusOK, promotion)
+	}
+}
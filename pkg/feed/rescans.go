@@ -0,0 +1,83 @@
+package feed
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"github.com/zacharyestep/s3yarascanner/pkg/yarascanner"
+	"net/http"
+	"strconv"
+)
+
+//handleRescans lists the periodic rescan jobs with their progress, newest first, the running ones with ?running=1
+func (fserver *Server) handleRescans() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobs := []models.RescanJob{}
+		query := fserver.FeedDB
+		if len(r.URL.Query().Get("running")) > 0 {
+			query = query.Where("status = ?", models.RescanJobRunning)
+		}
+		err := query.Order("id desc").Limit(queryInt(r, "limit", defaultResultsLimit)).Offset(queryInt(r, "offset", 0)).Find(&jobs).Error
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for i := range jobs {
+			yarascanner.RescanJobProgress(fserver.FeedDB, &jobs[i])
+		}
+		writeJSON(w, http.StatusOK, jobs)
+	}
+}
+
+//handleRescan returns a rescan job with its progress
+func (fserver *Server) handleRescan() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job := models.RescanJob{}
+		if fserver.FeedDB.First(&job, mux.Vars(r)["id"]).RecordNotFound() {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such rescan job"})
+			return
+		}
+		yarascanner.RescanJobProgress(fserver.FeedDB, &job)
+		writeJSON(w, http.StatusOK, job)
+	}
+}
+
+//handleRescanSchedule starts a rescan job of a configured schedule right away
+func (fserver *Server) handleRescanSchedule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fserver.Scanner == nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no scanner configured"})
+			return
+		}
+		schedule, ok := fserver.Scanner.Rescans.Schedule(mux.Vars(r)["name"])
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such schedule"})
+			return
+		}
+		job, err := fserver.Scanner.Rescans.Run(schedule)
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+//handleRescanCancel cancels a running rescan job
+func (fserver *Server) handleRescanCancel() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fserver.Scanner == nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no scanner configured"})
+			return
+		}
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := fserver.Scanner.Rescans.Cancel(uint(id)); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]uint{"cancelled": uint(id)})
+	}
+}
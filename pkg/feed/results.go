@@ -0,0 +1,113 @@
+package feed
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"net/http"
+	"strconv"
+)
+
+//defaultResultsLimit is the page size of /results when ?limit= isn't given
+const defaultResultsLimit = 100
+
+//queryInt returns an integer query parameter, or def when it isn't set or isn't a number
+func queryInt(r *http.Request, name string, def int) int {
+	value, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || value < 0 {
+		return def
+	}
+	return value
+}
+
+//handleResults lists open results with their string matches, tags and metadata, newest first.
+//They can be filtered by ?binary=, ?rule= and ?namespace=, shadow results are listed with ?shadow=1, closed ones along with
+//the open ones with ?closed=1 and they are paged with ?limit= and ?offset=
+func (fserver *Server) handleResults() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results := []models.Result{}
+		params := r.URL.Query()
+		query := fserver.FeedDB.Preload("Strings").Preload("Tags").Preload("Metas").Where("shadow = ?", len(params.Get("shadow")) > 0)
+		if len(params.Get("closed")) == 0 {
+			query = query.Where("closed_at IS NULL")
+		}
+		if binary := params.Get("binary"); len(binary) > 0 {
+			query = query.Where("binary_hash = ?", binary)
+		}
+		if rule := params.Get("rule"); len(rule) > 0 {
+			query = query.Where("rule_name = ?", rule)
+		}
+		if namespace := params.Get("namespace"); len(namespace) > 0 {
+			query = query.Where("namespace = ?", namespace)
+		}
+		err := query.Order("id desc").Limit(queryInt(r, "limit", defaultResultsLimit)).Offset(queryInt(r, "offset", 0)).Find(&results).Error
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, results)
+	}
+}
+
+//handleResult returns a result with its string matches, tags, metadata and the history of its changes
+func (fserver *Server) handleResult() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := models.Result{}
+		if fserver.FeedDB.Preload("Strings").Preload("Tags").Preload("Metas").Preload("Changes").First(&result, mux.Vars(r)["id"]).RecordNotFound() {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no result %s", mux.Vars(r)["id"]))
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+//handleVerdicts lists the binary verdicts, highest scores first, optionally filtered by ?verdict= and paged with ?limit= and ?offset=
+func (fserver *Server) handleVerdicts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		verdicts := []models.Verdict{}
+		query := fserver.FeedDB
+		if verdict := r.URL.Query().Get("verdict"); len(verdict) > 0 {
+			query = query.Where("verdict = ?", verdict)
+		}
+		err := query.Order("score desc, id").Limit(queryInt(r, "limit", defaultResultsLimit)).Offset(queryInt(r, "offset", 0)).Find(&verdicts).Error
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, verdicts)
+	}
+}
+
+//handleBinaryVerdict returns the verdict of a binary along with the open production results it was computed from
+func (fserver *Server) handleBinaryVerdict() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash := mux.Vars(r)["hash"]
+		verdict := models.Verdict{}
+		if fserver.FeedDB.Where("binary_hash = ?", hash).First(&verdict).RecordNotFound() {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no verdict for %s", hash))
+			return
+		}
+		results := []models.Result{}
+		err := fserver.FeedDB.Preload("Tags").Where("binary_hash = ? AND shadow = ? AND closed_at IS NULL", hash, false).
+			Order("score desc").Find(&results).Error
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"verdict": verdict, "results": results})
+	}
+}
+
+//handleBinaryChanges lists the history of the results of a binary being opened, closed and reopened, newest first
+func (fserver *Server) handleBinaryChanges() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		changes := []models.ResultChange{}
+		err := fserver.FeedDB.Where("binary_hash = ?", mux.Vars(r)["hash"]).Order("id desc").
+			Limit(queryInt(r, "limit", defaultResultsLimit)).Offset(queryInt(r, "offset", 0)).Find(&changes).Error
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, changes)
+	}
+}
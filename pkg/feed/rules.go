@@ -0,0 +1,181 @@
+package feed
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"github.com/zacharyestep/s3yarascanner/pkg/yarascanner"
+	"net/http"
+	"strconv"
+)
+
+//writeJSON writes v as the JSON response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Error writing response %v", err)
+	}
+}
+
+//writeError writes an error as a JSON response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+//requestActor returns the actor named in a request body, defaulting to the caller's address
+func requestActor(r *http.Request, actor string) string {
+	if len(actor) == 0 {
+		return r.RemoteAddr
+	}
+	return actor
+}
+
+//handleRules lists the indexed rules, optionally filtered by ?state=
+func (fserver *Server) handleRules() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rules := []models.Rule{}
+		query := fserver.FeedDB.Preload("Tags").Preload("Metas")
+		if state := r.URL.Query().Get("state"); len(state) > 0 {
+			query = query.Where("state = ?", state)
+		}
+		if err := query.Find(&rules).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rules)
+	}
+}
+
+//handleRuleProfile reports the slowest rules of a ruleset version, ?version= defaults to the latest profiled
+//and ?slow=1 only reports the rules flagged as slow
+func (fserver *Server) handleRuleProfile() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		profiles, err := yarascanner.SlowestRules(fserver.FeedDB, uint(queryInt(r, "version", 0)), len(r.URL.Query().Get("slow")) > 0,
+			queryInt(r, "limit", defaultResultsLimit))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, profiles)
+	}
+}
+
+//handleRuleCoverage reports the hits and corpus share of every rule. ?windows= lists the windows hits are counted over,
+//ie 1d,7d,30d, ?noisy= is the share of the corpus a noisy rule matches over, ?shadow=1 covers the shadow results,
+//?namespace= picks a namespace and ?filter=never or ?filter=noisy only lists the rules that never matched or are noisy
+func (fserver *Server) handleRuleCoverage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		windows := yarascanner.DefaultCoverageWindows
+		if raw := params.Get("windows"); len(raw) > 0 {
+			var err error
+			if windows, err = yarascanner.ParseCoverageWindows(raw); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		noisyShare := yarascanner.DefaultNoisyShare
+		if raw := params.Get("noisy"); len(raw) > 0 {
+			var err error
+			if noisyShare, err = strconv.ParseFloat(raw, 64); err != nil || noisyShare < 0 || noisyShare > 1 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "noisy must be a share of the corpus between 0 and 1"})
+				return
+			}
+		}
+		report, err := yarascanner.BuildCoverageReport(fserver.FeedDB, windows, noisyShare, len(params.Get("shadow")) > 0)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		namespace, filter := params.Get("namespace"), params.Get("filter")
+		rules := report.Rules[:0]
+		for _, rule := range report.Rules {
+			if (len(namespace) > 0 && rule.Namespace != namespace) || (filter == "never" && !rule.NeverMatched) || (filter == "noisy" && !rule.Noisy) {
+				continue
+			}
+			rules = append(rules, rule)
+		}
+		report.Rules = rules
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+//handleRulesSync pulls the rules from their source, for providers that support it
+func (fserver *Server) handleRulesSync() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fserver.Scanner == nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no scanner configured"})
+			return
+		}
+		provider, ok := fserver.Scanner.Provider.(yarascanner.SyncableRulesetProvider)
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "the ruleset provider can't be synced"})
+			return
+		}
+		if err := provider.Sync(); err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		//changed rules are reloaded in the background, the new version shows up under /rulesets
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "synced"})
+	}
+}
+
+//handleRulesetVersions lists the recorded ruleset versions, newest first
+func (fserver *Server) handleRulesetVersions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		versions := []models.RulesetVersion{}
+		if err := fserver.FeedDB.Order("id desc").Find(&versions).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, versions)
+	}
+}
+
+//handleRuleStateHistory returns the logged lifecycle state changes of a rule
+func (fserver *Server) handleRuleStateHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		changes := []models.RuleStateChange{}
+		if err := fserver.FeedDB.Where("rule_id = ?", mux.Vars(r)["id"]).Order("id").Find(&changes).Error; err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, changes)
+	}
+}
+
+//ruleStateRequest is the body of a rule state change, actor defaults to the caller's address
+type ruleStateRequest struct {
+	State string `json:"state"`
+	Actor string `json:"actor"`
+}
+
+//handleRuleState moves a rule to another lifecycle state
+func (fserver *Server) handleRuleState() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fserver.Scanner == nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no scanner configured"})
+			return
+		}
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		req := ruleStateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := fserver.Scanner.RulesetProvider.SetRuleState(uint(id), req.State, requestActor(r, req.Actor)); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		rule := models.Rule{}
+		fserver.FeedDB.First(&rule, id)
+		writeJSON(w, http.StatusOK, rule)
+	}
+}
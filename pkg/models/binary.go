@@ -8,6 +8,26 @@ import (
 //Binary a binary that will be considered for scanning
 type Binary struct {
 	gorm.Model
-	Hash string `gorm: "primary_key"`
+	Hash string `gorm:"index"`
 	LastScanedAt time.Time
+	//LastScanOutcome and LastScanError are those of the latest ScanRun, LastScanSucceededAt is nil until a scan succeeds
+	LastScanOutcome     string `gorm:"index"`
+	LastScanError       string
+	LastScanSucceededAt *time.Time
+	//QuarantinedAt is set when the binary crashed an isolated scan, it is no longer scanned or hunted
+	QuarantinedAt *time.Time `gorm:"index"`
+	//Bucket, Key, Size and ContentType describe the S3 object the binary was synced from, they are empty for binaries found on disk
+	Bucket      string
+	Key         string
+	Size        int64
+	ContentType string
+	Metas       []BinaryMeta
+}
+
+//BinaryMeta is a user metadata entry of the S3 object a binary was synced from
+type BinaryMeta struct {
+	ID       uint `gorm:"primary_key"`
+	BinaryID uint `gorm:"index"`
+	Key      string
+	Value    string
 }
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+//Hunt statuses
+const (
+	HuntQueued    = "queued"
+	HuntRunning   = "running"
+	HuntDone      = "done"
+	HuntCancelled = "cancelled"
+	HuntFailed    = "failed"
+	//HuntExpired hunts had their results removed once past ExpiresAt
+	HuntExpired = "expired"
+)
+
+//Hunt is a retro-hunt, ad-hoc rules run over the stored binaries apart from the production rules and feed
+type Hunt struct {
+	gorm.Model
+	Name  string
+	Rules string `json:",omitempty"`
+	//Bucket, KeyPrefix, ContentType and CreatedAfter/CreatedBefore restrict the binaries hunted, they match every binary when empty
+	Bucket        string
+	KeyPrefix     string
+	ContentType   string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	Status        string `gorm:"index"`
+	Error         string
+	StartedAt     *time.Time
+	FinishedAt    *time.Time
+	//ExpiresAt is when the hunt's results are removed
+	ExpiresAt time.Time `gorm:"index"`
+	//Total is the number of binaries selected when the hunt started, Scanned and Failed count those hunted so far
+	Total   int
+	Scanned int
+	Failed  int
+	//Matched counts the binaries matching at least one rule
+	Matched int
+	//Cursor is the ID of the last binary hunted, a hunt interrupted by a restart resumes after it
+	Cursor uint
+}
+
+//HuntResult is a rule of a hunt matching a binary
+type HuntResult struct {
+	ID         uint `gorm:"primary_key"`
+	CreatedAt  time.Time
+	HuntID     uint   `gorm:"index"`
+	BinaryHash string `gorm:"index"`
+	Namespace  string
+	RuleName   string
+	Tags       []HuntTag
+	Strings    []HuntString
+}
+
+//HuntTag is a tag of the hunt rule matched
+type HuntTag struct {
+	ID           uint `gorm:"primary_key"`
+	HuntResultID uint `gorm:"index"`
+	Tag          string
+}
+
+//HuntString is a string match of a hunt result, with Data hex encoded and truncated like ResultString
+type HuntString struct {
+	ID           uint `gorm:"primary_key"`
+	HuntResultID uint `gorm:"index"`
+	Name         string
+	Offset       uint64
+	Data         string
+	Length       int
+	Truncated    bool
+}
@@ -0,0 +1,10 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+//AutoMigrate creates or updates the tables of every model
+func AutoMigrate(db *gorm.DB) *gorm.DB {
+	return db.AutoMigrate(&Binary{}, &BinaryMeta{}, &Rule{}, &RuleTag{}, &RuleMeta{}, &RuleStateChange{}, &Result{}, &ResultString{}, &ResultTag{}, &ResultMeta{}, &ResultChange{}, &RulesetVersion{}, &RulesetFile{}, &RulesetPromotion{}, &RulesetDiff{}, &Verdict{}, &ScanRun{}, &ScanJob{}, &RescanJob{}, &Hunt{}, &HuntResult{}, &HuntTag{}, &HuntString{}, &RuleProfile{})
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+//Ruleset promotion statuses
+const (
+	PromotionEvaluating = "evaluating"
+	PromotionPending    = "pending"
+	PromotionPromoted   = "promoted"
+	PromotionRejected   = "rejected"
+	PromotionSuperseded = "superseded"
+	PromotionAbandoned  = "abandoned"
+)
+
+//RulesetPromotion is a candidate ruleset evaluated against the stored binaries before it replaces the active ruleset
+type RulesetPromotion struct {
+	gorm.Model
+	CandidateVersionID uint `gorm:"index"`
+	BaseVersionID      uint
+	Status             string `gorm:"index"`
+	Trigger            string
+	BinariesTotal      int
+	BinariesScanned    int
+	ScanErrors         int
+	//NewlyMatched and NoLongerMatched count the binaries gaining or losing a rule match under the candidate
+	NewlyMatched    int
+	NoLongerMatched int
+	//WithinThresholds is set by the evaluation when the diff meets the configured promotion thresholds
+	WithinThresholds bool
+	DecidedBy        string
+	DecidedAt        *time.Time
+	Diffs            []RulesetDiff
+}
+
+//RulesetDiff is a rule match on a binary that the candidate ruleset adds or no longer makes
+type RulesetDiff struct {
+	ID                 uint `gorm:"primary_key"`
+	RulesetPromotionID uint `gorm:"index"`
+	Namespace          string
+	RuleName           string
+	BinaryHash         string
+	//Matched is true for a new match and false for a lost one
+	Matched bool
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+//Rescan job statuses
+const (
+	RescanJobRunning   = "running"
+	RescanJobDone      = "done"
+	RescanJobCancelled = "cancelled"
+)
+
+//RescanJob is a run of a periodic rescan schedule, its binaries are fed to the scan queue in batches
+type RescanJob struct {
+	gorm.Model
+	Schedule   string `gorm:"index"`
+	Status     string `gorm:"index"`
+	StartedAt  time.Time
+	FinishedAt *time.Time
+	//Cutoff selects the binaries last scanned before it, every binary is rescanned when it is nil
+	Cutoff *time.Time
+	//Total is the number of binaries selected when the job started, binaries scanned in the meantime are skipped
+	Total int
+	//Queued is the number of binaries fed to the scan queue, Cursor the ID of the last of them
+	Queued int
+	Cursor uint
+	//Pending, Failed and Completed count the scans queued by the job, they are computed when it is served
+	Pending   int `gorm:"-"`
+	Failed    int `gorm:"-"`
+	Completed int `gorm:"-"`
+}
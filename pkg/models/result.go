@@ -2,13 +2,71 @@ package models
 
 import (
 	"github.com/jinzhu/gorm"
+	"time"
 )
 
-//Result - Result of scanning a binary with yara ruleset
+//Result changes recorded when the results of a binary are reconciled with its latest scan
+const (
+	ResultOpened   = "opened"
+	ResultClosed   = "closed"
+	ResultReopened = "reopened"
+)
+
+//Result - Result of scanning a binary with yara ruleset.
+//There is one result per binary and rule, it stays open while rescans keep matching and is closed when one doesn't
 type Result struct {
 	gorm.Model
-	BinaryHash	string
+	BinaryHash	string `gorm:"index"`
 	Score	int
 	RuleName string 
 	Namespace string
-}
\ No newline at end of file
+	RulesetVersionID uint `gorm:"index"`
+	//Shadow results come from draft or testing rules and are kept out of the feed
+	Shadow bool
+	FirstSeenAt time.Time
+	LastSeenAt  time.Time
+	//ClosedAt is set when the latest scan of the binary no longer matched the rule
+	ClosedAt *time.Time `gorm:"index"`
+	Strings []ResultString
+	Tags    []ResultTag
+	Metas   []ResultMeta
+	Changes []ResultChange `json:",omitempty"`
+}
+
+//ResultString is a string match of a result. Data is hex encoded and cut to a size cap, Length is the full length matched
+type ResultString struct {
+	ID        uint `gorm:"primary_key"`
+	ResultID  uint `gorm:"index"`
+	Name      string
+	Offset    uint64
+	Data      string
+	Length    int
+	Truncated bool
+}
+
+//ResultTag is a tag of the rule matched, as it was when the result was recorded
+type ResultTag struct {
+	ID       uint `gorm:"primary_key"`
+	ResultID uint `gorm:"index"`
+	Tag      string
+}
+
+//ResultMeta is a metadata entry of the rule matched, as it was when the result was recorded
+type ResultMeta struct {
+	ID       uint `gorm:"primary_key"`
+	ResultID uint `gorm:"index"`
+	Key      string
+	Value    string
+}
+
+//ResultChange records a result being opened, closed or reopened by a scan
+type ResultChange struct {
+	gorm.Model
+	ResultID         uint   `gorm:"index"`
+	BinaryHash       string `gorm:"index"`
+	Namespace        string
+	RuleName         string
+	Change           string
+	RulesetVersionID uint
+	Shadow           bool
+}
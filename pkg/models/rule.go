@@ -1,11 +1,66 @@
 package models
 
 import (
-		"github.com/jinzhu/gorm"
+	"github.com/jinzhu/gorm"
 )
 
-//Rule is a yara rule that will be used for scanning
+//Rule lifecycle states, draft and testing rules only run in the shadow ruleset and retired rules don't run at all
+const (
+	RuleStateDraft      = "draft"
+	RuleStateTesting    = "testing"
+	RuleStateProduction = "production"
+	RuleStateRetired    = "retired"
+)
+
+//ValidRuleState returns whether state is one of the rule lifecycle states
+func ValidRuleState(state string) bool {
+	switch state {
+	case RuleStateDraft, RuleStateTesting, RuleStateProduction, RuleStateRetired:
+		return true
+	}
+	return false
+}
+
+//Rule is a yara rule that will be used for scanning, identified by its namespace and identifier.
+//Rules no longer in the active ruleset are soft-deleted
 type Rule struct {
 	gorm.Model
-	Name string `gorm: "primary_key"`
-}
\ No newline at end of file
+	Namespace   string `gorm:"unique_index:idx_rule_identity"`
+	Identifier  string `gorm:"unique_index:idx_rule_identity"`
+	Author      string
+	Description string
+	Reference   string
+	Score       int
+	SourceFile  string
+	SourceHash  string
+	//State is the effective lifecycle state, StateOverride is set through the API and takes precedence over the rule's status metadata
+	State         string
+	StateOverride string
+	Tags          []RuleTag
+	Metas         []RuleMeta
+}
+
+//RuleTag is a tag of a yara rule
+type RuleTag struct {
+	ID     uint `gorm:"primary_key"`
+	RuleID uint `gorm:"index"`
+	Tag    string
+}
+
+//RuleMeta is a metadata entry of a yara rule, the value is stored in its string form
+type RuleMeta struct {
+	ID     uint `gorm:"primary_key"`
+	RuleID uint `gorm:"index"`
+	Key    string
+	Value  string
+}
+
+//RuleStateChange is a logged transition of a rule's lifecycle state
+type RuleStateChange struct {
+	gorm.Model
+	RuleID    uint `gorm:"index"`
+	FromState string
+	ToState   string
+	//Actor is who or what changed the state, ie the API caller or "metadata"
+	Actor string
+}
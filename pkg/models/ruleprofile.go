@@ -0,0 +1,25 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+//RuleProfile is the cost of scanning with a rule compiled on its own, accumulated over the binaries profiled with a ruleset version.
+//Rules of namespaces that can't be split and precompiled units are profiled whole, under RuleName "*"
+type RuleProfile struct {
+	gorm.Model
+	RulesetVersionID uint   `gorm:"unique_index:idx_rule_profile"`
+	Namespace        string `gorm:"unique_index:idx_rule_profile"`
+	RuleName         string `gorm:"unique_index:idx_rule_profile"`
+	Scans            int
+	//TotalMicros and MaxMicros are scan times in microseconds, AvgMicros is filled in for reports
+	TotalMicros   int64
+	MaxMicros     int64
+	AvgMicros     int64 `gorm:"-"`
+	Matches       int
+	StringMatches int
+	Timeouts      int
+	Errors        int
+	//Slow is set once the average scan time exceeded the profiler's threshold or a scan timed out
+	Slow bool `gorm:"index"`
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+//Ruleset version statuses, only one version is active at a time
+const (
+	RulesetVersionCandidate  = "candidate"
+	RulesetVersionActive     = "active"
+	RulesetVersionInactive   = "inactive"
+	RulesetVersionRejected   = "rejected"
+	RulesetVersionSuperseded = "superseded"
+)
+
+//RulesetVersion is a compiled ruleset that was put into use or proposed, results record the version that produced them
+type RulesetVersion struct {
+	gorm.Model
+	Hash       string `gorm:"index"`
+	CompiledAt time.Time
+	//Trigger describes what caused the ruleset to be compiled, ie startup or the rule file event
+	Trigger string
+	Status  string `gorm:"index"`
+	//Revision is where the rule files came from, ie the commit SHA for rules from git
+	Revision string `gorm:"index"`
+	Files    []RulesetFile
+}
+
+//RulesetFile is a rule file a ruleset version was built from
+type RulesetFile struct {
+	ID               uint `gorm:"primary_key"`
+	RulesetVersionID uint `gorm:"index"`
+	Name             string
+	Hash             string
+}
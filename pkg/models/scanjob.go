@@ -0,0 +1,47 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+//Scan job statuses, jobs are deleted once done
+const (
+	ScanJobPending = "pending"
+	ScanJobLeased  = "leased"
+	ScanJobFailed  = "failed"
+)
+
+//Scan job classes, in order of priority
+const (
+	//ScanClassIngest scans binaries newly synced or dropped in the bin dir
+	ScanClassIngest = "ingest"
+	//ScanClassOnDemand scans binaries requested through the API
+	ScanClassOnDemand = "ondemand"
+	//ScanClassRuleChange rescans the binaries after the rules changed
+	ScanClassRuleChange = "rulechange"
+	//ScanClassPeriodic rescans the binaries on a schedule
+	ScanClassPeriodic = "periodic"
+)
+
+//ScanClasses lists the scan job classes in order of priority
+var ScanClasses = []string{ScanClassIngest, ScanClassOnDemand, ScanClassRuleChange, ScanClassPeriodic}
+
+//ScanJob is a binary waiting in the durable scan queue
+type ScanJob struct {
+	gorm.Model
+	BinaryHash string `gorm:"index"`
+	Class      string `gorm:"index"`
+	Status     string `gorm:"index"`
+	//DeltaVersion is the ruleset version whose delta the binary needs scanning with, 0 for the whole ruleset
+	DeltaVersion uint
+	//RescanJobID is the periodic rescan that queued the job, if any
+	RescanJobID uint `gorm:"index"`
+	//AvailableAt delays retries, the job can't be leased before
+	AvailableAt time.Time `gorm:"index"`
+	//LeasedUntil is when a leased job becomes visible again if its worker didn't finish it
+	LeasedUntil *time.Time `gorm:"index"`
+	LeaseOwner  string
+	Attempts    int
+	LastError   string
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+//Outcomes of a scan run
+const (
+	ScanSucceeded = "success"
+	ScanFailed    = "error"
+	ScanTimedOut  = "timeout"
+	//ScanMissing is the outcome of scanning a binary that isn't on disk
+	ScanMissing = "missing"
+	//ScanCrashed is the outcome of a scan whose isolated process crashed, ran out of its limits or was killed
+	ScanCrashed = "crash"
+)
+
+//ScanRun is an attempt to scan a binary with a ruleset version
+type ScanRun struct {
+	gorm.Model
+	BinaryHash       string `gorm:"index"`
+	RulesetVersionID uint   `gorm:"index"`
+	//Shadow runs scan with the shadow ruleset
+	Shadow     bool
+	//Delta runs scan with only the rules changed by the ruleset version
+	Delta      bool
+	StartedAt  time.Time
+	FinishedAt time.Time
+	//DurationMs is the time the scan took in milliseconds
+	DurationMs int64
+	Bytes      int64
+	Outcome    string `gorm:"index"`
+	Error      string
+	Matches    int
+}
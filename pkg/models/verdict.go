@@ -0,0 +1,23 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+//Verdicts of a binary, from its aggregate score
+const (
+	VerdictClean      = "clean"
+	VerdictSuspicious = "suspicious"
+	VerdictMalicious  = "malicious"
+)
+
+//Verdict is the aggregate of the production results of a binary's latest scan
+type Verdict struct {
+	gorm.Model
+	BinaryHash string `gorm:"unique_index"`
+	Score      int
+	Verdict    string `gorm:"index"`
+	//Matches is the number of production rules the binary matched
+	Matches          int
+	RulesetVersionID uint
+}
@@ -5,11 +5,15 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/jinzhu/gorm"
 	log "github.com/sirupsen/logrus"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
@@ -27,10 +31,33 @@ type Syncer struct {
 	started      bool
 	workerexits  []chan bool
 	workersdone  *sync.WaitGroup
+	//DB when set records the source object of every binary copied, ie its key, size, content type and user metadata
+	DB *gorm.DB
+}
+
+//recordSource stores the S3 object a binary is copied from on its models.Binary, creating the record if needed
+func recordSource(db *gorm.DB, s3svc s3iface.S3API, bucket, key string) error {
+	head, err := s3svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return err
+	}
+	bin := models.Binary{}
+	db.Where(models.Binary{Hash: key}).FirstOrInit(&bin)
+	bin.Bucket = bucket
+	bin.Key = key
+	bin.Size = aws.Int64Value(head.ContentLength)
+	bin.ContentType = aws.StringValue(head.ContentType)
+	tx := db.Begin()
+	tx.Save(&bin)
+	tx.Where("binary_id = ?", bin.ID).Delete(&models.BinaryMeta{})
+	for metaKey, value := range head.Metadata {
+		tx.Create(&models.BinaryMeta{BinaryID: bin.ID, Key: strings.ToLower(metaKey), Value: aws.StringValue(value)})
+	}
+	return tx.Commit().Error
 }
 
 //CopyWorker - go routine worker for doing copies from s3 to fs
-func CopyWorker(source <-chan string, destpath string, downloader *s3manager.Downloader, bucket string, ignoreFiles map[string]bool, wg *sync.WaitGroup) {
+func CopyWorker(source <-chan string, destpath string, downloader *s3manager.Downloader, bucket string, ignoreFiles map[string]bool, db *gorm.DB, wg *sync.WaitGroup) {
 	//func (d Downloader) Download(w io.WriterAt, input *s3.GetObjectInput, options ...func(*Downloader)) (n int64, err error)
 	wg.Add(1)
 	defer log.Debugf("Copy worker returning")
@@ -38,6 +65,12 @@ func CopyWorker(source <-chan string, destpath string, downloader *s3manager.Dow
 	for filename := range source {
 		ignore, ok := ignoreFiles[filename]
 		if !ok || (ok && !ignore) {
+			//record the source first, so the binary is scanned with its externals once it lands
+			if db != nil {
+				if err := recordSource(db, downloader.S3, bucket, filename); err != nil {
+					log.Errorf("Copy worker recording source of %s %v", filename, err)
+				}
+			}
 			outfile, err := os.OpenFile(filepath.Join(destpath, filename), os.O_WRONLY|os.O_CREATE, 0755)
 			if err != nil {
 				log.Fatalf("Copy worker %v", err)
@@ -122,7 +155,7 @@ func (syncer *Syncer) Close() {
 func (syncer *Syncer) Start(workerNum int) {
 	if !syncer.started {
 		for i := 0; i < workerNum; i++ {
-			go CopyWorker(syncer.toCopy, syncer.DestDir, syncer.downloader, syncer.SourceBucket, syncer.ignoreFiles, syncer.workersdone)
+			go CopyWorker(syncer.toCopy, syncer.DestDir, syncer.downloader, syncer.SourceBucket, syncer.ignoreFiles, syncer.DB, syncer.workersdone)
 		}
 		syncer.workerexits = make([]chan bool, 2)
 		syncer.workerexits[0] = make(chan bool, 1)
@@ -136,8 +169,8 @@ func (syncer *Syncer) Start(workerNum int) {
 	}
 }
 
-//NewSyncer returns a Syncer or an error if construction fails
-func NewSyncer(srcBkt, destDir, endpointURL, awsregion, awsaccessid, awsaccesskey string, disableSSL, s3ForcePathStyle bool) (syncer *Syncer, err error) {
+//NewS3 returns an S3 client for the given endpoint, region and credentials, defaulting to the aws config for anything not set
+func NewS3(endpointURL, awsregion, awsaccessid, awsaccesskey string, disableSSL, s3ForcePathStyle bool) *s3.S3 {
 
 	awsCfg := aws.Config{}
 
@@ -160,11 +193,18 @@ func NewSyncer(srcBkt, destDir, endpointURL, awsregion, awsaccessid, awsaccesske
 
 	sess := session.Must(session.NewSession(&awsCfg))
 
+	return s3.New(sess)
+}
+
+//NewSyncer returns a Syncer or an error if construction fails
+func NewSyncer(srcBkt, destDir, endpointURL, awsregion, awsaccessid, awsaccesskey string, disableSSL, s3ForcePathStyle bool) (syncer *Syncer, err error) {
+
 	// The S3 client the S3 Downloader will use
+	s3svc := NewS3(endpointURL, awsregion, awsaccessid, awsaccesskey, disableSSL, s3ForcePathStyle)
 	s3ticker := time.NewTicker(1 * time.Second)
 	fsticker := time.NewTicker(1 * time.Second)
 
-	syncer = &Syncer{SourceBucket: srcBkt, DestDir: destDir, S3SVC: s3.New(sess), ignoreFiles: make(map[string]bool), toCopy: make(chan string, 10000), s3ticker: s3ticker, fsticker: fsticker, started: false, workersdone: &sync.WaitGroup{}, workerexits: make([]chan bool, 0)}
+	syncer = &Syncer{SourceBucket: srcBkt, DestDir: destDir, S3SVC: s3svc, ignoreFiles: make(map[string]bool), toCopy: make(chan string, 10000), s3ticker: s3ticker, fsticker: fsticker, started: false, workersdone: &sync.WaitGroup{}, workerexits: make([]chan bool, 0)}
 	// Create a downloader with the s3 client and default options
 	syncer.downloader = s3manager.NewDownloaderWithClient(syncer.S3SVC)
 
@@ -0,0 +1,235 @@
+package yarascanner
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/hillu/go-yara"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//BundleExts are the extensions of the rule bundle archives accepted in a rule directory
+var BundleExts = []string{".zip", ".tar.gz", ".tgz", ".tar"}
+
+//RuleSourceExts are the extensions of the rule sources compiled from a bundle, other members are ignored
+var RuleSourceExts = map[string]bool{".yar": true, ".yara": true}
+
+//MaxBundleMemberSize bounds the size of a single rule source unpacked from a bundle
+var MaxBundleMemberSize int64 = 64 << 20
+
+//MaxBundleSize bounds the total size of the rule sources unpacked from a bundle
+var MaxBundleSize int64 = 256 << 20
+
+//MaxBundleMembers bounds the number of members of a bundle, counting those that aren't rule sources
+var MaxBundleMembers = 10000
+
+//bundleExt returns the archive extension of name, or "" if it isn't a rule bundle
+func bundleExt(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range BundleExts {
+		if strings.HasSuffix(lower, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+//BundleNamespace returns the namespace the rules of a bundle are compiled under, the archive name without its extension
+func BundleNamespace(name string) string {
+	return name[:len(name)-len(bundleExt(name))]
+}
+
+//bundleMember is a rule source read from a bundle
+type bundleMember struct {
+	name string
+	data []byte
+}
+
+//isBundleSource returns whether an archive member is a rule source to compile, skipping hidden files like __MACOSX/._x
+func isBundleSource(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || strings.HasPrefix(part, "__") {
+			return false
+		}
+	}
+	return RuleSourceExts[strings.ToLower(path.Ext(name))]
+}
+
+//bundleReader reads the members of a bundle within MaxBundleMembers, MaxBundleMemberSize and MaxBundleSize
+type bundleReader struct {
+	members  []bundleMember
+	count    int
+	unpacked int64
+}
+
+//next counts a member of the archive, failing once there are more than MaxBundleMembers
+func (br *bundleReader) next() error {
+	br.count++
+	if br.count > MaxBundleMembers {
+		return fmt.Errorf("more than %d members", MaxBundleMembers)
+	}
+	return nil
+}
+
+//read reads a rule source of the archive up to MaxBundleMemberSize, and up to what is left of MaxBundleSize
+func (br *bundleReader) read(name string, reader io.Reader) error {
+	limit := MaxBundleMemberSize
+	if left := MaxBundleSize - br.unpacked; left < limit {
+		limit = left
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return fmt.Errorf("member %s - %v", name, err)
+	}
+	if int64(len(data)) > MaxBundleMemberSize {
+		return fmt.Errorf("member %s is larger than %d bytes", name, MaxBundleMemberSize)
+	}
+	br.unpacked += int64(len(data))
+	if br.unpacked > MaxBundleSize {
+		return fmt.Errorf("rule sources larger than %d bytes in total", MaxBundleSize)
+	}
+	br.members = append(br.members, bundleMember{name: name, data: data})
+	return nil
+}
+
+//readZipBundle returns the rule sources of a zip archive
+func readZipBundle(data []byte) ([]bundleMember, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	br := &bundleReader{}
+	for _, file := range archive.File {
+		if err := br.next(); err != nil {
+			return nil, err
+		}
+		if file.FileInfo().IsDir() || !isBundleSource(file.Name) {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("member %s - %v", file.Name, err)
+		}
+		err = br.read(file.Name, reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return br.members, nil
+}
+
+//readTarBundle returns the rule sources of a tar archive, gunzipping it first when compressed
+func readTarBundle(data []byte, compressed bool) ([]bundleMember, error) {
+	var reader io.Reader = bytes.NewReader(data)
+	if compressed {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	archive := tar.NewReader(reader)
+	br := &bundleReader{}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return br.members, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := br.next(); err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		if header.Typeflag != tar.TypeReg || !isBundleSource(name) {
+			continue
+		}
+		if err := br.read(name, archive); err != nil {
+			return nil, err
+		}
+	}
+}
+
+//readBundle returns the rule sources of a bundle archive sorted by name
+func readBundle(name string, data []byte) ([]bundleMember, error) {
+	var members []bundleMember
+	var err error
+	switch bundleExt(name) {
+	case ".zip":
+		members, err = readZipBundle(data)
+	case ".tar":
+		members, err = readTarBundle(data, false)
+	default:
+		members, err = readTarBundle(data, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].name < members[j].name })
+	return members, nil
+}
+
+//compileBundle compiles the rule sources of a bundle in RuleDir under the bundle's namespace, from its verified contents when given.
+//Members are compiled from memory, so includes between them are not resolved
+func (wrp *WatchedRulesetProvider) compileBundle(name, bundleHash string, verified []byte) (*yara.Rules, error) {
+	cache := wrp.ruleCache()
+	cacheKey := wrp.cacheKey(bundleHash)
+	if cache != nil {
+		rules, err := cache.Load(cacheKey)
+		if err != nil {
+			log.Errorf("Error loading cached bundle %s %s, recompiling - %v", name, bundleHash, err)
+		} else if rules != nil {
+			log.Infof("Loaded cached bundle %s", name)
+			return rules, nil
+		}
+	}
+	data := verified
+	if data == nil {
+		var err error
+		if data, err = ioutil.ReadFile(filepath.Join(wrp.RuleDir, name)); err != nil {
+			return nil, err
+		}
+	}
+	members, err := readBundle(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("no rule sources")
+	}
+	compiler, err := wrp.newCompiler()
+	if err != nil {
+		return nil, err
+	}
+	defer compiler.Destroy()
+	//members are compiled from memory, an include would pull in files from outside of the bundle
+	compiler.DisableIncludes()
+	namespace := BundleNamespace(name)
+	for _, member := range members {
+		if err := compiler.AddString(string(member.data), namespace); err != nil {
+			return nil, fmt.Errorf("member %s - %v", member.name, err)
+		}
+	}
+	rules, err := compiler.GetRules()
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Compiled bundle %s, %d rule files in namespace %s", name, len(members), namespace)
+	if cache != nil {
+		if err := cache.Save(cacheKey, rules); err != nil {
+			log.Errorf("Error caching bundle %s %s - %v", name, bundleHash, err)
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,92 @@
+package yarascanner
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//tarArchive returns a tar archive of files, gzipped when compressed
+func tarArchive(t *testing.T, files map[string]string, compressed bool) []byte {
+	buf := &bytes.Buffer{}
+	archive := tar.NewWriter(buf)
+	for name, content := range files {
+		if err := archive.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("Error archiving %s %v", name, err)
+		}
+		archive.Write([]byte(content))
+	}
+	archive.Close()
+	if !compressed {
+		return buf.Bytes()
+	}
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	gz.Write(buf.Bytes())
+	gz.Close()
+	return gzipped.Bytes()
+}
+
+//Test the rule sources of zip, tar and tgz bundles compile under the bundle's namespace, skipping other members
+func TestBundles(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "bundles")
+	defer os.RemoveAll(dir)
+	members := func(rule string) map[string]string {
+		return map[string]string{"rules/" + rule + ".yar": "rule " + rule + " { condition: true }", "README.md": "not a rule",
+			"__MACOSX/rules/._" + rule + ".yar": "\x00\x05", "rules/.hidden.yar": "not compiled"}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "z.zip"), zipArchive(t, members("zipped")), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "t.tar"), tarArchive(t, members("tarred"), false), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "g.tgz"), tarArchive(t, members("gzipped"), true), 0644)
+	wrp, _ := NewWatchedRulesetProvider(dir, gdb, nil)
+	if err := wrp.LoadRules(); err != nil {
+		t.Fatalf("Error loading bundles %v", err)
+	}
+	ruleset, _ := wrp.GetRules()
+	if rules := strings.Join(rulesetRules(ruleset), " "); rules != "g:gzipped t:tarred z:zipped" {
+		t.Fatalf("Expected a rule of each bundle, got %s", rules)
+	}
+
+	defer func(memberSize, size int64, count int) {
+		MaxBundleMemberSize, MaxBundleSize, MaxBundleMembers = memberSize, size, count
+	}(MaxBundleMemberSize, MaxBundleSize, MaxBundleMembers)
+	MaxBundleMemberSize, MaxBundleSize, MaxBundleMembers = 100, 150, 4
+	large := "rule large { condition: true }" + strings.Repeat(" ", 80)
+	cases := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{"b.zip", map[string]string{"a.yar": large}, "larger than 100 bytes"},
+		{"b.tgz", map[string]string{"a.yar": large}, "larger than 100 bytes"},
+		{"b.tar", map[string]string{"a.yar": strings.Repeat(" ", 80), "b.yar": strings.Repeat(" ", 80)}, "150 bytes in total"},
+		{"b.zip", map[string]string{"a.yar": strings.Repeat(" ", 80), "b.yar": strings.Repeat(" ", 80)}, "150 bytes in total"},
+		{"b.zip", map[string]string{"a.txt": "", "b.txt": "", "c.txt": "", "d.txt": "", "e.yar": "rule e { condition: true }"}, "more than 4 members"},
+		{"b.tar", map[string]string{"a.txt": "", "b.txt": "", "c.txt": "", "d.txt": "", "e.yar": "rule e { condition: true }"}, "more than 4 members"},
+		{"b.zip", map[string]string{"README.md": "no rules"}, "no rule sources"},
+	}
+	for _, c := range cases {
+		data := zipArchive(t, c.files)
+		if bundleExt(c.name) != ".zip" {
+			data = tarArchive(t, c.files, bundleExt(c.name) != ".tar")
+		}
+		if _, err := readBundle(c.name, data); c.err == "no rule sources" && err != nil {
+			t.Fatalf("Expected %s read without rule sources, got %v", c.name, err)
+		}
+		ioutil.WriteFile(filepath.Join(dir, c.name), data, 0644)
+		if _, err := wrp.reload(c.name); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s %v expected %q got %v", c.name, c.files, c.err, err)
+		}
+		os.Remove(filepath.Join(dir, c.name))
+	}
+	if current, _ := wrp.GetRules(); current != ruleset {
+		t.Fatalf("Expected the active ruleset kept after refusing the bundles")
+	}
+}
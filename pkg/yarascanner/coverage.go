@@ -0,0 +1,165 @@
+package yarascanner
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"sort"
+	"strings"
+	"time"
+)
+
+//CoverageWindow is a time window hits are counted over, named like 7d
+type CoverageWindow struct {
+	Name     string
+	Duration time.Duration
+}
+
+//DefaultCoverageWindows count the hits of the last day, week and month
+var DefaultCoverageWindows = []CoverageWindow{{"1d", 24 * time.Hour}, {"7d", 7 * 24 * time.Hour}, {"30d", 30 * 24 * time.Hour}}
+
+//DefaultNoisyShare flags the rules matching over 5% of the corpus as noisy
+var DefaultNoisyShare = 0.05
+
+//ParseCoverageWindows parses a comma separated list of windows, Go durations or days like 7d
+func ParseCoverageWindows(raw string) ([]CoverageWindow, error) {
+	windows := make([]CoverageWindow, 0)
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.TrimSpace(name); len(name) == 0 {
+			continue
+		}
+		duration, err := parseAge(name)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("window %s must be a positive duration like 12h or 7d", name)
+		}
+		windows = append(windows, CoverageWindow{Name: name, Duration: duration})
+	}
+	return windows, nil
+}
+
+//RuleCoverage is how much of the corpus a rule matches
+type RuleCoverage struct {
+	Namespace string
+	RuleName  string
+	//Indexed is false for rules with results that are no longer in the rule index, State is the indexed lifecycle state
+	Indexed bool
+	State   string
+	//Hits counts the binaries the rule started matching, or matched again after it stopped, within each window, keyed by the window's name
+	Hits map[string]int
+	//Binaries is the number of binaries the rule currently matches, AllTimeBinaries counts those it stopped matching too
+	Binaries        int
+	AllTimeBinaries int
+	//Share is the fraction of the corpus the rule currently matches
+	Share        float64
+	Noisy        bool
+	NeverMatched bool
+}
+
+//CoverageReport is the coverage of every indexed rule, and of the rules with results no longer indexed, over the corpus
+type CoverageReport struct {
+	GeneratedAt time.Time
+	//Corpus is the number of binaries stored
+	Corpus       int
+	Windows      []string
+	NoisyShare   float64
+	Shadow       bool
+	NeverMatched int
+	Noisy        int
+	Rules        []RuleCoverage
+}
+
+//ruleCount is the number of distinct binaries of a rule's results
+type ruleCount struct {
+	Namespace string
+	RuleName  string
+	Count     int
+}
+
+//countResults counts the distinct binaries of the results of each rule matching the conditions of query
+func countResults(query *gorm.DB) (map[string]int, error) {
+	counts := make([]ruleCount, 0)
+	err := query.Model(&models.Result{}).Select("namespace, rule_name, count(distinct binary_hash) as count").Group("namespace, rule_name").Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	keyed := make(map[string]int, len(counts))
+	for _, count := range counts {
+		keyed[ruleKey(count.Namespace, count.RuleName)] = count.Count
+	}
+	return keyed, nil
+}
+
+//BuildCoverageReport reports, per rule, the binaries it matched within each window, the binaries it matches now and ever
+//matched, whether it never matched and whether it matches over noisyShare of the corpus. It covers the production results,
+//or the shadow results of the draft and testing rules when shadow is set
+func BuildCoverageReport(db *gorm.DB, windows []CoverageWindow, noisyShare float64, shadow bool) (*CoverageReport, error) {
+	now := time.Now()
+	report := &CoverageReport{GeneratedAt: now, NoisyShare: noisyShare, Shadow: shadow, Rules: make([]RuleCoverage, 0)}
+	if err := db.Model(&models.Binary{}).Count(&report.Corpus).Error; err != nil {
+		return nil, err
+	}
+	results := db.Where("shadow = ?", shadow)
+	allTime, err := countResults(results)
+	if err != nil {
+		return nil, err
+	}
+	open, err := countResults(results.Where("closed_at IS NULL"))
+	if err != nil {
+		return nil, err
+	}
+	hits := make([]map[string]int, len(windows))
+	for i, window := range windows {
+		since := now.Add(-window.Duration)
+		//a hit is a result opened or reopened within the window, rescans of a result still open don't count again.
+		//Results recorded before reconciliation have no changes nor first seen time, zero or NULL for rows older than the
+		//column, their creation is when they were opened
+		changed := db.Model(&models.ResultChange{}).Select("result_id").
+			Where("change IN (?) AND created_at >= ?", []string{models.ResultOpened, models.ResultReopened}, since).SubQuery()
+		query := results.Where("id IN (?) OR first_seen_at >= ? OR ((first_seen_at IS NULL OR first_seen_at <= ?) AND created_at >= ?)",
+			changed, since, time.Time{}, since)
+		if hits[i], err = countResults(query); err != nil {
+			return nil, err
+		}
+		report.Windows = append(report.Windows, window.Name)
+	}
+	rules := make(map[string]*RuleCoverage)
+	indexed := make([]models.Rule, 0)
+	if err := db.Find(&indexed).Error; err != nil {
+		return nil, err
+	}
+	for _, rule := range indexed {
+		rules[ruleKey(rule.Namespace, rule.Identifier)] = &RuleCoverage{Namespace: rule.Namespace, RuleName: rule.Identifier, Indexed: true, State: rule.State}
+	}
+	counted := make([]ruleCount, 0)
+	if err := results.Model(&models.Result{}).Select("distinct namespace, rule_name").Scan(&counted).Error; err != nil {
+		return nil, err
+	}
+	for _, rule := range counted {
+		if _, ok := rules[ruleKey(rule.Namespace, rule.RuleName)]; !ok {
+			rules[ruleKey(rule.Namespace, rule.RuleName)] = &RuleCoverage{Namespace: rule.Namespace, RuleName: rule.RuleName}
+		}
+	}
+	for key, coverage := range rules {
+		coverage.Hits = make(map[string]int, len(windows))
+		for i, window := range windows {
+			coverage.Hits[window.Name] = hits[i][key]
+		}
+		coverage.Binaries, coverage.AllTimeBinaries = open[key], allTime[key]
+		if report.Corpus > 0 {
+			coverage.Share = float64(coverage.Binaries) / float64(report.Corpus)
+		}
+		coverage.NeverMatched = coverage.AllTimeBinaries == 0
+		coverage.Noisy = coverage.Binaries > 0 && coverage.Share > noisyShare
+		if coverage.NeverMatched {
+			report.NeverMatched++
+		}
+		if coverage.Noisy {
+			report.Noisy++
+		}
+		report.Rules = append(report.Rules, *coverage)
+	}
+	sort.Slice(report.Rules, func(i, j int) bool {
+		return ruleKey(report.Rules[i].Namespace, report.Rules[i].RuleName) < ruleKey(report.Rules[j].Namespace, report.Rules[j].RuleName)
+	})
+	return report, nil
+}
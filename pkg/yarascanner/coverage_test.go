@@ -0,0 +1,76 @@
+package yarascanner
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"testing"
+	"time"
+)
+
+//Test the coverage report counts hits per window and distinct binaries, and finds the rules never matched and the noisy ones
+func TestCoverageReport(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	for i := 0; i < 10; i++ {
+		gdb.Create(&models.Binary{Hash: fmt.Sprintf("bin%d", i)})
+	}
+	gdb.Create(&models.Rule{Namespace: "a.yar", Identifier: "noisy", State: models.RuleStateProduction})
+	gdb.Create(&models.Rule{Namespace: "a.yar", Identifier: "rare", State: models.RuleStateProduction})
+	gdb.Create(&models.Rule{Namespace: "a.yar", Identifier: "dead", State: models.RuleStateProduction})
+	now := time.Now()
+	old := now.Add(-10 * 24 * time.Hour)
+	//the noisy results were opened 10 days ago and rescanned today, the one of bin0 was closed since and reopened today
+	for i := 0; i < 3; i++ {
+		result := models.Result{BinaryHash: fmt.Sprintf("bin%d", i), Namespace: "a.yar", RuleName: "noisy", FirstSeenAt: old, LastSeenAt: now}
+		gdb.Create(&result)
+		gdb.Create(&models.ResultChange{Model: gorm.Model{CreatedAt: old}, ResultID: result.ID, BinaryHash: result.BinaryHash, Change: models.ResultOpened})
+		if i == 0 {
+			gdb.Create(&models.ResultChange{Model: gorm.Model{CreatedAt: old}, ResultID: result.ID, BinaryHash: result.BinaryHash, Change: models.ResultClosed})
+			gdb.Create(&models.ResultChange{ResultID: result.ID, BinaryHash: result.BinaryHash, Change: models.ResultReopened})
+		}
+	}
+	gdb.Create(&models.Result{BinaryHash: "bin0", Namespace: "a.yar", RuleName: "rare", FirstSeenAt: old, LastSeenAt: old})
+	gdb.Create(&models.Result{BinaryHash: "bin1", Namespace: "a.yar", RuleName: "rare", FirstSeenAt: old, LastSeenAt: old, ClosedAt: &old})
+	gdb.Create(&models.Result{BinaryHash: "bin2", Namespace: "a.yar", RuleName: "dead", Shadow: true, FirstSeenAt: now, LastSeenAt: now})
+	gdb.Create(&models.Result{BinaryHash: "bin3", Namespace: "gone.yar", RuleName: "removed", FirstSeenAt: old, LastSeenAt: old})
+	gdb.Create(&models.Result{BinaryHash: "bin4", Namespace: "gone.yar", RuleName: "legacy"})
+	//rows recorded before the first seen column was added have it NULL
+	migrated := models.Result{BinaryHash: "bin5", Namespace: "gone.yar", RuleName: "legacy"}
+	gdb.Create(&migrated)
+	gdb.Model(&migrated).UpdateColumn("first_seen_at", gorm.Expr("NULL"))
+
+	windows, err := ParseCoverageWindows("1d, 30d")
+	if err != nil {
+		t.Fatalf("Error parsing windows %v", err)
+	}
+	report, err := BuildCoverageReport(gdb, windows, 0.2, false)
+	if err != nil {
+		t.Fatalf("Error building the coverage report %v", err)
+	}
+	coverage := make(map[string]RuleCoverage)
+	for _, rule := range report.Rules {
+		coverage[ruleKey(rule.Namespace, rule.RuleName)] = rule
+	}
+	if report.Corpus != 10 || len(report.Rules) != 5 || report.NeverMatched != 1 || report.Noisy != 1 {
+		t.Fatalf("Expected 5 rules over 10 binaries, 1 never matched and 1 noisy, got %+v", report)
+	}
+	if noisy := coverage["a.yar:noisy"]; !noisy.Noisy || noisy.Binaries != 3 || noisy.Hits["1d"] != 1 || noisy.Hits["30d"] != 3 || noisy.Share != 0.3 {
+		t.Fatalf("Expected the noisy rule matching 3 binaries, only reopened on 1 today, got %+v", noisy)
+	}
+	if rare := coverage["a.yar:rare"]; rare.Noisy || rare.Binaries != 1 || rare.AllTimeBinaries != 2 || rare.Hits["1d"] != 0 || rare.Hits["30d"] != 2 {
+		t.Fatalf("Expected the rare rule matching 1 binary, 2 ever, none today, got %+v", rare)
+	}
+	if dead := coverage["a.yar:dead"]; !dead.NeverMatched {
+		t.Fatalf("Expected the rule only matching in the shadow ruleset never matched in production, got %+v", dead)
+	}
+	if removed := coverage["gone.yar:removed"]; removed.Indexed || removed.Binaries != 1 {
+		t.Fatalf("Expected the removed rule reported as not indexed, got %+v", removed)
+	}
+	if legacy := coverage["gone.yar:legacy"]; legacy.Hits["1d"] != 2 {
+		t.Fatalf("Expected the results recorded before reconciliation counted when they were created, got %+v", legacy)
+	}
+	if _, err := ParseCoverageWindows("soon"); err == nil {
+		t.Fatalf("Expected an invalid window refused")
+	}
+}
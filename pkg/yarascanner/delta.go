@@ -0,0 +1,472 @@
+package yarascanner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/hillu/go-yara"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//ruleBlock is the source of a single rule
+type ruleBlock struct {
+	identifier string
+	text       string
+	global     bool
+	//references are the rules declared before it that its source mentions, it may depend on them
+	references []string
+}
+
+//namespaceSource is the source of the rules of a namespace, split into rules so a delta of some of them can be compiled
+type namespaceSource struct {
+	namespace string
+	//texts are the source files of the namespace, compiled as is when they couldn't be split
+	texts   []string
+	split   bool
+	imports []string
+	rules   []ruleBlock
+	//identifiers are the rules the namespace was compiled into
+	identifiers []string
+}
+
+var identifierPattern = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+
+//sourceScanner walks yara source, skipping comments, text strings and regular expressions, which may hold braces
+type sourceScanner struct {
+	src string
+	pos int
+}
+
+//skipSpace moves past whitespace and comments
+func (ss *sourceScanner) skipSpace() error {
+	for ss.pos < len(ss.src) {
+		switch {
+		case strings.ContainsRune(" \t\r\n", rune(ss.src[ss.pos])):
+			ss.pos++
+		case strings.HasPrefix(ss.src[ss.pos:], "//"):
+			end := strings.IndexByte(ss.src[ss.pos:], '\n')
+			if end < 0 {
+				ss.pos = len(ss.src)
+			} else {
+				ss.pos += end + 1
+			}
+		case strings.HasPrefix(ss.src[ss.pos:], "/*"):
+			end := strings.Index(ss.src[ss.pos+2:], "*/")
+			if end < 0 {
+				return fmt.Errorf("unterminated comment")
+			}
+			ss.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+//skipDelimited moves past a text string or regular expression starting at pos, honouring escapes
+func (ss *sourceScanner) skipDelimited(delimiter byte) error {
+	for i := ss.pos + 1; i < len(ss.src); i++ {
+		switch ss.src[i] {
+		case '\\':
+			i++
+		case '\n':
+			return fmt.Errorf("unterminated %c at offset %d", delimiter, ss.pos)
+		case delimiter:
+			ss.pos = i + 1
+			return nil
+		}
+	}
+	return fmt.Errorf("unterminated %c at offset %d", delimiter, ss.pos)
+}
+
+//word reads an identifier or keyword
+func (ss *sourceScanner) word() string {
+	found := identifierPattern.FindStringIndex(ss.src[ss.pos:])
+	if found == nil || found[0] != 0 {
+		return ""
+	}
+	ss.pos += found[1]
+	return ss.src[ss.pos-found[1] : ss.pos]
+}
+
+//skipBody moves past the body of a rule from its opening brace to the matching closing one
+func (ss *sourceScanner) skipBody() error {
+	depth := 0
+	for ss.pos < len(ss.src) {
+		if err := ss.skipSpace(); err != nil {
+			return err
+		}
+		if ss.pos >= len(ss.src) {
+			break
+		}
+		switch ss.src[ss.pos] {
+		case '"':
+			if err := ss.skipDelimited('"'); err != nil {
+				return err
+			}
+			continue
+		case '/':
+			//yara divides with \, a slash outside of comments opens a regular expression
+			if err := ss.skipDelimited('/'); err != nil {
+				return err
+			}
+			continue
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				ss.pos++
+				return nil
+			}
+		}
+		ss.pos++
+	}
+	return fmt.Errorf("unterminated rule body")
+}
+
+//splitRuleSource splits a rule source file into its imports and rules.
+//Sources including other files are refused, their rules can't be compiled apart
+func splitRuleSource(src string) ([]string, []ruleBlock, error) {
+	ss := &sourceScanner{src: src}
+	imports := make([]string, 0)
+	rules := make([]ruleBlock, 0)
+	declared := make(map[string]bool)
+	for {
+		if err := ss.skipSpace(); err != nil {
+			return nil, nil, err
+		}
+		if ss.pos >= len(src) {
+			return imports, rules, nil
+		}
+		start := ss.pos
+		keyword := ss.word()
+		switch keyword {
+		case "import":
+			if err := ss.skipSpace(); err != nil {
+				return nil, nil, err
+			}
+			if ss.pos >= len(src) || src[ss.pos] != '"' {
+				return nil, nil, fmt.Errorf("malformed import at offset %d", start)
+			}
+			if err := ss.skipDelimited('"'); err != nil {
+				return nil, nil, err
+			}
+			imports = append(imports, src[start:ss.pos])
+		case "private", "global", "rule":
+			block := ruleBlock{}
+			for keyword != "rule" {
+				if keyword == "global" {
+					block.global = true
+				} else if keyword != "private" {
+					return nil, nil, fmt.Errorf("unexpected %q at offset %d", keyword, start)
+				}
+				if err := ss.skipSpace(); err != nil {
+					return nil, nil, err
+				}
+				keyword = ss.word()
+			}
+			if err := ss.skipSpace(); err != nil {
+				return nil, nil, err
+			}
+			block.identifier = ss.word()
+			if len(block.identifier) == 0 {
+				return nil, nil, fmt.Errorf("rule without identifier at offset %d", start)
+			}
+			brace := strings.IndexByte(src[ss.pos:], '{')
+			if brace < 0 {
+				return nil, nil, fmt.Errorf("rule %s without body", block.identifier)
+			}
+			ss.pos += brace
+			if err := ss.skipBody(); err != nil {
+				return nil, nil, fmt.Errorf("rule %s - %v", block.identifier, err)
+			}
+			block.text = src[start:ss.pos]
+			seen := make(map[string]bool)
+			for _, word := range identifierPattern.FindAllString(block.text, -1) {
+				if declared[word] && !seen[word] {
+					seen[word] = true
+					block.references = append(block.references, word)
+				}
+			}
+			declared[block.identifier] = true
+			rules = append(rules, block)
+		case "include":
+			return nil, nil, fmt.Errorf("includes other files")
+		default:
+			return nil, nil, fmt.Errorf("unexpected %q at offset %d", src[start:minInt(start+10, len(src))], start)
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+//newNamespaceSource splits the source files of a namespace, identifiers are the rules it was compiled into.
+//A namespace whose split doesn't account for exactly those rules is kept whole
+func newNamespaceSource(namespace string, texts []string, identifiers []string) *namespaceSource {
+	source := &namespaceSource{namespace: namespace, texts: texts, identifiers: identifiers}
+	imports := make([]string, 0)
+	rules := make([]ruleBlock, 0)
+	for _, text := range texts {
+		textImports, textRules, err := splitRuleSource(text)
+		if err != nil {
+			log.Debugf("Rules of namespace %s compiled together in deltas, the source can't be split - %v", namespace, err)
+			return source
+		}
+		imports = append(imports, textImports...)
+		rules = append(rules, textRules...)
+	}
+	split := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		split = append(split, rule.identifier)
+	}
+	compiled := append([]string{}, identifiers...)
+	sort.Strings(split)
+	sort.Strings(compiled)
+	if strings.Join(split, ",") != strings.Join(compiled, ",") {
+		log.Debugf("Rules of namespace %s compiled together in deltas, the rules split don't match the rules compiled", namespace)
+		return source
+	}
+	source.split, source.imports, source.rules = true, imports, rules
+	return source
+}
+
+//fingerprints returns a hash of the source of every rule of the namespace keyed by ruleKey, covering the imports,
+//the global rules and the rules it references, so a rule changes when anything its matches depend on changes.
+//Rules of a namespace that couldn't be split share the hash of the whole source
+func (source *namespaceSource) fingerprints() map[string]string {
+	fingerprints := make(map[string]string, len(source.identifiers))
+	if !source.split {
+		hasher := sha256.New()
+		for _, text := range source.texts {
+			io.WriteString(hasher, text)
+			io.WriteString(hasher, "\x00")
+		}
+		whole := hex.EncodeToString(hasher.Sum(nil))
+		for _, identifier := range source.identifiers {
+			fingerprints[ruleKey(source.namespace, identifier)] = whole
+		}
+		return fingerprints
+	}
+	common := sha256.New()
+	for _, text := range source.imports {
+		io.WriteString(common, text+"\x00")
+	}
+	for _, rule := range source.rules {
+		if rule.global {
+			io.WriteString(common, rule.text+"\x00")
+		}
+	}
+	commonHash := hex.EncodeToString(common.Sum(nil))
+	byIdentifier := make(map[string]string, len(source.rules))
+	for _, rule := range source.rules {
+		hasher := sha256.New()
+		io.WriteString(hasher, commonHash)
+		io.WriteString(hasher, rule.text)
+		//references are declared before, so their fingerprints are known
+		for _, reference := range rule.references {
+			io.WriteString(hasher, "\x00"+byIdentifier[reference])
+		}
+		byIdentifier[rule.identifier] = hex.EncodeToString(hasher.Sum(nil))
+		fingerprints[ruleKey(source.namespace, rule.identifier)] = byIdentifier[rule.identifier]
+	}
+	return fingerprints
+}
+
+//deltaSource returns the source to compile for the rules of the namespace in scope, with the imports, global rules
+//and the rules they reference, or nil if none of its rules are in scope
+func (source *namespaceSource) deltaSource(scope map[string]bool) []string {
+	inScope := false
+	for _, identifier := range source.identifiers {
+		if scope[ruleKey(source.namespace, identifier)] {
+			inScope = true
+			break
+		}
+	}
+	if !inScope {
+		return nil
+	}
+	if !source.split {
+		return source.texts
+	}
+	needed := make(map[string]bool)
+	for i := len(source.rules) - 1; i >= 0; i-- {
+		rule := source.rules[i]
+		if rule.global || scope[ruleKey(source.namespace, rule.identifier)] {
+			needed[rule.identifier] = true
+		}
+		if needed[rule.identifier] {
+			for _, reference := range rule.references {
+				needed[reference] = true
+			}
+		}
+	}
+	parts := append([]string{}, source.imports...)
+	for _, rule := range source.rules {
+		if needed[rule.identifier] {
+			parts = append(parts, rule.text)
+		}
+	}
+	return []string{strings.Join(parts, "\n\n")}
+}
+
+//readRuleSource returns the contents of a rule file in RuleDir, its verified contents when given
+func (wrp *WatchedRulesetProvider) readRuleSource(name string, verified map[string][]byte) ([]byte, error) {
+	if data, ok := verified[name]; ok {
+		return data, nil
+	}
+	return ioutil.ReadFile(filepath.Join(wrp.RuleDir, name))
+}
+
+//fingerprintRules records the fingerprint of every rule of a ruleset built from the given sources and bundles.
+//Rules of precompiled units are fingerprinted by the hash of their file. The fingerprints are left unset when
+//a source can't be read again, rule changes then rescan with the whole ruleset
+func (wrp *WatchedRulesetProvider) fingerprintRules(ruleset *Ruleset, verified map[string][]byte) {
+	fingerprints := make(map[string]string)
+	sources := make(map[string]*namespaceSource)
+	for unit, rules := range ruleset.Rules {
+		origin := ruleset.Origins[unit]
+		identifiers := make(map[string][]string)
+		for _, rule := range rules.GetRules() {
+			identifiers[rule.Namespace()] = append(identifiers[rule.Namespace()], rule.Identifier())
+			if len(origin) > 0 && len(bundleExt(origin)) == 0 {
+				fingerprints[ruleKey(rule.Namespace(), rule.Identifier())] = "compiled:" + ruleset.Files[origin]
+			}
+		}
+		if len(origin) > 0 && len(bundleExt(origin)) == 0 {
+			continue
+		}
+		var texts map[string][]string
+		if len(origin) == 0 {
+			//sources are compiled in the namespace of their file name
+			texts = make(map[string][]string)
+			for namespace := range identifiers {
+				data, err := wrp.readRuleSource(namespace, verified)
+				if err != nil {
+					log.Errorf("Error reading rule source %s, rule changes will rescan with the whole ruleset - %v", namespace, err)
+					return
+				}
+				texts[namespace] = []string{string(data)}
+			}
+		} else {
+			data, err := wrp.readRuleSource(origin, verified)
+			var members []bundleMember
+			if err == nil {
+				members, err = readBundle(origin, data)
+			}
+			if err != nil {
+				log.Errorf("Error reading rule bundle %s, rule changes will rescan with the whole ruleset - %v", origin, err)
+				return
+			}
+			namespace := BundleNamespace(origin)
+			texts = map[string][]string{namespace: nil}
+			for _, member := range members {
+				texts[namespace] = append(texts[namespace], string(member.data))
+			}
+		}
+		for namespace, namespaceTexts := range texts {
+			source := newNamespaceSource(namespace, namespaceTexts, identifiers[namespace])
+			sources[namespace] = source
+			for key, fingerprint := range source.fingerprints() {
+				fingerprints[key] = fingerprint
+			}
+		}
+	}
+	ruleset.Fingerprints, ruleset.sources = fingerprints, sources
+}
+
+//buildDelta compiles the delta of a ruleset against the previous one, the rules added or whose fingerprint or state changed.
+//Removed rules are in its Scope without being compiled, so their results get closed by the delta rescans.
+//It returns nil when binaries must be rescanned with the whole ruleset, ie when the scan options changed
+func (wrp *WatchedRulesetProvider) buildDelta(previous, ruleset *Ruleset) (*Ruleset, error) {
+	if previous == nil || previous.Fingerprints == nil || ruleset.Fingerprints == nil || previous.ScanOptions != ruleset.ScanOptions {
+		return nil, nil
+	}
+	scope := make(map[string]bool)
+	for key, fingerprint := range ruleset.Fingerprints {
+		if previous.Fingerprints[key] != fingerprint || previous.States[key] != ruleset.States[key] {
+			scope[key] = true
+		}
+	}
+	removed := 0
+	for key := range previous.Fingerprints {
+		if _, ok := ruleset.Fingerprints[key]; !ok {
+			scope[key] = true
+			removed++
+		}
+	}
+	delta := &Ruleset{Hash: ruleset.Hash, Files: ruleset.Files, Revision: ruleset.Revision, ScanOptions: ruleset.ScanOptions,
+		Base: previous.Version, Scope: scope}
+	if len(scope) > removed {
+		compiler, err := wrp.newCompiler()
+		if err != nil {
+			return nil, err
+		}
+		defer compiler.Destroy()
+		namespaces := make([]string, 0, len(ruleset.sources))
+		for namespace := range ruleset.sources {
+			namespaces = append(namespaces, namespace)
+		}
+		sort.Strings(namespaces)
+		compiled := 0
+		for _, namespace := range namespaces {
+			for _, text := range ruleset.sources[namespace].deltaSource(scope) {
+				if err := compiler.AddString(text, namespace); err != nil {
+					return nil, fmt.Errorf("namespace %s - %v", namespace, err)
+				}
+				compiled++
+			}
+		}
+		if compiled > 0 {
+			rules, err := compiler.GetRules()
+			if err != nil {
+				return nil, err
+			}
+			delta.Rules = append(delta.Rules, rules)
+			delta.Origins = append(delta.Origins, "")
+		}
+		//precompiled units can't be split, those holding a rule in scope are rescanned whole
+		for unit, rules := range ruleset.Rules {
+			origin := ruleset.Origins[unit]
+			if len(origin) == 0 || len(bundleExt(origin)) > 0 || !unitInScope(rules, scope) {
+				continue
+			}
+			copied, err := copyRules(rules)
+			if err != nil {
+				return nil, err
+			}
+			delta.Rules = append(delta.Rules, copied)
+			delta.Origins = append(delta.Origins, origin)
+		}
+		if err := applyRuleStates(delta, ruleset.States); err != nil {
+			return nil, err
+		}
+		if delta.Shadow != nil {
+			delta.Shadow.Base, delta.Shadow.Scope = delta.Base, scope
+		}
+	}
+	log.Infof("Delta of ruleset %s against version %d, %d rules changed and %d removed out of %d", ruleset.Hash, previous.Version,
+		len(scope)-removed, removed, len(ruleset.Fingerprints))
+	return delta, nil
+}
+
+//unitInScope returns whether a compiled unit holds a rule in scope
+func unitInScope(rules *yara.Rules, scope map[string]bool) bool {
+	for _, rule := range rules.GetRules() {
+		if scope[ruleKey(rule.Namespace(), rule.Identifier())] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package yarascanner
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const deltaTestSource = `import "pe"
+/* rule commented { } */
+private rule is_pe { condition: uint16(0) == 0x5A4D }
+
+rule braces : tag1 {
+	meta:
+		description = "a } brace in a string"
+	strings:
+		$hex = { 4D 5A [2-4] ( 90 | 00 ) }
+		$re = /ab{1,2}\/c/ nocase // trailing } comment
+	condition:
+		is_pe and ($hex or $re)
+}
+
+rule standalone { condition: filesize \ 2 > 10 }
+`
+
+//Test rule sources split into rules, and edits only change the fingerprints of the rules depending on them
+func TestDeltaSource(t *testing.T) {
+	identifiers := []string{"is_pe", "braces", "standalone"}
+	source := newNamespaceSource("test.yar", []string{deltaTestSource}, identifiers)
+	if !source.split || len(source.rules) != 3 || len(source.imports) != 1 {
+		t.Fatalf("Expected the source split into 3 rules and an import, got %+v", source)
+	}
+	if !strings.HasSuffix(source.rules[1].text, "($hex or $re)\n}") || source.rules[1].references[0] != "is_pe" {
+		t.Fatalf("Expected rule braces up to its closing brace referencing is_pe, got %q %v", source.rules[1].text, source.rules[1].references)
+	}
+	before := source.fingerprints()
+	edited := newNamespaceSource("test.yar", []string{strings.Replace(deltaTestSource, "0x5A4D", "0x4D5A", 1)}, identifiers).fingerprints()
+	for identifier, changed := range map[string]bool{"is_pe": true, "braces": true, "standalone": false} {
+		key := ruleKey("test.yar", identifier)
+		if (before[key] != edited[key]) != changed {
+			t.Fatalf("Expected the fingerprint of %s changed %v, got %s %s", identifier, changed, before[key], edited[key])
+		}
+	}
+	delta := source.deltaSource(map[string]bool{ruleKey("test.yar", "braces"): true})
+	if len(delta) != 1 || !strings.Contains(delta[0], "import \"pe\"") || !strings.Contains(delta[0], "rule is_pe") || strings.Contains(delta[0], "standalone") {
+		t.Fatalf("Expected the delta of braces with its import and is_pe, got %v", delta)
+	}
+	if delta := source.deltaSource(map[string]bool{ruleKey("other.yar", "braces"): true}); delta != nil {
+		t.Fatalf("Expected no delta for rules of other namespaces, got %v", delta)
+	}
+
+	//sources that can't be split are rescanned whole
+	included := newNamespaceSource("inc.yar", []string{"include \"other.yar\"\nrule a { condition: true }"}, []string{"a"})
+	if included.split || len(included.deltaSource(map[string]bool{ruleKey("inc.yar", "a"): true})) != 1 {
+		t.Fatalf("Expected a source with includes compiled whole, got %+v", included)
+	}
+	mismatched := newNamespaceSource("test.yar", []string{deltaTestSource}, []string{"braces"})
+	if mismatched.split {
+		t.Fatalf("Expected a source whose rules don't match the compiled ones compiled whole")
+	}
+}
+
+//Test the delta of a ruleset scopes the rules added, edited, removed and whose state changed, and compiles all but the removed
+func TestBuildDelta(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "delta")
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{"a.yar": `rule keep { condition: true }
+rule edit { condition: filesize > 1 }
+rule remove { condition: true }
+rule flip { condition: true }`})
+	wrp, _ := NewWatchedRulesetProvider(dir, gdb, nil)
+	if err := wrp.LoadRules(); err != nil {
+		t.Fatalf("Error loading rules %v", err)
+	}
+	previous, _ := wrp.GetRules()
+	gdb.Model(&models.Rule{}).Where("identifier = ?", "flip").Update("state_override", models.RuleStateTesting)
+	writeTestFiles(t, dir, map[string]string{"a.yar": `rule keep { condition: true }
+rule edit { condition: filesize > 2 }
+rule flip { condition: true }
+rule add { condition: true }`})
+	if changed, err := wrp.reload("edit"); !changed || err != nil {
+		t.Fatalf("Expected the edits put into use, got %v %v", changed, err)
+	}
+	ruleset, _ := wrp.GetRules()
+	delta := ruleset.Delta
+	if delta == nil || delta.Base != previous.Version || delta.Version != ruleset.Version {
+		t.Fatalf("Expected a delta against version %d, got %+v", previous.Version, delta)
+	}
+	scope := make([]string, 0, len(delta.Scope))
+	for key := range delta.Scope {
+		scope = append(scope, key)
+	}
+	sort.Strings(scope)
+	if strings.Join(scope, " ") != "a.yar:add a.yar:edit a.yar:flip a.yar:remove" {
+		t.Fatalf("Expected the rules added, edited, removed and moved to testing in scope, got %v", scope)
+	}
+	if rules := strings.Join(rulesetRules(delta), " "); rules != "a.yar:add a.yar:edit a.yar:flip" {
+		t.Fatalf("Expected the delta to compile the rules in scope still in the ruleset, got %s", rules)
+	}
+	if delta.Shadow == nil || delta.Shadow.Base != previous.Version || !delta.Shadow.Scope["a.yar:flip"] {
+		t.Fatalf("Expected flip scanned by the shadow of the delta, got %+v", delta.Shadow)
+	}
+
+	//changed scan options rescan with the whole ruleset
+	ioutil.WriteFile(filepath.Join(dir, ScanOptionsFile), []byte(`{"timeout":"1m"}`), 0644)
+	if changed, err := wrp.reload("options"); !changed || err != nil {
+		t.Fatalf("Expected the scan options put into use, got %v %v", changed, err)
+	}
+	if ruleset, _ := wrp.GetRules(); ruleset.Delta != nil {
+		t.Fatalf("Expected no delta when the scan options changed, got %+v", ruleset.Delta)
+	}
+}
+
+//staticProvider hands out the ruleset it holds, counting the calls
+type staticProvider struct {
+	sync.Mutex
+	ruleset *Ruleset
+	calls   int
+}
+
+func (sp *staticProvider) LoadRules() error      { return nil }
+func (sp *staticProvider) Go(wg *sync.WaitGroup) {}
+func (sp *staticProvider) Stop()                 {}
+func (sp *staticProvider) GetRules() (*Ruleset, error) {
+	sp.Lock()
+	defer sp.Unlock()
+	sp.calls++
+	return sp.ruleset, nil
+}
+
+//swap hands out ruleset once the provider was asked for its rules
+func (sp *staticProvider) swap(ruleset *Ruleset) {
+	for {
+		sp.Lock()
+		if sp.calls > 0 {
+			sp.ruleset = ruleset
+			sp.Unlock()
+			return
+		}
+		sp.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+//Test rule watchers queue delta rescans against the version they last queued for, and full rescans otherwise
+func TestBinaryRescanRuleWatcher(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	gdb.Create(&models.Binary{Hash: "x"})
+	gdb.Create(&models.Binary{Hash: "y"})
+	queue := NewScanQueue(gdb)
+	scope := map[string]bool{"a.yar:a": true}
+	cases := []struct {
+		name   string
+		queued *Ruleset
+		next   *Ruleset
+		jobs   int
+		delta  uint
+	}{
+		{"delta", &Ruleset{Version: 1}, &Ruleset{Version: 2, Delta: &Ruleset{Version: 2, Base: 1, Scope: scope}}, 2, 2},
+		{"delta against a version in between", &Ruleset{Version: 2}, &Ruleset{Version: 4, Delta: &Ruleset{Version: 4, Base: 3, Scope: scope}}, 2, 0},
+		{"no delta", &Ruleset{Version: 4}, &Ruleset{Version: 5}, 2, 0},
+		{"no rules changed", &Ruleset{Version: 5}, &Ruleset{Version: 6, Delta: &Ruleset{Version: 6, Base: 5, Scope: map[string]bool{}}}, 0, 0},
+		{"same version", &Ruleset{Version: 6}, &Ruleset{Version: 6}, 0, 0},
+	}
+	for _, c := range cases {
+		provider := &staticProvider{ruleset: c.queued}
+		events := make(chan fsnotify.Event, 1)
+		wg := &sync.WaitGroup{}
+		go BinaryRescanRuleWatcher(gdb, events, provider, queue, wg)
+		//the watcher reads the version queued for when it starts
+		provider.swap(c.next)
+		events <- fsnotify.Event{Name: c.name}
+		close(events)
+		wg.Wait()
+		jobs := make([]models.ScanJob, 0)
+		gdb.Where("status = ?", models.ScanJobPending).Find(&jobs)
+		if len(jobs) != c.jobs {
+			t.Fatalf("%s - expected %d rescans, got %+v", c.name, c.jobs, jobs)
+		}
+		for _, job := range jobs {
+			if job.DeltaVersion != c.delta || job.Class != models.ScanClassRuleChange {
+				t.Fatalf("%s - expected rescans with the delta of version %d, got %+v", c.name, c.delta, job)
+			}
+		}
+		gdb.Unscoped().Delete(models.ScanJob{})
+	}
+}
+
+//Test a pending delta rescan is upgraded to a full rescan when another version queues it again
+func TestEnqueueDeltaUpgrade(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	queue := NewScanQueue(gdb)
+	steps := []struct {
+		enqueue func() error
+		delta   uint
+	}{
+		{func() error { return queue.EnqueueDelta([]string{"x"}, models.ScanClassRuleChange, 2) }, 2},
+		{func() error { return queue.EnqueueDelta([]string{"x"}, models.ScanClassRuleChange, 2) }, 2},
+		{func() error { return queue.EnqueueDelta([]string{"x"}, models.ScanClassRuleChange, 3) }, 0},
+		{func() error { return queue.EnqueueDelta([]string{"x"}, models.ScanClassRuleChange, 4) }, 0},
+	}
+	for i, step := range steps {
+		if err := step.enqueue(); err != nil {
+			t.Fatalf("step %d - error queueing %v", i, err)
+		}
+		jobs := make([]models.ScanJob, 0)
+		gdb.Find(&jobs)
+		if len(jobs) != 1 || jobs[0].DeltaVersion != step.delta {
+			t.Fatalf("step %d - expected a single job for the delta of %d, got %+v", i, step.delta, jobs)
+		}
+	}
+	gdb.Unscoped().Delete(models.ScanJob{})
+	queue.EnqueueDelta([]string{"x"}, models.ScanClassRuleChange, 5)
+	queue.Enqueue("x", models.ScanClassIngest)
+	job := models.ScanJob{}
+	if gdb.First(&job); job.DeltaVersion != 0 || job.Class != models.ScanClassIngest {
+		t.Fatalf("Expected a full ingest scan to replace the pending delta rescan, got %+v", job)
+	}
+}
@@ -0,0 +1,214 @@
+package yarascanner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/hillu/go-yara"
+	"github.com/jinzhu/gorm"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+//External variables declared for every compiled rule source, rules can condition on them, ie filepath matches /uploads\/exe/
+const (
+	//ExternalFileName is the base name of the binary's S3 key, or its hash for binaries found on disk
+	ExternalFileName = "filename"
+	//ExternalFilePath is the binary's S3 key, or its hash for binaries found on disk
+	ExternalFilePath = "filepath"
+	//ExternalExtension is the lowercased extension of the file name, without the dot
+	ExternalExtension = "extension"
+	//ExternalBucket is the S3 bucket the binary was synced from
+	ExternalBucket = "bucket"
+	//ExternalObjectSize is the size of the S3 object, yara's own filesize is the size of the file scanned
+	ExternalObjectSize = "objectsize"
+	//ExternalContentType is the Content-Type of the S3 object
+	ExternalContentType = "contenttype"
+	//ExternalMetadata is the object's user metadata as sorted key=value pairs separated by ;
+	ExternalMetadata = "metadata"
+	//ExternalMetaPrefix prefixes the externals holding the user metadata keys listed in ExternalMetaKeys
+	ExternalMetaPrefix = "meta_"
+)
+
+//Externals maps external variable names to their values
+type Externals map[string]interface{}
+
+//DefaultExternals returns the externals declared on compile with their default values, metaKeys are the user metadata keys
+//exposed as variables of their own
+func DefaultExternals(metaKeys []string) Externals {
+	externals := Externals{
+		ExternalFileName:    "",
+		ExternalFilePath:    "",
+		ExternalExtension:   "",
+		ExternalBucket:      "",
+		ExternalObjectSize:  int64(0),
+		ExternalContentType: "",
+		ExternalMetadata:    "",
+	}
+	for _, key := range metaKeys {
+		externals[ExternalMetaPrefix+externalMetaKey(key)] = ""
+	}
+	return externals
+}
+
+//externalMetaKey normalizes a user metadata key into a valid identifier suffix
+func externalMetaKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(key))
+}
+
+//BinaryExternals returns the externals for scanning a binary, from its record and the S3 object it was synced from
+func BinaryExternals(bin *models.Binary, metaKeys []string) Externals {
+	externals := DefaultExternals(metaKeys)
+	filePath := bin.Key
+	if len(filePath) == 0 {
+		filePath = bin.Hash
+	}
+	fileName := path.Base(filePath)
+	externals[ExternalFilePath] = filePath
+	externals[ExternalFileName] = fileName
+	externals[ExternalExtension] = strings.ToLower(strings.TrimPrefix(path.Ext(fileName), "."))
+	externals[ExternalBucket] = bin.Bucket
+	externals[ExternalObjectSize] = bin.Size
+	externals[ExternalContentType] = bin.ContentType
+	pairs := make([]string, 0, len(bin.Metas))
+	for _, meta := range bin.Metas {
+		pairs = append(pairs, meta.Key+"="+meta.Value)
+		if _, ok := externals[ExternalMetaPrefix+externalMetaKey(meta.Key)]; ok {
+			externals[ExternalMetaPrefix+externalMetaKey(meta.Key)] = meta.Value
+		}
+	}
+	sort.Strings(pairs)
+	externals[ExternalMetadata] = strings.Join(pairs, ";")
+	return externals
+}
+
+//Hash returns a hash of the names and types of the externals, compiled rules depend on them being declared
+func (externals Externals) Hash() string {
+	names := make([]string, 0, len(externals))
+	for name := range externals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hasher := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hasher, "%s:%T\x00", name, externals[name])
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+//Declare defines the externals with their values on a compiler
+func (externals Externals) Declare(compiler *yara.Compiler) error {
+	for name, value := range externals {
+		if err := compiler.DefineVariable(name, value); err != nil {
+			return fmt.Errorf("external %s - %v", name, err)
+		}
+	}
+	return nil
+}
+
+//newCompiler returns a compiler with the provider's externals declared.
+//Includes are disabled when rule files must be signed, the files they pull in aren't verified
+func (wrp *WatchedRulesetProvider) newCompiler() (*yara.Compiler, error) {
+	compiler, err := yara.NewCompiler()
+	if err != nil {
+		return nil, fmt.Errorf("YC error %v ", err)
+	}
+	if len(wrp.TrustedKeys) > 0 {
+		compiler.DisableIncludes()
+	}
+	if err := DefaultExternals(wrp.ExternalMetaKeys).Declare(compiler); err != nil {
+		compiler.Destroy()
+		return nil, err
+	}
+	return compiler, nil
+}
+
+//cacheKey returns the key compiled rules are cached under, the hash of their sources along with the externals declared
+func (wrp *WatchedRulesetProvider) cacheKey(sourceHash string) string {
+	hasher := sha256.New()
+	io.WriteString(hasher, sourceHash)
+	io.WriteString(hasher, DefaultExternals(wrp.ExternalMetaKeys).Hash())
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+//Clone returns a copy of the ruleset whose externals can be set without affecting scans with the original.
+//Setting externals changes the compiled rules, so each scanning goroutine works on its own clone
+func (rs *Ruleset) Clone() (*Ruleset, error) {
+	clone := *rs
+	clone.Rules = make([]*yara.Rules, 0, len(rs.Rules))
+	clone.Shadow, clone.Delta = nil, nil
+	for _, rules := range rs.Rules {
+		copied, err := copyRules(rules)
+		if err != nil {
+			clone.Destroy()
+			return nil, err
+		}
+		clone.Rules = append(clone.Rules, copied)
+	}
+	if rs.Shadow != nil {
+		shadow, err := rs.Shadow.Clone()
+		if err != nil {
+			clone.Destroy()
+			return nil, err
+		}
+		clone.Shadow = shadow
+	}
+	if rs.Delta != nil {
+		delta, err := rs.Delta.Clone()
+		if err != nil {
+			clone.Destroy()
+			return nil, err
+		}
+		clone.Delta = delta
+	}
+	return &clone, nil
+}
+
+//Destroy frees the compiled rules of a clone, its shadow and its delta. Only clones are destroyed,
+//the rulesets of the provider may still be in use by other workers
+func (rs *Ruleset) Destroy() {
+	for _, rules := range rs.Rules {
+		rules.Destroy()
+	}
+	rs.Rules = nil
+	if rs.Shadow != nil {
+		rs.Shadow.Destroy()
+	}
+	if rs.Delta != nil {
+		rs.Delta.Destroy()
+	}
+}
+
+//DefineExternals sets the externals on every unit of the ruleset, its shadow and its delta.
+//Precompiled units may not declare them all, the variables they don't declare are skipped
+func (rs *Ruleset) DefineExternals(externals Externals) {
+	for _, rules := range rs.Rules {
+		for name, value := range externals {
+			rules.DefineVariable(name, value)
+		}
+	}
+	if rs.Shadow != nil {
+		rs.Shadow.DefineExternals(externals)
+	}
+	if rs.Delta != nil {
+		rs.Delta.DefineExternals(externals)
+	}
+}
+
+//binaryExternals looks up the record of a binary and returns its externals, the defaults apply to binaries not recorded
+func binaryExternals(db *gorm.DB, hash string, metaKeys []string) Externals {
+	bin := models.Binary{}
+	//older databases may hold several records of a binary, prefer one with its source recorded
+	if db.Preload("Metas").Where("hash = ?", hash).Order("key desc, id desc").First(&bin).RecordNotFound() {
+		bin.Hash = hash
+	}
+	return BinaryExternals(&bin, metaKeys)
+}
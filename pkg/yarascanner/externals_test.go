@@ -0,0 +1,152 @@
+package yarascanner
+
+import (
+	"context"
+	"github.com/hillu/go-yara"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//Test the externals of a binary synced from S3 and of one found on disk
+func TestBinaryExternals(t *testing.T) {
+	bin := &models.Binary{Hash: "abc", Bucket: "uploads", Key: "in/Setup.EXE", Size: 42, ContentType: "application/octet-stream",
+		Metas: []models.BinaryMeta{{Key: "uploader", Value: "bob"}, {Key: "Source-IP", Value: "10.0.0.1"}}}
+	externals := BinaryExternals(bin, []string{"Source-IP"})
+	expected := Externals{ExternalFileName: "Setup.EXE", ExternalFilePath: "in/Setup.EXE", ExternalExtension: "exe", ExternalBucket: "uploads",
+		ExternalObjectSize: int64(42), ExternalContentType: "application/octet-stream", ExternalMetadata: "Source-IP=10.0.0.1;uploader=bob",
+		ExternalMetaPrefix + "source_ip": "10.0.0.1"}
+	if len(externals) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, externals)
+	}
+	for name, value := range expected {
+		if externals[name] != value {
+			t.Errorf("%s expected %v got %v", name, value, externals[name])
+		}
+	}
+	disk := BinaryExternals(&models.Binary{Hash: "abc"}, nil)
+	if disk[ExternalFilePath] != "abc" || disk[ExternalFileName] != "abc" || disk[ExternalExtension] != "" || disk[ExternalMetadata] != "" {
+		t.Fatalf("Expected the hash as the path of a binary found on disk, got %v", disk)
+	}
+}
+
+//Test externals are set on the units declaring them only, and compiled rules are cached per set of externals
+func TestDefineExternals(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "externals")
+	defer os.RemoveAll(dir)
+	ruleDir := filepath.Join(dir, "rules")
+	os.Mkdir(ruleDir, 0755)
+	writeTestFiles(t, ruleDir, map[string]string{"a.yar": `rule exe { condition: extension == "exe" and meta_team contains "red" }`})
+	writeTestFiles(t, dir, map[string]string{"bin": "content"})
+	//a precompiled unit declaring none of the externals
+	compiler, _ := yara.NewCompiler()
+	compiler.AddString(`rule plain { condition: true }`, "plain")
+	plain, _ := compiler.GetRules()
+	if err := plain.Save(filepath.Join(ruleDir, "plain.yarc")); err != nil {
+		t.Fatalf("Error saving compiled rules %v", err)
+	}
+	wrp, _ := NewWatchedRulesetProvider(ruleDir, gdb, nil)
+	wrp.ExternalMetaKeys = []string{"team"}
+	if err := wrp.LoadRules(); err != nil {
+		t.Fatalf("Error loading rules %v", err)
+	}
+	ruleset, _ := wrp.GetRules()
+	clone, err := ruleset.Clone()
+	if err != nil {
+		t.Fatalf("Error cloning %v", err)
+	}
+	defer clone.Destroy()
+	bin := &models.Binary{Hash: "bin", Key: "drop/x.exe", Metas: []models.BinaryMeta{{Key: "team", Value: "redteam"}}}
+	for _, c := range []struct {
+		bin      *models.Binary
+		expected int
+	}{{bin, 2}, {&models.Binary{Hash: "bin"}, 1}} {
+		clone.DefineExternals(BinaryExternals(c.bin, wrp.ExternalMetaKeys))
+		if matches, err := clone.Scan(filepath.Join(dir, "bin")); err != nil || len(matches) != c.expected {
+			t.Fatalf("Expected %d matches with the externals of %s, got %v %v", c.expected, c.bin.Key, matches, err)
+		}
+	}
+	if matches, _ := ruleset.Scan(filepath.Join(dir, "bin")); len(matches) != 1 {
+		t.Fatalf("Expected the provider's ruleset untouched by the externals set on its clone, got %v", matches)
+	}
+
+	key := wrp.cacheKey("sources")
+	wrp.ExternalMetaKeys = []string{"team", "owner"}
+	if wrp.cacheKey("sources") == key {
+		t.Fatalf("Expected the cache key to change with the externals declared")
+	}
+	wrp.ExternalMetaKeys = []string{"team"}
+	if wrp.cacheKey("sources") != key || wrp.cacheKey("other") == key {
+		t.Fatalf("Expected the cache key to follow the sources and externals")
+	}
+}
+
+//Test a worker's clone is replaced and destroyed when the provider swaps its ruleset
+func TestWorkerScannerSwap(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "worker")
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{"a.yar": `rule first { condition: true }`})
+	wrp, _ := NewWatchedRulesetProvider(dir, gdb, nil)
+	if err := wrp.LoadRules(); err != nil {
+		t.Fatalf("Error loading rules %v", err)
+	}
+	ws := NewWorkerScanner(wrp, nil)
+	first, err := ws.Ruleset(context.Background())
+	if again, _ := ws.Ruleset(context.Background()); err != nil || again != first {
+		t.Fatalf("Expected the clone kept until it is released, got %v", err)
+	}
+	ws.Release()
+	if again, _ := ws.Ruleset(context.Background()); again != first {
+		t.Fatalf("Expected the released clone taken again while the provider's ruleset is unchanged")
+	}
+	writeTestFiles(t, dir, map[string]string{"a.yar": `rule second { condition: true }`})
+	wrp.reload("edit")
+	ws.Release()
+	if len(first.Rules) != 0 {
+		t.Fatalf("Expected the clone of the swapped ruleset destroyed when released")
+	}
+	second, err := ws.Ruleset(context.Background())
+	if err != nil || rulesetRules(second)[0] != "a.yar:second" {
+		t.Fatalf("Expected a clone of the new ruleset, got %v", err)
+	}
+	ws.Close()
+	wrp.Stop()
+	if len(second.Rules) != 0 {
+		t.Fatalf("Expected the free clones destroyed when the provider stops")
+	}
+}
+
+//Test the clones taken by workers are bounded by MaxRulesetClones, a worker waits for one handed back
+func TestWorkerScannerClonesBounded(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "worker")
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{"a.yar": `rule first { condition: true }`})
+	wrp, _ := NewWatchedRulesetProvider(dir, gdb, nil)
+	wrp.MaxRulesetClones = 1
+	if err := wrp.LoadRules(); err != nil {
+		t.Fatalf("Error loading rules %v", err)
+	}
+	holder, waiter := NewWorkerScanner(wrp, nil), NewWorkerScanner(wrp, nil)
+	defer waiter.Close()
+	held, err := holder.Ruleset(context.Background())
+	if err != nil {
+		t.Fatalf("Error taking a clone %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := waiter.Ruleset(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the second worker to wait for the only clone, got %v", err)
+	}
+	holder.Close()
+	if taken, err := waiter.Ruleset(context.Background()); err != nil || taken != held {
+		t.Fatalf("Expected the clone handed back taken by the waiting worker, got %v", err)
+	}
+}
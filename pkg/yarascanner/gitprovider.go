@@ -0,0 +1,120 @@
+package yarascanner
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//GitRulesetProvider is a RulesetProvider compiling the rules of a git repository.
+//The repository is checked out at Ref into CheckoutDir and the rules under SubPath are served by the embedded
+//WatchedRulesetProvider, every ruleset version records the commit it was built from
+type GitRulesetProvider struct {
+	mirroredProvider
+	//Remote is any url git can clone, including file:// and local paths
+	Remote string
+	//Ref is the branch, tag or commit to check out, the remote's default branch when empty
+	Ref         string
+	SubPath     string
+	CheckoutDir string
+	commit      string
+}
+
+//NewGitRulesetProvider clones remote into checkoutDir, or reuses a previous clone, checks out ref
+//and returns a provider for the rules under subPath
+func NewGitRulesetProvider(remote, ref, subPath, checkoutDir string, interval time.Duration, ruleDb *gorm.DB) (*GitRulesetProvider, error) {
+	log.Debugf("NewGitRulesetProvider %s %s %s", remote, ref, subPath)
+	gp := &GitRulesetProvider{Remote: remote, Ref: ref, SubPath: subPath, CheckoutDir: checkoutDir}
+	if _, err := os.Stat(filepath.Join(checkoutDir, ".git")); os.IsNotExist(err) {
+		if _, err := gp.git("", "clone", "--no-checkout", remote, checkoutDir); err != nil {
+			return nil, err
+		}
+	} else if _, err := gp.git(checkoutDir, "remote", "set-url", "origin", remote); err != nil {
+		return nil, err
+	}
+	if _, err := gp.update(); err != nil {
+		return nil, err
+	}
+	wrp, err := NewWatchedRulesetProvider(filepath.Join(checkoutDir, subPath), ruleDb, make(chan fsnotify.Event, 10))
+	if err != nil {
+		return nil, err
+	}
+	wrp.Revision = gp.Commit
+	gp.mirroredProvider = newMirroredProvider(wrp, remote, interval, gp.pull)
+	return gp, nil
+}
+
+//git runs a git command in dir and returns its trimmed output
+func (gp *GitRulesetProvider) git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s - %v %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+//resolveRef returns the commit Ref points to after a fetch, trying remote branches, then tags, then commits
+func (gp *GitRulesetProvider) resolveRef() (string, error) {
+	if len(gp.Ref) == 0 {
+		return gp.git(gp.CheckoutDir, "rev-parse", "--verify", "FETCH_HEAD^{commit}")
+	}
+	for _, candidate := range []string{"refs/remotes/origin/" + gp.Ref, "refs/tags/" + gp.Ref, gp.Ref} {
+		commit, err := gp.git(gp.CheckoutDir, "rev-parse", "--verify", "--quiet", candidate+"^{commit}")
+		if err == nil {
+			return commit, nil
+		}
+	}
+	return "", fmt.Errorf("git ref %s not found in %s", gp.Ref, gp.Remote)
+}
+
+//update fetches the remote and checks out Ref, returning whether the commit changed
+func (gp *GitRulesetProvider) update() (bool, error) {
+	fetchArgs := []string{"fetch", "--force", "--prune", "origin", "HEAD"}
+	if len(gp.Ref) > 0 {
+		fetchArgs = []string{"fetch", "--force", "--prune", "--tags", "origin", "+refs/heads/*:refs/remotes/origin/*"}
+	}
+	if _, err := gp.git(gp.CheckoutDir, fetchArgs...); err != nil {
+		return false, err
+	}
+	commit, err := gp.resolveRef()
+	if err != nil {
+		return false, err
+	}
+	if commit == gp.commit {
+		return false, nil
+	}
+	if _, err := gp.git(gp.CheckoutDir, "checkout", "--force", "--detach", commit); err != nil {
+		return false, err
+	}
+	if _, err := gp.git(gp.CheckoutDir, "clean", "-fdx"); err != nil {
+		return false, err
+	}
+	log.Infof("Checked out rules from %s at %s", gp.Remote, commit)
+	gp.commit = commit
+	return true, nil
+}
+
+//Commit returns the SHA of the commit checked out
+func (gp *GitRulesetProvider) Commit() string {
+	return gp.commit
+}
+
+//pull fetches the repository and checks out Ref, describing the new commit if it changed
+func (gp *GitRulesetProvider) pull() (string, error) {
+	changed, err := gp.update()
+	if err != nil || !changed {
+		return "", err
+	}
+	return "git " + gp.commit, nil
+}
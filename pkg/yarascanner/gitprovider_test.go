@@ -0,0 +1,66 @@
+package yarascanner
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//Test a git provider clones a repository, fetches new commits and records the commit of each ruleset
+func TestGitRulesetProvider(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "git")
+	defer os.RemoveAll(dir)
+	work, bare := filepath.Join(dir, "work"), filepath.Join(dir, "rules.git")
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("Error running git %v %v %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git(dir, "init", "-q", work)
+	os.Mkdir(filepath.Join(work, "rules"), 0755)
+	writeTestFiles(t, filepath.Join(work, "rules"), map[string]string{"a.yar": `rule first { condition: true }`})
+	git(work, "add", "-A")
+	git(work, "commit", "-q", "-m", "first")
+	git(dir, "clone", "-q", "--bare", work, bare)
+	first := git(work, "rev-parse", "HEAD")
+
+	gp, err := NewGitRulesetProvider("file://"+bare, "", "rules", filepath.Join(dir, "checkout"), 0, gdb)
+	if err != nil {
+		t.Fatalf("Error cloning %v", err)
+	}
+	defer gp.Stop()
+	if err := gp.LoadRules(); err != nil {
+		t.Fatalf("Error loading rules %v", err)
+	}
+	if ruleset, _ := gp.GetRules(); ruleset.Revision != first || rulesetRules(ruleset)[0] != "a.yar:first" {
+		t.Fatalf("Expected the rules of %s, got %s %v", first, ruleset.Revision, rulesetRules(ruleset))
+	}
+
+	writeTestFiles(t, filepath.Join(work, "rules"), map[string]string{"a.yar": `rule second { condition: true }`})
+	git(work, "commit", "-q", "-a", "-m", "second")
+	git(work, "push", "-q", bare, "HEAD")
+	second := git(work, "rev-parse", "HEAD")
+	if err := gp.Sync(); err != nil {
+		t.Fatalf("Error syncing %v", err)
+	}
+	if gp.Commit() != second {
+		t.Fatalf("Expected %s checked out, got %s", second, gp.Commit())
+	}
+	if changed, err := gp.reload("sync"); !changed || err != nil {
+		t.Fatalf("Expected the new commit put into use, got %v %v", changed, err)
+	}
+	if ruleset, _ := gp.GetRules(); ruleset.Revision != second || rulesetRules(ruleset)[0] != "a.yar:second" {
+		t.Fatalf("Expected the rules of %s, got %s %v", second, ruleset.Revision, rulesetRules(ruleset))
+	}
+}
@@ -0,0 +1,96 @@
+package yarascanner
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"github.com/jinzhu/gorm"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+//openTestDB returns a migrated in-memory DB. Every connection to :memory: opens a DB of its own, so it is held to one
+func openTestDB(t *testing.T) *gorm.DB {
+	gdb, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening db for tests ... %v", err)
+	}
+	gdb.DB().SetMaxOpenConns(1)
+	models.AutoMigrate(gdb)
+	return gdb
+}
+
+//testDir returns a new temp dir, the caller removes it
+func testDir(t *testing.T, prefix string) string {
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		t.Fatalf("Error creating temp dir %v", err)
+	}
+	return dir
+}
+
+//writeTestFiles writes each file to dir under its name
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Error writing %s %v", name, err)
+		}
+	}
+}
+
+//zipArchive returns a zip archive of files
+func zipArchive(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+	for name, content := range files {
+		member, err := archive.Create(name)
+		if err == nil {
+			_, err = member.Write([]byte(content))
+		}
+		if err != nil {
+			t.Fatalf("Error zipping %s %v", name, err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("Error zipping %v", err)
+	}
+	return buf.Bytes()
+}
+
+//rulesetRules returns the sorted ruleKeys of the compiled rules of a ruleset
+func rulesetRules(ruleset *Ruleset) []string {
+	keys := make([]string, 0)
+	for _, rules := range ruleset.Rules {
+		for _, rule := range rules.GetRules() {
+			keys = append(keys, ruleKey(rule.Namespace(), rule.Identifier()))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//runScanningWorker runs a scanning worker on the jobs of queue until done returns true, failing the test after 10s.
+//The queue is closed on return, once the worker exited
+func runScanningWorker(t *testing.T, queue *ScanQueue, wrp *WatchedRulesetProvider, binDir string, done func() bool) {
+	queue.PollInterval = 10 * time.Millisecond
+	scanned := make(chan struct{})
+	//the worker adds itself to the wait group it's given, waiting on a channel can't miss it not started yet
+	go func() {
+		ScanningWorker(context.Background(), binDir, queue, "test", wrp, queue.DB, nil, DefaultVerdictPolicy, &sync.WaitGroup{})
+		close(scanned)
+	}()
+	defer func() {
+		queue.Close()
+		<-scanned
+	}()
+	for deadline := time.Now().Add(10 * time.Second); !done(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the scanning worker")
+		}
+	}
+}
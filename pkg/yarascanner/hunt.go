@@ -0,0 +1,286 @@
+package yarascanner
+
+import (
+	"context"
+	"fmt"
+	"github.com/hillu/go-yara"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//HuntNamespace is the namespace hunt rules are compiled in
+const HuntNamespace = "hunt"
+
+//DefaultHuntTTL is how long the results of a hunt are kept when it doesn't say
+var DefaultHuntTTL = 7 * 24 * time.Hour
+
+//HuntRunner runs retro-hunts over the stored binaries in the background, one at a time, with rules compiled apart from
+//the provider's rulesets. Hunts don't record scan runs or results, nor touch the binaries' last scan, so they stay out of
+//the production feed. A hunt interrupted by a restart resumes where it stopped
+type HuntRunner struct {
+	DB     *gorm.DB
+	BinDir string
+	//Interval is how often queued hunts are looked for and expired ones removed
+	Interval time.Duration
+	//Isolation runs the hunt scans in a child process of their own when set, a sample crashing it fails to scan
+	//but isn't quarantined, as the hunt rules come from API callers
+	Isolation *ScanIsolation
+	provider  *WatchedRulesetProvider
+	notify    chan bool
+	stop      chan bool
+	cancelled map[uint]bool
+	//running is the hunt in progress, cancelRunning aborts its scan
+	running       uint
+	cancelRunning context.CancelFunc
+	lock          sync.Mutex
+}
+
+//NewHuntRunner returns a runner hunting the binaries of binDir, hunt rules can use the externals declared by provider
+//and are scanned with its ScanOptions
+func NewHuntRunner(binDir string, provider *WatchedRulesetProvider, db *gorm.DB) *HuntRunner {
+	return &HuntRunner{DB: db, BinDir: binDir, Interval: time.Minute, provider: provider, notify: make(chan bool, 1), stop: make(chan bool),
+		cancelled: make(map[uint]bool)}
+}
+
+//compile compiles hunt rules, includes are refused as the rules come from API callers
+func (hr *HuntRunner) compile(text string) (*yara.Rules, error) {
+	compiler, err := hr.provider.newCompiler()
+	if err != nil {
+		return nil, err
+	}
+	defer compiler.Destroy()
+	compiler.DisableIncludes()
+	if err := compiler.AddString(text, HuntNamespace); err != nil {
+		return nil, err
+	}
+	return compiler.GetRules()
+}
+
+//Submit validates the rules of a hunt and queues it, a hunt without ExpiresAt keeps its results for DefaultHuntTTL
+func (hr *HuntRunner) Submit(hunt *models.Hunt) error {
+	if strings.TrimSpace(hunt.Rules) == "" {
+		return fmt.Errorf("no rules to hunt with")
+	}
+	if _, err := hr.compile(hunt.Rules); err != nil {
+		return fmt.Errorf("compiling the hunt rules - %v", err)
+	}
+	hunt.Status = models.HuntQueued
+	if hunt.ExpiresAt.IsZero() {
+		hunt.ExpiresAt = time.Now().Add(DefaultHuntTTL)
+	}
+	if err := hr.DB.Create(hunt).Error; err != nil {
+		return err
+	}
+	log.Infof("Hunt %d %q queued", hunt.ID, hunt.Name)
+	select {
+	case hr.notify <- true:
+	default:
+	}
+	return nil
+}
+
+//Cancel stops a queued or running hunt, the results found so far are kept until it expires
+func (hr *HuntRunner) Cancel(id uint) error {
+	hunt := models.Hunt{}
+	if hr.DB.First(&hunt, id).RecordNotFound() {
+		return fmt.Errorf("no hunt %d", id)
+	}
+	if hunt.Status != models.HuntQueued && hunt.Status != models.HuntRunning {
+		return fmt.Errorf("hunt %d is %s", id, hunt.Status)
+	}
+	hr.lock.Lock()
+	hr.cancelled[id] = true
+	if hr.running == id && hr.cancelRunning != nil {
+		hr.cancelRunning()
+	}
+	hr.lock.Unlock()
+	now := time.Now()
+	return hr.DB.Model(&hunt).Updates(map[string]interface{}{"status": models.HuntCancelled, "finished_at": &now}).Error
+}
+
+//isCancelled returns whether a hunt was cancelled since it started
+func (hr *HuntRunner) isCancelled(id uint) bool {
+	hr.lock.Lock()
+	defer hr.lock.Unlock()
+	return hr.cancelled[id]
+}
+
+//huntBinaries selects the binaries of a hunt left to scan
+func huntBinaries(db *gorm.DB, hunt *models.Hunt) *gorm.DB {
+	query := db.Model(&models.Binary{}).Where("id > ? AND quarantined_at IS NULL", hunt.Cursor)
+	if len(hunt.Bucket) > 0 {
+		query = query.Where("bucket = ?", hunt.Bucket)
+	}
+	if len(hunt.KeyPrefix) > 0 {
+		query = query.Where("key LIKE ? ESCAPE '\\'", strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(hunt.KeyPrefix)+"%")
+	}
+	if len(hunt.ContentType) > 0 {
+		query = query.Where("content_type = ?", hunt.ContentType)
+	}
+	if hunt.CreatedAfter != nil {
+		query = query.Where("created_at >= ?", *hunt.CreatedAfter)
+	}
+	if hunt.CreatedBefore != nil {
+		query = query.Where("created_at < ?", *hunt.CreatedBefore)
+	}
+	return query
+}
+
+//recordHuntMatches stores the matches of a hunt on a binary, with their string matches and tags capped like those of results
+func recordHuntMatches(db *gorm.DB, hunt *models.Hunt, binaryHash string, matches []yara.MatchRule) {
+	for _, match := range matches {
+		result := models.HuntResult{HuntID: hunt.ID, BinaryHash: binaryHash, Namespace: match.Namespace, RuleName: match.Rule}
+		strs, tags, _ := matchDetails(match)
+		for _, str := range strs {
+			result.Strings = append(result.Strings, models.HuntString{Name: str.Name, Offset: str.Offset, Data: str.Data, Length: str.Length, Truncated: str.Truncated})
+		}
+		for _, tag := range tags {
+			result.Tags = append(result.Tags, models.HuntTag{Tag: tag.Tag})
+		}
+		if err := db.Create(&result).Error; err != nil {
+			log.Errorf("Error recording hunt %d result on %s %v", hunt.ID, binaryHash, err)
+		}
+	}
+}
+
+//run hunts the binaries of a hunt from its cursor, returning false if the runner was stopped before it finished
+func (hr *HuntRunner) run(hunt *models.Hunt) bool {
+	rules, err := hr.compile(hunt.Rules)
+	now := time.Now()
+	if err != nil {
+		hr.DB.Model(hunt).Updates(map[string]interface{}{"status": models.HuntFailed, "error": err.Error(), "finished_at": &now})
+		log.Errorf("Hunt %d failed - %v", hunt.ID, err)
+		return true
+	}
+	defer rules.Destroy()
+	scanner := newScratchScanner(hr.Isolation)
+	defer scanner.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	hr.lock.Lock()
+	hr.running, hr.cancelRunning = hunt.ID, cancel
+	hr.lock.Unlock()
+	defer func() {
+		hr.lock.Lock()
+		hr.running, hr.cancelRunning = 0, nil
+		hr.lock.Unlock()
+		cancel()
+	}()
+	if hunt.Status == models.HuntQueued {
+		huntBinaries(hr.DB, hunt).Count(&hunt.Total)
+		hr.DB.Model(hunt).Updates(map[string]interface{}{"status": models.HuntRunning, "started_at": &now, "total": hunt.Total})
+		log.Infof("Hunt %d %q started over %d binaries", hunt.ID, hunt.Name, hunt.Total)
+	}
+	huntRuleset := &Ruleset{Rules: []*yara.Rules{rules}, ScanOptions: hr.provider.ScanOptions}
+	kind := fmt.Sprintf("hunt-%d", hunt.ID)
+	for {
+		binaries := make([]models.Binary, 0)
+		huntBinaries(hr.DB, hunt).Preload("Metas").Order("id").Limit(100).Find(&binaries)
+		if len(binaries) == 0 {
+			break
+		}
+		for _, bin := range binaries {
+			select {
+			case <-hr.stop:
+				return false
+			default:
+			}
+			if hr.isCancelled(hunt.ID) {
+				log.Infof("Hunt %d cancelled after %d binaries", hunt.ID, hunt.Scanned)
+				return true
+			}
+			scan := scanner.Scanner(ctx, huntRuleset, kind, BinaryExternals(&bin, hr.provider.ExternalMetaKeys))
+			matches, err := scan(filepath.Join(hr.BinDir, bin.Hash))
+			if err == context.Canceled {
+				//stopped or cancelled mid-scan, a resumed hunt scans the binary again
+				return hr.isCancelled(hunt.ID)
+			}
+			fields := map[string]interface{}{"cursor": bin.ID}
+			if err != nil {
+				hunt.Failed++
+				fields["failed"] = hunt.Failed
+				log.Debugf("Hunt %d failed to scan %s - %v", hunt.ID, bin.Hash, err)
+			} else {
+				hunt.Scanned++
+				fields["scanned"] = hunt.Scanned
+				if len(matches) > 0 {
+					recordHuntMatches(hr.DB, hunt, bin.Hash, matches)
+					hunt.Matched++
+					fields["matched"] = hunt.Matched
+				}
+			}
+			hunt.Cursor = bin.ID
+			hr.DB.Model(hunt).Updates(fields)
+		}
+	}
+	finished := time.Now()
+	//a hunt cancelled as it finished stays cancelled
+	hr.DB.Model(hunt).Where("status = ?", models.HuntRunning).Updates(map[string]interface{}{"status": models.HuntDone, "finished_at": &finished})
+	log.Infof("Hunt %d %q done, %d of %d binaries matched", hunt.ID, hunt.Name, hunt.Matched, hunt.Scanned)
+	return true
+}
+
+//expire removes the results of the hunts past their expiry
+func (hr *HuntRunner) expire() {
+	expired := make([]models.Hunt, 0)
+	hr.DB.Where("expires_at < ? AND status NOT IN (?)", time.Now(), []string{models.HuntRunning, models.HuntExpired}).Find(&expired)
+	for _, hunt := range expired {
+		tx := hr.DB.Begin()
+		huntResults := tx.Model(&models.HuntResult{}).Select("id").Where("hunt_id = ?", hunt.ID).SubQuery()
+		tx.Where("hunt_result_id IN (?)", huntResults).Delete(models.HuntString{})
+		tx.Where("hunt_result_id IN (?)", huntResults).Delete(models.HuntTag{})
+		tx.Where("hunt_id = ?", hunt.ID).Delete(models.HuntResult{})
+		tx.Model(&hunt).Update("status", models.HuntExpired)
+		if err := tx.Commit().Error; err != nil {
+			log.Errorf("Error expiring hunt %d %v", hunt.ID, err)
+			continue
+		}
+		log.Infof("Hunt %d %q expired, its results were removed", hunt.ID, hunt.Name)
+	}
+}
+
+//next returns the hunt to run, a running hunt interrupted by a restart first, or nil if none is waiting
+func (hr *HuntRunner) next() *models.Hunt {
+	hunt := models.Hunt{}
+	if hr.DB.Where("status IN (?)", []string{models.HuntRunning, models.HuntQueued}).Order("status = 'queued', id").First(&hunt).RecordNotFound() {
+		return nil
+	}
+	return &hunt
+}
+
+//Go runs the queued hunts until Stop is called
+func (hr *HuntRunner) Go(wg *sync.WaitGroup) {
+	wg.Add(1)
+	defer log.Debugf("Hunt runner exiting")
+	defer wg.Done()
+	ticker := time.NewTicker(hr.Interval)
+	defer ticker.Stop()
+	for {
+		hr.expire()
+		for hunt := hr.next(); hunt != nil; hunt = hr.next() {
+			if !hr.run(hunt) {
+				return
+			}
+		}
+		select {
+		case <-hr.stop:
+			return
+		case <-hr.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+//Stop stops the runner, aborting the scan in progress, a running hunt resumes on the next start
+func (hr *HuntRunner) Stop() {
+	close(hr.stop)
+	hr.lock.Lock()
+	defer hr.lock.Unlock()
+	if hr.cancelRunning != nil {
+		hr.cancelRunning()
+	}
+}
@@ -0,0 +1,136 @@
+package yarascanner
+
+import (
+	"encoding/hex"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"os"
+	"testing"
+	"time"
+)
+
+//Test hunts only select the binaries matching their filters and expired hunts lose their results
+func TestHuntBinariesAndExpiry(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	gdb.Create(&models.Binary{Hash: "a", Bucket: "samples", Key: "mal/one.exe", ContentType: "application/x-dosexec"})
+	gdb.Create(&models.Binary{Hash: "b", Bucket: "samples", Key: "mal_/two.exe", ContentType: "application/x-dosexec"})
+	gdb.Create(&models.Binary{Hash: "c", Bucket: "other", Key: "mal/three.pdf", ContentType: "application/pdf"})
+
+	hashes := func(hunt *models.Hunt) []string {
+		binaries := make([]models.Binary, 0)
+		huntBinaries(gdb, hunt).Order("id").Find(&binaries)
+		found := make([]string, 0, len(binaries))
+		for _, bin := range binaries {
+			found = append(found, bin.Hash)
+		}
+		return found
+	}
+	if found := hashes(&models.Hunt{}); len(found) != 3 {
+		t.Fatalf("Expected an unfiltered hunt over every binary, got %v", found)
+	}
+	if found := hashes(&models.Hunt{Bucket: "samples", KeyPrefix: "mal_"}); len(found) != 1 || found[0] != "b" {
+		t.Fatalf("Expected the key prefix matched literally, got %v", found)
+	}
+	if found := hashes(&models.Hunt{ContentType: "application/x-dosexec", Cursor: 1}); len(found) != 1 || found[0] != "b" {
+		t.Fatalf("Expected the hunt resumed after its cursor, got %v", found)
+	}
+
+	runner := NewHuntRunner("", nil, gdb)
+	hunt := models.Hunt{Name: "old", Status: models.HuntDone, ExpiresAt: time.Now().Add(-time.Minute)}
+	gdb.Create(&hunt)
+	gdb.Create(&models.HuntResult{HuntID: hunt.ID, BinaryHash: "a", RuleName: "r", Strings: []models.HuntString{{Name: "$s"}}, Tags: []models.HuntTag{{Tag: "t"}}})
+	runner.expire()
+	results, strs, tags := 0, 0, 0
+	gdb.Model(&models.HuntResult{}).Count(&results)
+	gdb.Model(&models.HuntString{}).Count(&strs)
+	gdb.Model(&models.HuntTag{}).Count(&tags)
+	gdb.First(&hunt, hunt.ID)
+	if hunt.Status != models.HuntExpired || results != 0 || strs != 0 || tags != 0 {
+		t.Fatalf("Expected the hunt expired without results, got %s %d %d %d", hunt.Status, results, strs, tags)
+	}
+}
+
+//Test hunts record their matches, stop when cancelled and resume after their cursor when interrupted
+func TestHuntRun(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "hunt")
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{"a": "a needle", "b": "no match", "c": "needle again"})
+	for _, hash := range []string{"a", "b", "c"} {
+		gdb.Create(&models.Binary{Hash: hash})
+	}
+	wrp, _ := NewWatchedRulesetProvider(dir, gdb, nil)
+	runner := NewHuntRunner(dir, wrp, gdb)
+	defer func(limit int) { MatchDataLimit = limit }(MatchDataLimit)
+	MatchDataLimit = 4
+	rules := `rule needle : found tagged { strings: $s = "needle" condition: $s }`
+	if err := runner.Submit(&models.Hunt{Name: "bad", Rules: "rule {"}); err == nil {
+		t.Fatalf("Expected a hunt with invalid rules refused")
+	}
+
+	hunt := &models.Hunt{Name: "needles", Rules: rules}
+	if err := runner.Submit(hunt); err != nil {
+		t.Fatalf("Error submitting %v", err)
+	}
+	if !runner.run(runner.next()) {
+		t.Fatalf("Expected the hunt to run to its end")
+	}
+	gdb.First(hunt, hunt.ID)
+	if hunt.Status != models.HuntDone || hunt.Total != 3 || hunt.Scanned != 3 || hunt.Matched != 2 || hunt.FinishedAt == nil {
+		t.Fatalf("Expected the hunt done over 3 binaries with 2 matched, got %+v", hunt)
+	}
+	results := make([]models.HuntResult, 0)
+	gdb.Preload("Strings").Preload("Tags").Where("hunt_id = ?", hunt.ID).Order("binary_hash").Find(&results)
+	if len(results) != 2 || results[0].BinaryHash != "a" || results[1].BinaryHash != "c" {
+		t.Fatalf("Expected results on a and c, got %+v", results)
+	}
+	if str := results[0].Strings; len(str) != 1 || str[0].Data != hex.EncodeToString([]byte("need")) || str[0].Length != 6 || !str[0].Truncated {
+		t.Fatalf("Expected the string match truncated like a result's, got %+v", str)
+	}
+	if tags := results[0].Tags; len(tags) != 2 || tags[0].Tag != "found" || tags[1].Tag != "tagged" {
+		t.Fatalf("Expected the tags recorded as rows, got %+v", tags)
+	}
+
+	//a hunt stopped by a shutdown keeps running and resumes after its cursor
+	first := models.Binary{}
+	gdb.Where("hash = ?", "a").First(&first)
+	resumed := &models.Hunt{Name: "resumed", Rules: rules, Status: models.HuntRunning, Cursor: first.ID, Total: 3, Scanned: 1, Matched: 1}
+	gdb.Create(resumed)
+	stopped := NewHuntRunner(dir, wrp, gdb)
+	close(stopped.stop)
+	if stopped.run(stopped.next()) {
+		t.Fatalf("Expected the stopped runner to leave the hunt unfinished")
+	}
+	if next := runner.next(); next == nil || next.ID != resumed.ID || next.Cursor != first.ID {
+		t.Fatalf("Expected the interrupted hunt resumed first from its cursor, got %+v", next)
+	}
+	runner.run(runner.next())
+	gdb.First(resumed, resumed.ID)
+	scanned := make([]string, 0)
+	gdb.Model(&models.HuntResult{}).Where("hunt_id = ?", resumed.ID).Order("binary_hash").Pluck("binary_hash", &scanned)
+	if resumed.Status != models.HuntDone || resumed.Scanned != 3 || resumed.Matched != 2 || len(scanned) != 1 || scanned[0] != "c" {
+		t.Fatalf("Expected the hunt resumed after a, got %+v with results on %v", resumed, scanned)
+	}
+
+	//cancelled hunts stop before their next binary and stay cancelled
+	cancelled := &models.Hunt{Name: "cancelled", Rules: rules}
+	runner.Submit(cancelled)
+	if err := runner.Cancel(cancelled.ID); err != nil {
+		t.Fatalf("Error cancelling %v", err)
+	}
+	if err := runner.Cancel(cancelled.ID); err == nil {
+		t.Fatalf("Expected a cancelled hunt not cancelled again")
+	}
+	if next := runner.next(); next != nil {
+		t.Fatalf("Expected no hunt left to run, got %+v", next)
+	}
+	cancelled.Status = models.HuntRunning
+	if !runner.run(cancelled) {
+		t.Fatalf("Expected the cancelled hunt to end")
+	}
+	gdb.First(cancelled, cancelled.ID)
+	if cancelled.Status != models.HuntCancelled || cancelled.Scanned != 0 || cancelled.FinishedAt == nil {
+		t.Fatalf("Expected the hunt cancelled before scanning, got %+v", cancelled)
+	}
+}
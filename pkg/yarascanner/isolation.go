@@ -0,0 +1,469 @@
+package yarascanner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hillu/go-yara"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//ScanChildEnv is set in the environment of scan child processes, the scanner's main runs RunScanChild when it finds it
+const ScanChildEnv = "S3YARASCANNER_SCANCHILD"
+
+const (
+	//scanChildMemoryEnv and scanChildCPUEnv hand the limits to a child, in bytes and seconds
+	scanChildMemoryEnv = "S3YARASCANNER_SCANCHILD_MEMORY"
+	scanChildCPUEnv    = "S3YARASCANNER_SCANCHILD_CPU"
+	//scanChildCPUExit is the exit code of a child that ran out of CPU time on a scan
+	scanChildCPUExit = 3
+	//scanChildUnits caps the compiled units a child keeps loaded
+	scanChildUnits = 16
+)
+
+//ScanCrashError is the error of a scan whose child process crashed or ran out of its limits
+type ScanCrashError struct {
+	Reason string
+}
+
+//errWatchdogTimeout is the error of a scan whose child the watchdog killed, it is recorded as timed out like yara's own
+//timeouts and retried, as a hang may be down to the load of the host rather than the sample
+var errWatchdogTimeout = errors.New(scanTimeoutError)
+
+func (err *ScanCrashError) Error() string {
+	return "scan process " + err.Reason
+}
+
+//ScanIsolation runs the scans of each scanning worker in a supervised child process, so a sample crashing libyara or
+//blowing up its memory only takes the child down. The scan is recorded as crashed, the sample quarantined and the
+//worker starts a new child for its next scan. A child hanging past the scan's deadline is killed and the scan recorded
+//as timed out, to be retried. Rulesets are handed to the children as compiled files saved in Dir
+type ScanIsolation struct {
+	//Command runs a child, it defaults to the running executable, whose main must call RunScanChild when ScanChildEnv is set
+	Command []string
+	Dir     string
+	//MemoryLimit caps the address space of a child in bytes and CPULimit the CPU time of a scan, 0 is no limit
+	MemoryLimit uint64
+	CPULimit    time.Duration
+	//WatchdogGrace is how long a scan may outlast its timeout before the watchdog kills its child
+	WatchdogGrace time.Duration
+	//QuarantineDir is where the binaries crashing a scan are moved, when empty they are left in place but still quarantined
+	QuarantineDir string
+	versions      []uint
+	lock          sync.Mutex
+}
+
+//NewScanIsolation returns an isolation without limits saving the rulesets of the children in dir
+func NewScanIsolation(dir string) *ScanIsolation {
+	return &ScanIsolation{Dir: dir, WatchdogGrace: 30 * time.Second}
+}
+
+//saveUnits saves the compiled units of a ruleset as <name>-<i>.yarc files in Dir, unless they already are, and returns their files.
+//The caller holds the lock
+func (iso *ScanIsolation) saveUnits(ruleset *Ruleset, name string) ([]string, error) {
+	if err := os.MkdirAll(iso.Dir, 0700); err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(ruleset.Rules))
+	for i, rules := range ruleset.Rules {
+		file := filepath.Join(iso.Dir, fmt.Sprintf("%s-%d.yarc", name, i))
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			if err := rules.Save(file + ".tmp"); err != nil {
+				return nil, fmt.Errorf("saving ruleset %d for scan children - %v", ruleset.Version, err)
+			}
+			if err := os.Rename(file+".tmp", file); err != nil {
+				return nil, err
+			}
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+//shortHash returns the prefix of a ruleset's hash naming its unit files
+func shortHash(ruleset *Ruleset) string {
+	if len(ruleset.Hash) > 12 {
+		return ruleset.Hash[:12]
+	}
+	return ruleset.Hash
+}
+
+//unitFiles saves the compiled units of a ruleset for the children, once per version and kind, and returns their files.
+//The files of all but the two latest versions are removed
+func (iso *ScanIsolation) unitFiles(ruleset *Ruleset, kind string) ([]string, error) {
+	iso.lock.Lock()
+	defer iso.lock.Unlock()
+	files, err := iso.saveUnits(ruleset, fmt.Sprintf("%d-%s-%s", ruleset.Version, shortHash(ruleset), kind))
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range iso.versions {
+		if version == ruleset.Version {
+			return files, nil
+		}
+	}
+	iso.versions = append(iso.versions, ruleset.Version)
+	for len(iso.versions) > 2 {
+		stale, _ := filepath.Glob(filepath.Join(iso.Dir, fmt.Sprintf("%d-*.yarc", iso.versions[0])))
+		for _, file := range stale {
+			os.Remove(file)
+		}
+		iso.versions = iso.versions[1:]
+	}
+	return files, nil
+}
+
+//scratchFiles saves the compiled units of rules scanned apart from the scanning workers for the children and returns their files,
+//they aren't removed with the stale versions but once their scan is closed. kind must tell apart the rules of a version, as
+//the children keep the units they loaded by file
+func (iso *ScanIsolation) scratchFiles(ruleset *Ruleset, kind string) ([]string, error) {
+	iso.lock.Lock()
+	defer iso.lock.Unlock()
+	return iso.saveUnits(ruleset, fmt.Sprintf("scratch-%d-%s-%s", ruleset.Version, shortHash(ruleset), kind))
+}
+
+//Quarantine marks a binary as quarantined, so it is no longer scanned or hunted, and moves it to QuarantineDir
+func (iso *ScanIsolation) Quarantine(db *gorm.DB, binDir, binaryHash string, reason error) {
+	now := time.Now()
+	db.Model(&models.Binary{}).Where("hash = ?", binaryHash).Update("quarantined_at", &now)
+	log.Warnf("Quarantined %s - %v", binaryHash, reason)
+	if len(iso.QuarantineDir) == 0 {
+		return
+	}
+	if err := os.MkdirAll(iso.QuarantineDir, 0700); err != nil {
+		log.Errorf("Error creating quarantine dir %s %v", iso.QuarantineDir, err)
+		return
+	}
+	if err := os.Rename(filepath.Join(binDir, binaryHash), filepath.Join(iso.QuarantineDir, binaryHash)); err != nil {
+		log.Errorf("Error moving %s to quarantine %v", binaryHash, err)
+	}
+}
+
+//binaryQuarantined returns whether a binary was quarantined
+func binaryQuarantined(db *gorm.DB, binaryHash string) bool {
+	count := 0
+	db.Model(&models.Binary{}).Where("hash = ? AND quarantined_at IS NOT NULL", binaryHash).Count(&count)
+	return count > 0
+}
+
+//scanChildRequest asks a child to scan a file with the units of a ruleset
+type scanChildRequest struct {
+	Units     []string
+	Path      string
+	Externals Externals
+	Options   ScanOptions
+}
+
+//scanChildResponse holds the matches of a scan, or its error and outcome
+type scanChildResponse struct {
+	Matches []yara.MatchRule
+	Outcome string
+	Error   string
+}
+
+//scanChild is a running child process and the pipes to it
+type scanChild struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	encoder *json.Encoder
+	decoder *json.Decoder
+}
+
+//start starts a child process with the limits of the isolation
+func (iso *ScanIsolation) start() (*scanChild, error) {
+	command := iso.Command
+	if len(command) == 0 {
+		executable, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		command = []string{executable}
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cpuSeconds := int64((iso.CPULimit + time.Second - 1) / time.Second)
+	cmd.Env = append(os.Environ(), ScanChildEnv+"=1", fmt.Sprintf("%s=%d", scanChildMemoryEnv, iso.MemoryLimit),
+		fmt.Sprintf("%s=%d", scanChildCPUEnv, cpuSeconds))
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(stdout)
+	decoder.UseNumber()
+	return &scanChild{cmd: cmd, stdin: stdin, encoder: json.NewEncoder(stdin), decoder: decoder}, nil
+}
+
+//states of a scan in a child, the watchdog kills the child only while it is scanning
+const (
+	childScanning int32 = iota
+	childAnswered
+	childTimedOut
+	childCancelled
+)
+
+//scan sends a scan to the child and waits for its response, killing the child once deadline passed or ctx is done.
+//A child that doesn't answer is reaped and a ScanCrashError returned, errWatchdogTimeout when it was killed past the deadline
+//or ctx's error when it was cancelled.
+//The child can't be used afterwards
+func (child *scanChild) scan(ctx context.Context, request scanChildRequest, deadline time.Duration) ([]yara.MatchRule, error) {
+	if err := child.encoder.Encode(request); err != nil {
+		return nil, child.crashed(false, err)
+	}
+	//the scan ends once, either answered or killed by the watchdog, so a child that answered is never killed and reused
+	state := childScanning
+	answered := make(chan bool)
+	go func() {
+		watchdog := time.NewTimer(deadline)
+		defer watchdog.Stop()
+		select {
+		case <-answered:
+			return
+		case <-watchdog.C:
+			if !atomic.CompareAndSwapInt32(&state, childScanning, childTimedOut) {
+				return
+			}
+		case <-ctx.Done():
+			if !atomic.CompareAndSwapInt32(&state, childScanning, childCancelled) {
+				return
+			}
+		}
+		child.cmd.Process.Kill()
+	}()
+	response := scanChildResponse{}
+	err := child.decoder.Decode(&response)
+	if !atomic.CompareAndSwapInt32(&state, childScanning, childAnswered) && err == nil {
+		//the answer came in as the child was being killed
+		err = errors.New("killed after answering")
+	}
+	close(answered)
+	if err != nil {
+		ended := atomic.LoadInt32(&state)
+		crash := child.crashed(ended == childTimedOut, err)
+		if ended == childCancelled {
+			return nil, ctx.Err()
+		}
+		return nil, crash
+	}
+	for i := range response.Matches {
+		for key, value := range response.Matches[i].Meta {
+			response.Matches[i].Meta[key] = fromJSONNumber(value)
+		}
+	}
+	switch response.Outcome {
+	case "":
+		return response.Matches, nil
+	case models.ScanMissing:
+		return nil, &os.PathError{Op: "open", Path: request.Path, Err: syscall.ENOENT}
+	case models.ScanTimedOut:
+		return nil, errors.New(scanTimeoutError)
+	}
+	return nil, errors.New(response.Error)
+}
+
+//crashed reaps a child that stopped answering and returns why it did
+func (child *scanChild) crashed(killed bool, cause error) error {
+	child.stdin.Close()
+	waitErr := child.cmd.Wait()
+	if killed {
+		return errWatchdogTimeout
+	}
+	if exitErr, ok := waitErr.(*exec.ExitError); ok {
+		if exitErr.ExitCode() == scanChildCPUExit {
+			return &ScanCrashError{Reason: "exceeded its CPU limit"}
+		}
+		return &ScanCrashError{Reason: "crashed - " + exitErr.Error()}
+	}
+	return &ScanCrashError{Reason: "failed - " + cause.Error()}
+}
+
+//close stops the child, which exits once its input closes
+func (child *scanChild) close() {
+	child.stdin.Close()
+	child.cmd.Wait()
+}
+
+//IsolatedScan scans with a worker's child process, starting one as needed
+type IsolatedScan struct {
+	isolation *ScanIsolation
+	child     *scanChild
+	//scratch scans save their units with scratchFiles, saved holds them to remove on Close
+	scratch bool
+	saved   map[string]bool
+}
+
+//Worker returns the scans of a worker, Close stops its child
+func (iso *ScanIsolation) Worker() *IsolatedScan {
+	return &IsolatedScan{isolation: iso}
+}
+
+//Scratch returns the scans of rules kept apart from the provider's rulesets, those of the hunts, the rule profiler and
+//the stager, Close stops its child and removes the units it saved
+func (iso *ScanIsolation) Scratch() *IsolatedScan {
+	return &IsolatedScan{isolation: iso, scratch: true, saved: make(map[string]bool)}
+}
+
+//Scan scans a file with a ruleset and its externals in the worker's child, kind tells the rulesets of a version apart.
+//The child is killed when ctx is done, the next scan starts another
+func (scan *IsolatedScan) Scan(ctx context.Context, ruleset *Ruleset, kind, path string, externals Externals) ([]yara.MatchRule, error) {
+	var units []string
+	var err error
+	if scan.scratch {
+		units, err = scan.isolation.scratchFiles(ruleset, kind)
+		for _, unit := range units {
+			scan.saved[unit] = true
+		}
+	} else {
+		units, err = scan.isolation.unitFiles(ruleset, kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if scan.child == nil {
+		if scan.child, err = scan.isolation.start(); err != nil {
+			return nil, fmt.Errorf("starting scan process - %v", err)
+		}
+	}
+	options := ruleset.ScanOptions
+	deadline := options.Timeout * time.Duration(len(units))
+	if options.FullRescanOnMatch {
+		deadline *= 2
+	}
+	matches, err := scan.child.scan(ctx, scanChildRequest{Units: units, Path: path, Externals: externals, Options: options}, deadline+scan.isolation.WatchdogGrace)
+	if _, crashed := err.(*ScanCrashError); crashed || err == errWatchdogTimeout || (err != nil && err == ctx.Err()) {
+		scan.child = nil
+	}
+	return matches, err
+}
+
+//Close stops the worker's child, and removes the units saved by a scratch scan
+func (scan *IsolatedScan) Close() {
+	if scan.child != nil {
+		scan.child.close()
+		scan.child = nil
+	}
+	for unit := range scan.saved {
+		os.Remove(unit)
+		delete(scan.saved, unit)
+	}
+}
+
+//fromJSONNumber turns a number decoded from JSON back into the int64 yara uses for integers
+func fromJSONNumber(value interface{}) interface{} {
+	number, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+	if integer, err := number.Int64(); err == nil {
+		return integer
+	}
+	float, _ := number.Float64()
+	return float
+}
+
+//limitCPU lets the process use limit more seconds of CPU time before it gets SIGXCPU, 0 lifts the limit
+func limitCPU(limit uint64) {
+	current := syscall.Rlimit{}
+	if err := syscall.Getrlimit(syscall.RLIMIT_CPU, &current); err != nil {
+		return
+	}
+	current.Cur = current.Max
+	if limit > 0 {
+		usage := syscall.Rusage{}
+		syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+		used := uint64((usage.Utime.Nano() + usage.Stime.Nano()) / int64(time.Second))
+		if used+limit < current.Max {
+			current.Cur = used + limit
+		}
+	}
+	syscall.Setrlimit(syscall.RLIMIT_CPU, &current)
+}
+
+//RunScanChild serves the scans of a parent's ScanIsolation, reading requests from stdin and answering on stdout
+//until stdin closes. It applies the memory limit to the process and the CPU limit to each scan
+func RunScanChild() error {
+	memory, _ := strconv.ParseUint(os.Getenv(scanChildMemoryEnv), 10, 64)
+	cpu, _ := strconv.ParseUint(os.Getenv(scanChildCPUEnv), 10, 64)
+	if memory > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: memory, Max: memory}); err != nil {
+			return fmt.Errorf("limiting memory - %v", err)
+		}
+	}
+	if cpu > 0 {
+		exceeded := make(chan os.Signal, 1)
+		signal.Notify(exceeded, syscall.SIGXCPU)
+		go func() {
+			<-exceeded
+			os.Exit(scanChildCPUExit)
+		}()
+	}
+	loaded := make(map[string]*yara.Rules)
+	order := make([]string, 0, scanChildUnits)
+	decoder := json.NewDecoder(os.Stdin)
+	decoder.UseNumber()
+	encoder := json.NewEncoder(os.Stdout)
+	for {
+		request := scanChildRequest{}
+		if err := decoder.Decode(&request); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		ruleset := &Ruleset{ScanOptions: request.Options}
+		response := scanChildResponse{}
+		for _, unit := range request.Units {
+			rules, ok := loaded[unit]
+			if !ok {
+				var err error
+				if rules, err = yara.LoadRules(unit); err != nil {
+					response.Outcome, response.Error = models.ScanFailed, fmt.Sprintf("loading %s - %v", unit, err)
+					break
+				}
+				loaded[unit] = rules
+				order = append(order, unit)
+			}
+			ruleset.Rules = append(ruleset.Rules, rules)
+		}
+		if len(response.Outcome) == 0 {
+			externals := make(Externals, len(request.Externals))
+			for name, value := range request.Externals {
+				externals[name] = fromJSONNumber(value)
+			}
+			ruleset.DefineExternals(externals)
+			limitCPU(cpu)
+			matches, err := ruleset.Scan(request.Path)
+			limitCPU(0)
+			response.Matches = matches
+			if err != nil {
+				response.Outcome, response.Error = scanOutcome(err), err.Error()
+			}
+		}
+		if err := encoder.Encode(response); err != nil {
+			return err
+		}
+		for len(order) > scanChildUnits {
+			loaded[order[0]].Destroy()
+			delete(loaded, order[0])
+			order = order[1:]
+		}
+	}
+}
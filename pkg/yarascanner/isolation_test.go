@@ -0,0 +1,130 @@
+package yarascanner
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hillu/go-yara"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//TestScanChildHelper is run as a scan child by TestScanIsolation, it answers, crashes or hangs per TEST_SCANCHILD
+func TestScanChildHelper(t *testing.T) {
+	mode := os.Getenv("TEST_SCANCHILD")
+	if len(mode) == 0 {
+		return
+	}
+	decoder := json.NewDecoder(os.Stdin)
+	for {
+		request := scanChildRequest{}
+		if err := decoder.Decode(&request); err != nil {
+			os.Exit(0)
+		}
+		switch mode {
+		case "crash":
+			os.Exit(2)
+		case "hang":
+			time.Sleep(time.Minute)
+		}
+		match := yara.MatchRule{Rule: "found", Namespace: "test", Meta: map[string]interface{}{"score": int64(80)}}
+		json.NewEncoder(os.Stdout).Encode(scanChildResponse{Matches: []yara.MatchRule{match}})
+	}
+}
+
+//Test isolated scans return the child's matches, crashing children are reported as crashes and their samples quarantined,
+//hanging ones as timeouts and the worker starts another child for its next scan
+func TestScanIsolation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isolation")
+	if err != nil {
+		t.Fatalf("Error creating temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	isolation := NewScanIsolation(filepath.Join(dir, "children"))
+	isolation.Command = []string{os.Args[0], "-test.run=TestScanChildHelper"}
+	isolation.WatchdogGrace = 500 * time.Millisecond
+	isolation.QuarantineDir = filepath.Join(dir, "quarantine")
+	ruleset := &Ruleset{Version: 1, ScanOptions: ScanOptions{Timeout: time.Second}}
+
+	scanContext := func(ctx context.Context, mode string) ([]yara.MatchRule, error) {
+		os.Setenv("TEST_SCANCHILD", mode)
+		defer os.Unsetenv("TEST_SCANCHILD")
+		worker := isolation.Worker()
+		defer worker.Close()
+		return worker.Scan(ctx, ruleset, "full", filepath.Join(dir, "bin"), Externals{ExternalObjectSize: int64(1)})
+	}
+	scan := func(mode string) ([]yara.MatchRule, error) {
+		return scanContext(context.Background(), mode)
+	}
+	matches, err := scan("answer")
+	if err != nil || len(matches) != 1 || matches[0].Meta["score"] != int64(80) {
+		t.Fatalf("Expected the child's match with its integer meta, got %v %v", matches, err)
+	}
+	if _, err := scan("crash"); err == nil || !strings.Contains(err.Error(), "crashed") || scanOutcome(err) != models.ScanCrashed {
+		t.Fatalf("Expected a crash reported, got %v", err)
+	}
+	worker := isolation.Worker()
+	defer worker.Close()
+	os.Setenv("TEST_SCANCHILD", "hang")
+	started := time.Now()
+	_, err = worker.Scan(context.Background(), ruleset, "full", filepath.Join(dir, "bin"), nil)
+	if scanOutcome(err) != models.ScanTimedOut || time.Since(started) > 10*time.Second {
+		t.Fatalf("Expected the hanging child killed by the watchdog as a timeout, got %v after %v", err, time.Since(started))
+	}
+	os.Setenv("TEST_SCANCHILD", "answer")
+	matches, err = worker.Scan(context.Background(), ruleset, "full", filepath.Join(dir, "bin"), nil)
+	os.Unsetenv("TEST_SCANCHILD")
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("Expected a new child started after the watchdog killed the last, got %v %v", matches, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := scanContext(ctx, "hang"); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the scan cancelled with its context rather than crashed, got %v", err)
+	}
+
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	gdb.Create(&models.Binary{Hash: "bin"})
+	ioutil.WriteFile(filepath.Join(dir, "bin"), []byte("sample"), 0600)
+	isolation.Quarantine(gdb, dir, "bin", &ScanCrashError{Reason: "crashed"})
+	if _, statErr := os.Stat(filepath.Join(isolation.QuarantineDir, "bin")); statErr != nil || !binaryQuarantined(gdb, "bin") {
+		t.Fatalf("Expected the sample quarantined, got %v", statErr)
+	}
+}
+
+//Test hunts scan in a scratch child of the isolation, whose units are removed once the hunt ends
+func TestIsolatedHunt(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "isolatedhunt")
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{"a": "content", "b": "content"})
+	gdb.Create(&models.Binary{Hash: "a"})
+	gdb.Create(&models.Binary{Hash: "b"})
+	wrp, _ := NewWatchedRulesetProvider(dir, gdb, nil)
+	runner := NewHuntRunner(dir, wrp, gdb)
+	runner.Isolation = NewScanIsolation(filepath.Join(dir, "children"))
+	runner.Isolation.Command = []string{os.Args[0], "-test.run=TestScanChildHelper"}
+	os.Setenv("TEST_SCANCHILD", "answer")
+	defer os.Unsetenv("TEST_SCANCHILD")
+
+	hunt := &models.Hunt{Name: "isolated", Rules: `rule local { condition: false }`}
+	if err := runner.Submit(hunt); err != nil {
+		t.Fatalf("Error submitting %v", err)
+	}
+	runner.run(runner.next())
+	gdb.First(hunt, hunt.ID)
+	found := make([]string, 0)
+	gdb.Model(&models.HuntResult{}).Where("hunt_id = ?", hunt.ID).Pluck("rule_name", &found)
+	if hunt.Status != models.HuntDone || hunt.Matched != 2 || len(found) != 2 || found[0] != "found" {
+		t.Fatalf("Expected the matches of the child recorded, got %+v with %v", hunt, found)
+	}
+	if units, _ := filepath.Glob(filepath.Join(runner.Isolation.Dir, "*.yarc")); len(units) != 0 {
+		t.Fatalf("Expected the hunt's units removed once it ended, got %v", units)
+	}
+}
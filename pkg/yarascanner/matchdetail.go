@@ -0,0 +1,44 @@
+package yarascanner
+
+import (
+	"encoding/hex"
+	"github.com/hillu/go-yara"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"sort"
+)
+
+//MatchDataLimit caps the bytes of matched data recorded per string match
+var MatchDataLimit = 64
+
+//MatchStringsLimit caps the string matches recorded per result, full mode scans may match a string many times
+var MatchStringsLimit = 1000
+
+//matchDetails returns the string matches, tags and metadata of a match to record along with its result
+func matchDetails(match yara.MatchRule) ([]models.ResultString, []models.ResultTag, []models.ResultMeta) {
+	strs := make([]models.ResultString, 0, len(match.Strings))
+	for i, matched := range match.Strings {
+		if i >= MatchStringsLimit {
+			break
+		}
+		data := matched.Data
+		if len(data) > MatchDataLimit {
+			data = data[:MatchDataLimit]
+		}
+		strs = append(strs, models.ResultString{Name: matched.Name, Offset: matched.Offset, Data: hex.EncodeToString(data),
+			Length: len(matched.Data), Truncated: len(data) < len(matched.Data)})
+	}
+	tags := make([]models.ResultTag, 0, len(match.Tags))
+	for _, tag := range match.Tags {
+		tags = append(tags, models.ResultTag{Tag: tag})
+	}
+	keys := make([]string, 0, len(match.Meta))
+	for key := range match.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	metas := make([]models.ResultMeta, 0, len(keys))
+	for _, key := range keys {
+		metas = append(metas, models.ResultMeta{Key: key, Value: metaString(match.Meta[key])})
+	}
+	return strs, tags, metas
+}
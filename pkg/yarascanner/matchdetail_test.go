@@ -0,0 +1,49 @@
+package yarascanner
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/hillu/go-yara"
+	"testing"
+)
+
+//Test the details recorded for a match are capped, and metadata of any type is recorded as text
+func TestMatchDetails(t *testing.T) {
+	defer func(dataLimit, stringsLimit int) {
+		MatchDataLimit, MatchStringsLimit = dataLimit, stringsLimit
+	}(MatchDataLimit, MatchStringsLimit)
+	MatchDataLimit, MatchStringsLimit = 4, 3
+	match := yara.MatchRule{Rule: "r", Namespace: "n", Tags: []string{"evil", "dropper"},
+		Meta: map[string]interface{}{"score": int32(80), "active": true, "author": "x", "ratio": 0.5}}
+	for i := 0; i < 5; i++ {
+		match.Strings = append(match.Strings, yara.MatchString{Name: fmt.Sprintf("$s%d", i), Offset: uint64(i * 10), Data: bytes.Repeat([]byte{'a'}, i+2)})
+	}
+	strs, tags, metas := matchDetails(match)
+	if len(strs) != MatchStringsLimit {
+		t.Fatalf("Expected the string matches capped at %d, got %d", MatchStringsLimit, len(strs))
+	}
+	for i, str := range strs {
+		data, _ := hex.DecodeString(str.Data)
+		length, recorded := i+2, i+2
+		if recorded > MatchDataLimit {
+			recorded = MatchDataLimit
+		}
+		if str.Name != match.Strings[i].Name || str.Offset != match.Strings[i].Offset || str.Length != length ||
+			str.Truncated != (length > MatchDataLimit) || len(data) != recorded {
+			t.Errorf("string %d expected %d bytes of %d recorded, got %+v", i, recorded, length, str)
+		}
+	}
+	if len(tags) != 2 || tags[0].Tag != "evil" || tags[1].Tag != "dropper" {
+		t.Fatalf("Expected the tags in order, got %+v", tags)
+	}
+	expected := []string{"active=true", "author=x", "ratio=0.5", "score=80"}
+	if len(metas) != len(expected) {
+		t.Fatalf("Expected %v, got %+v", expected, metas)
+	}
+	for i, meta := range metas {
+		if meta.Key+"="+meta.Value != expected[i] {
+			t.Errorf("meta %d expected %s got %s=%s", i, expected[i], meta.Key, meta.Value)
+		}
+	}
+}
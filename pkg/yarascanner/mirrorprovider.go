@@ -0,0 +1,91 @@
+package yarascanner
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+//SyncableRulesetProvider is a RulesetProvider whose rules can be refreshed from their source on demand
+type SyncableRulesetProvider interface {
+	RulesetProvider
+	Sync() error
+}
+
+//mirroredProvider is the part shared by providers mirroring rules from a remote source into the RuleDir
+//of their WatchedRulesetProvider. update refreshes the mirror and describes the change, or returns "" when nothing changed
+type mirroredProvider struct {
+	*WatchedRulesetProvider
+	//Interval between syncs, rules are only synced through Sync when 0
+	Interval time.Duration
+	source   string
+	update   func() (string, error)
+	syncLock sync.Mutex
+	stopped  bool
+	done     chan bool
+}
+
+func newMirroredProvider(wrp *WatchedRulesetProvider, source string, interval time.Duration, update func() (string, error)) mirroredProvider {
+	return mirroredProvider{WatchedRulesetProvider: wrp, Interval: interval, source: source, update: update, done: make(chan bool)}
+}
+
+//Sync refreshes the mirror and reloads the rules when they changed
+func (mp *mirroredProvider) Sync() error {
+	mp.syncLock.Lock()
+	defer mp.syncLock.Unlock()
+	if mp.stopped {
+		return fmt.Errorf("ruleset provider for %s stopped", mp.source)
+	}
+	//the mirror must not change under a ruleset being compiled
+	mp.reloadLock.Lock()
+	change, err := mp.update()
+	mp.reloadLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(change) > 0 {
+		mp.IncomingRulesChan <- fsnotify.Event{Name: change, Op: fsnotify.Write}
+	}
+	return nil
+}
+
+//Go syncs every Interval while serving rules like a WatchedRulesetProvider
+func (mp *mirroredProvider) Go(wg *sync.WaitGroup) {
+	go mp.poll(wg)
+	mp.WatchedRulesetProvider.Go(wg)
+}
+
+//poll syncs every Interval until stopped, then closes the rule event channel
+func (mp *mirroredProvider) poll(wg *sync.WaitGroup) {
+	wg.Add(1)
+	defer log.Debugf("Ruleset provider for %s -> poll exiting", mp.source)
+	defer wg.Done()
+	var tick <-chan time.Time
+	if mp.Interval > 0 {
+		ticker := time.NewTicker(mp.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			if err := mp.Sync(); err != nil {
+				log.Errorf("Error syncing rules from %s - %v", mp.source, err)
+			}
+		case <-mp.done:
+			mp.syncLock.Lock()
+			mp.stopped = true
+			close(mp.IncomingRulesChan)
+			mp.syncLock.Unlock()
+			return
+		}
+	}
+}
+
+//Stop stops syncing and closes the output channel
+func (mp *mirroredProvider) Stop() {
+	close(mp.done)
+	mp.WatchedRulesetProvider.Stop()
+}
@@ -0,0 +1,245 @@
+package yarascanner
+
+import (
+	"context"
+	"fmt"
+	"github.com/hillu/go-yara"
+	"github.com/jinzhu/gorm"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//profiledUnit is a rule, or a namespace or precompiled unit that can't be split, compiled on its own for profiling
+type profiledUnit struct {
+	namespace string
+	rule      string
+	rules     *yara.Rules
+}
+
+//RuleProfiler finds the rules that make scans slow. libyara doesn't report what each rule costs, so every rule is compiled
+//on its own, with the imports, global rules and rules it references, and a sample of the binaries is scanned with each
+//of them every Interval. The scan times and string matches are accumulated per ruleset version as RuleProfiles and
+//timed in the metrics registry, rules whose average scan time exceeds Threshold or that time out are flagged as slow
+type RuleProfiler struct {
+	DB     *gorm.DB
+	BinDir string
+	//Interval is how often a round of profiling runs, each profiling SampleSize binaries picked at random
+	Interval   time.Duration
+	SampleSize int
+	Threshold  time.Duration
+	//Isolation runs the profiling scans in a child process of their own when set, their times then include the round trip to it
+	Isolation *ScanIsolation
+	provider  *WatchedRulesetProvider
+	version   uint
+	units     []profiledUnit
+	stop      chan bool
+}
+
+//NewRuleProfiler returns a profiler scanning 5 binaries of binDir an hour and flagging rules averaging over 100ms
+func NewRuleProfiler(binDir string, provider *WatchedRulesetProvider, db *gorm.DB) *RuleProfiler {
+	return &RuleProfiler{DB: db, BinDir: binDir, Interval: time.Hour, SampleSize: 5, Threshold: 100 * time.Millisecond, provider: provider,
+		stop: make(chan bool)}
+}
+
+//compile compiles the rules of a ruleset one by one, retired rules aren't profiled
+func (rp *RuleProfiler) compile(ruleset *Ruleset) {
+	for _, unit := range rp.units {
+		unit.rules.Destroy()
+	}
+	rp.units = nil
+	rp.version = ruleset.Version
+	add := func(namespace, rule string, texts []string) {
+		compiler, err := rp.provider.newCompiler()
+		if err != nil {
+			log.Errorf("Error profiling %s %v", ruleKey(namespace, rule), err)
+			return
+		}
+		defer compiler.Destroy()
+		for _, text := range texts {
+			if err := compiler.AddString(text, namespace); err != nil {
+				log.Errorf("Error compiling %s for profiling %v", ruleKey(namespace, rule), err)
+				return
+			}
+		}
+		rules, err := compiler.GetRules()
+		if err != nil {
+			log.Errorf("Error compiling %s for profiling %v", ruleKey(namespace, rule), err)
+			return
+		}
+		rp.units = append(rp.units, profiledUnit{namespace: namespace, rule: rule, rules: rules})
+	}
+	namespaces := make([]string, 0, len(ruleset.sources))
+	for namespace := range ruleset.sources {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		source := ruleset.sources[namespace]
+		if !source.split {
+			add(namespace, "*", source.texts)
+			continue
+		}
+		for _, rule := range source.rules {
+			key := ruleKey(namespace, rule.identifier)
+			if ruleset.States[key] == models.RuleStateRetired {
+				continue
+			}
+			add(namespace, rule.identifier, source.deltaSource(map[string]bool{key: true}))
+		}
+	}
+	for unit, rules := range ruleset.Rules {
+		origin := ruleset.Origins[unit]
+		if len(origin) == 0 || len(bundleExt(origin)) > 0 {
+			continue
+		}
+		copied, err := copyRules(rules)
+		if err != nil {
+			log.Errorf("Error profiling %s %v", origin, err)
+			continue
+		}
+		rp.units = append(rp.units, profiledUnit{namespace: origin, rule: "*", rules: copied})
+	}
+	log.Infof("Profiling %d rules of ruleset version %d", len(rp.units), ruleset.Version)
+}
+
+//record adds the scans of a rule to its profile, flagging it when it turns slow
+func (rp *RuleProfiler) record(unit profiledUnit, durations []time.Duration, matches, stringMatches, timeouts, errors int) {
+	profile := models.RuleProfile{}
+	rp.DB.Where(models.RuleProfile{RulesetVersionID: rp.version, Namespace: unit.namespace, RuleName: unit.rule}).FirstOrInit(&profile)
+	timer := metrics.GetOrRegisterTimer("rules.profile."+strings.Replace(unit.namespace, ".", "_", -1)+"."+unit.rule, nil)
+	for _, duration := range durations {
+		micros := int64(duration / time.Microsecond)
+		profile.TotalMicros += micros
+		if micros > profile.MaxMicros {
+			profile.MaxMicros = micros
+		}
+		timer.Update(duration)
+	}
+	profile.Scans += len(durations)
+	profile.Matches += matches
+	profile.StringMatches += stringMatches
+	profile.Timeouts += timeouts
+	profile.Errors += errors
+	wasSlow := profile.Slow
+	if profile.Scans > 0 && (time.Duration(profile.TotalMicros/int64(profile.Scans))*time.Microsecond > rp.Threshold || profile.Timeouts > 0) {
+		profile.Slow = true
+	}
+	if err := rp.DB.Save(&profile).Error; err != nil {
+		log.Errorf("Error recording the profile of %s %v", ruleKey(unit.namespace, unit.rule), err)
+		return
+	}
+	if profile.Slow && !wasSlow {
+		log.Warnf("Rule %s is slow, %dus on average over %d scans, %d timed out", ruleKey(unit.namespace, unit.rule),
+			profile.TotalMicros/int64(profile.Scans), profile.Scans, profile.Timeouts)
+		metrics.GetOrRegisterCounter("rules.profile.slow", nil).Inc(1)
+	}
+}
+
+//Profile runs a round of profiling with the provider's current ruleset
+func (rp *RuleProfiler) Profile() {
+	ruleset, err := rp.provider.GetRules()
+	if err != nil || ruleset == nil {
+		log.Errorf("Error profiling rules, no ruleset %v", err)
+		return
+	}
+	if ruleset.Version != rp.version || rp.units == nil {
+		rp.compile(ruleset)
+	}
+	binaries := make([]models.Binary, 0)
+	//quarantined binaries crashed a scan, they would take the scanner down with them
+	rp.DB.Where("quarantined_at IS NULL").Order("RANDOM()").Limit(rp.SampleSize).Find(&binaries)
+	if len(binaries) == 0 {
+		return
+	}
+	//units are profiled with a plain scan, without the MaxMatches and FullRescanOnMatch options
+	options := ScanOptions{Flags: ruleset.ScanOptions.Flags, Timeout: ruleset.ScanOptions.Timeout}
+	scanner := newScratchScanner(rp.Isolation)
+	defer scanner.Close()
+	started := time.Now()
+	for i, unit := range rp.units {
+		unitRuleset := &Ruleset{Hash: ruleset.Hash, Version: ruleset.Version, Rules: []*yara.Rules{unit.rules}, ScanOptions: options}
+		kind := fmt.Sprintf("profile-%d", i)
+		durations := make([]time.Duration, 0, len(binaries))
+		matches, stringMatches, timeouts, errors := 0, 0, 0, 0
+		for _, bin := range binaries {
+			select {
+			case <-rp.stop:
+				return
+			default:
+			}
+			scan := scanner.Scanner(context.Background(), unitRuleset, kind, binaryExternals(rp.DB, bin.Hash, rp.provider.ExternalMetaKeys))
+			scanStarted := time.Now()
+			unitMatches, err := scan(filepath.Join(rp.BinDir, bin.Hash))
+			elapsed := time.Since(scanStarted)
+			switch {
+			case err == nil:
+				durations = append(durations, elapsed)
+			case scanOutcome(err) == models.ScanTimedOut:
+				durations = append(durations, elapsed)
+				timeouts++
+				continue
+			default:
+				errors++
+				continue
+			}
+			matches += len(unitMatches)
+			for _, match := range unitMatches {
+				stringMatches += len(match.Strings)
+			}
+		}
+		rp.record(unit, durations, matches, stringMatches, timeouts, errors)
+	}
+	log.Infof("Profiled %d rules over %d binaries in %v", len(rp.units), len(binaries), time.Since(started))
+}
+
+//Go profiles the rules every Interval until Stop is called
+func (rp *RuleProfiler) Go(wg *sync.WaitGroup) {
+	wg.Add(1)
+	defer log.Debugf("Rule profiler exiting")
+	defer wg.Done()
+	ticker := time.NewTicker(rp.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rp.stop:
+			return
+		case <-ticker.C:
+			rp.Profile()
+		}
+	}
+}
+
+//Stop stops the profiler, aborting the round in progress
+func (rp *RuleProfiler) Stop() {
+	close(rp.stop)
+}
+
+//SlowestRules returns the profiles of a ruleset version, the latest profiled when 0, slowest on average first.
+//With slowOnly only the rules flagged as slow are returned
+func SlowestRules(db *gorm.DB, version uint, slowOnly bool, limit int) ([]models.RuleProfile, error) {
+	if version == 0 {
+		latest := models.RuleProfile{}
+		if db.Order("ruleset_version_id desc").First(&latest).RecordNotFound() {
+			return []models.RuleProfile{}, nil
+		}
+		version = latest.RulesetVersionID
+	}
+	query := db.Where("ruleset_version_id = ? AND scans > 0", version)
+	if slowOnly {
+		query = query.Where("slow = ?", true)
+	}
+	profiles := make([]models.RuleProfile, 0)
+	if err := query.Order("total_micros / scans desc").Limit(limit).Find(&profiles).Error; err != nil {
+		return nil, err
+	}
+	for i := range profiles {
+		profiles[i].AvgMicros = profiles[i].TotalMicros / int64(profiles[i].Scans)
+	}
+	return profiles, nil
+}
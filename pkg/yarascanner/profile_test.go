@@ -0,0 +1,33 @@
+package yarascanner
+
+import (
+	"testing"
+	"time"
+)
+
+//Test rule profiles accumulate across rounds, flag the rules over the threshold and report the slowest first
+func TestRuleProfiles(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	profiler := NewRuleProfiler("", nil, gdb)
+	profiler.version = 3
+	fast := profiledUnit{namespace: "a.yar", rule: "fast"}
+	slow := profiledUnit{namespace: "a.yar", rule: "slow"}
+	profiler.record(fast, []time.Duration{time.Millisecond, 3 * time.Millisecond}, 1, 4, 0, 0)
+	profiler.record(slow, []time.Duration{50 * time.Millisecond}, 0, 0, 0, 0)
+	profiler.record(slow, []time.Duration{250 * time.Millisecond}, 0, 0, 0, 1)
+
+	profiles, err := SlowestRules(gdb, 0, false, 10)
+	if err != nil || len(profiles) != 2 {
+		t.Fatalf("Expected the profiles of both rules, got %v %v", profiles, err)
+	}
+	if profiles[0].RuleName != "slow" || profiles[0].Scans != 2 || profiles[0].AvgMicros != 150000 || !profiles[0].Slow || profiles[0].Errors != 1 {
+		t.Fatalf("Expected the slow rule first, flagged with its scans accumulated, got %+v", profiles[0])
+	}
+	if profiles[1].Slow || profiles[1].MaxMicros != 3000 || profiles[1].StringMatches != 4 {
+		t.Fatalf("Expected the fast rule not flagged, got %+v", profiles[1])
+	}
+	if flagged, _ := SlowestRules(gdb, 3, true, 10); len(flagged) != 1 {
+		t.Fatalf("Expected only the slow rule reported with slowOnly, got %v", flagged)
+	}
+}
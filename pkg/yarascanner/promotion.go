@@ -0,0 +1,278 @@
+package yarascanner
+
+import (
+	"context"
+	"fmt"
+	"github.com/hillu/go-yara"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//PromotionPolicy holds the thresholds a candidate ruleset must meet to be promoted without approval
+type PromotionPolicy struct {
+	//AutoPromote promotes candidates meeting the thresholds once evaluated, otherwise every candidate waits for approval
+	AutoPromote bool
+	//MaxNewlyMatched and MaxNoLongerMatched limit the number of binaries gaining or losing a match, negative means no limit
+	MaxNewlyMatched    int
+	MaxNoLongerMatched int
+	//MaxNewlyMatchedFraction limits the share of the corpus gaining a match, 0 means no limit
+	MaxNewlyMatchedFraction float64
+	//MaxScanErrors limits the binaries that failed to scan during the evaluation, negative means no limit
+	MaxScanErrors int
+}
+
+//Allows returns whether an evaluated promotion meets the thresholds
+func (policy PromotionPolicy) Allows(promotion *models.RulesetPromotion) bool {
+	if policy.MaxNewlyMatched >= 0 && promotion.NewlyMatched > policy.MaxNewlyMatched {
+		return false
+	}
+	if policy.MaxNoLongerMatched >= 0 && promotion.NoLongerMatched > policy.MaxNoLongerMatched {
+		return false
+	}
+	if policy.MaxNewlyMatchedFraction > 0 && promotion.BinariesTotal > 0 &&
+		float64(promotion.NewlyMatched)/float64(promotion.BinariesTotal) > policy.MaxNewlyMatchedFraction {
+		return false
+	}
+	if policy.MaxScanErrors >= 0 && promotion.ScanErrors > policy.MaxScanErrors {
+		return false
+	}
+	return true
+}
+
+//stagedRuleset is the candidate being evaluated or waiting for approval
+type stagedRuleset struct {
+	promotionID uint
+	base        *Ruleset
+	candidate   *Ruleset
+	trigger     string
+	cancel      chan bool
+}
+
+//Stager evaluates candidate rulesets against the stored binaries in the background and promotes them
+//when the PromotionPolicy allows it or after manual approval. Only the latest candidate is kept
+type Stager struct {
+	DB     *gorm.DB
+	BinDir string
+	Policy PromotionPolicy
+	//Isolation runs the evaluation scans in a child process of their own when set, a sample crashing it counts as a scan error
+	Isolation *ScanIsolation
+	provider  *WatchedRulesetProvider
+	sync.Mutex
+	staged *stagedRuleset
+	wg     sync.WaitGroup
+}
+
+//NewStager returns a Stager for the provider's rulesets, evaluating them against the binaries in binDir.
+//Promotions left over from a previous run are abandoned, as their candidates are gone
+func NewStager(provider *WatchedRulesetProvider, binDir string, policy PromotionPolicy) *Stager {
+	provider.RuleDB.Model(&models.RulesetPromotion{}).Where("status IN (?)", []string{models.PromotionEvaluating, models.PromotionPending}).
+		Update("status", models.PromotionAbandoned)
+	stager := &Stager{DB: provider.RuleDB, BinDir: binDir, Policy: policy, provider: provider}
+	provider.Stager = stager
+	return stager
+}
+
+//Candidate returns the ruleset currently staged, or nil
+func (st *Stager) Candidate() *Ruleset {
+	st.Lock()
+	defer st.Unlock()
+	if st.staged == nil {
+		return nil
+	}
+	return st.staged.candidate
+}
+
+//Stage starts evaluating a candidate against the base ruleset, superseding any previous candidate
+func (st *Stager) Stage(base, candidate *Ruleset, trigger string) error {
+	st.Lock()
+	defer st.Unlock()
+	if st.staged != nil {
+		st.closeStaged(models.PromotionSuperseded, models.RulesetVersionSuperseded, "")
+	}
+	promotion := models.RulesetPromotion{CandidateVersionID: candidate.Version, BaseVersionID: base.Version, Status: models.PromotionEvaluating, Trigger: trigger}
+	if err := st.DB.Create(&promotion).Error; err != nil {
+		return err
+	}
+	st.staged = &stagedRuleset{promotionID: promotion.ID, base: base, candidate: candidate, trigger: trigger, cancel: make(chan bool)}
+	log.Infof("Staged ruleset version %d as promotion %d (%s)", candidate.Version, promotion.ID, trigger)
+	st.wg.Add(1)
+	go st.evaluate(st.staged)
+	return nil
+}
+
+//closeStaged ends the staged candidate with the given promotion and version statuses, the caller holds the lock
+func (st *Stager) closeStaged(status, versionStatus, decidedBy string) {
+	close(st.staged.cancel)
+	now := time.Now()
+	st.DB.Model(&models.RulesetPromotion{}).Where("id = ?", st.staged.promotionID).
+		Updates(map[string]interface{}{"status": status, "decided_by": decidedBy, "decided_at": &now})
+	if len(versionStatus) > 0 {
+		st.DB.Model(&models.RulesetVersion{}).Where("id = ?", st.staged.candidate.Version).Update("status", versionStatus)
+	}
+	log.Infof("Promotion %d %s %s", st.staged.promotionID, status, decidedBy)
+	st.staged = nil
+}
+
+//matchesByRule keys matches by ruleKey
+func matchesByRule(matches []yara.MatchRule) map[string]yara.MatchRule {
+	keyed := make(map[string]yara.MatchRule, len(matches))
+	for _, match := range matches {
+		keyed[ruleKey(match.Namespace, match.Rule)] = match
+	}
+	return keyed
+}
+
+//evaluate scans every stored binary with the base and candidate rulesets and records the differences
+func (st *Stager) evaluate(staged *stagedRuleset) {
+	defer st.wg.Done()
+	bins := make([]models.Binary, 0)
+	//quarantined binaries crashed a scan, they would take the scanner down with them
+	st.DB.Where("quarantined_at IS NULL").Find(&bins)
+	promotion := models.RulesetPromotion{}
+	st.DB.First(&promotion, staged.promotionID)
+	promotion.BinariesTotal = len(bins)
+	//externals are set per binary, on clones as the base ruleset is in use by the scanning workers
+	base, err := staged.base.Clone()
+	var candidate *Ruleset
+	if err == nil {
+		candidate, err = staged.candidate.Clone()
+	}
+	if err != nil {
+		log.Errorf("Error cloning rulesets to evaluate promotion %d - %v", staged.promotionID, err)
+		if base != nil {
+			base.Destroy()
+		}
+		//the candidate can't be evaluated, it is dropped rather than left evaluating
+		st.Lock()
+		if st.staged == staged {
+			st.closeStaged(models.PromotionAbandoned, models.RulesetVersionRejected, "evaluation")
+		}
+		st.Unlock()
+		return
+	}
+	defer base.Destroy()
+	defer candidate.Destroy()
+	scanner := newScratchScanner(st.Isolation)
+	defer scanner.Close()
+	for _, bin := range bins {
+		select {
+		case <-staged.cancel:
+			log.Debugf("Promotion %d evaluation cancelled", staged.promotionID)
+			return
+		default:
+		}
+		path := filepath.Join(st.BinDir, bin.Hash)
+		externals := binaryExternals(st.DB, bin.Hash, st.provider.ExternalMetaKeys)
+		baseMatches, err := scanner.Scanner(context.Background(), base, "base", externals)(path)
+		if err == nil {
+			var candidateMatches []yara.MatchRule
+			candidateMatches, err = scanner.Scanner(context.Background(), candidate, "candidate", externals)(path)
+			if err == nil {
+				err = st.recordDiff(&promotion, bin.Hash, matchesByRule(baseMatches), matchesByRule(candidateMatches))
+			}
+		}
+		if err != nil {
+			log.Debugf("Error evaluating promotion %d on %s %v", staged.promotionID, bin.Hash, err)
+			promotion.ScanErrors++
+		}
+		promotion.BinariesScanned++
+		if promotion.BinariesScanned%100 == 0 {
+			st.DB.Model(&promotion).Updates(map[string]interface{}{"binaries_total": promotion.BinariesTotal, "binaries_scanned": promotion.BinariesScanned})
+		}
+	}
+	st.Lock()
+	if st.staged != staged {
+		st.Unlock()
+		return
+	}
+	promotion.Status = models.PromotionPending
+	promotion.WithinThresholds = st.Policy.Allows(&promotion)
+	st.DB.Save(&promotion)
+	log.Infof("Promotion %d evaluated: %d binaries newly matched, %d no longer matched, %d errors", promotion.ID, promotion.NewlyMatched, promotion.NoLongerMatched, promotion.ScanErrors)
+	st.Unlock()
+	if st.Policy.AutoPromote && promotion.WithinThresholds {
+		if err := st.Approve(promotion.ID, "policy"); err != nil {
+			log.Errorf("Error promoting %d %v", promotion.ID, err)
+		}
+	}
+}
+
+//recordDiff stores the matches a binary gains and loses under the candidate and counts it in the promotion,
+//the rows of a binary are stored together or not at all
+func (st *Stager) recordDiff(promotion *models.RulesetPromotion, binaryHash string, base, candidate map[string]yara.MatchRule) error {
+	gained, lost := false, false
+	tx := st.DB.Begin()
+	for key, match := range candidate {
+		if _, ok := base[key]; !ok {
+			if err := tx.Create(&models.RulesetDiff{RulesetPromotionID: promotion.ID, Namespace: match.Namespace, RuleName: match.Rule, BinaryHash: binaryHash, Matched: true}).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+			gained = true
+		}
+	}
+	for key, match := range base {
+		if _, ok := candidate[key]; !ok {
+			if err := tx.Create(&models.RulesetDiff{RulesetPromotionID: promotion.ID, Namespace: match.Namespace, RuleName: match.Rule, BinaryHash: binaryHash, Matched: false}).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+			lost = true
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	if gained {
+		promotion.NewlyMatched++
+	}
+	if lost {
+		promotion.NoLongerMatched++
+	}
+	return nil
+}
+
+//Approve promotes an evaluated candidate, making it the active ruleset
+func (st *Stager) Approve(promotionID uint, actor string) error {
+	st.Lock()
+	staged := st.staged
+	if staged == nil || staged.promotionID != promotionID {
+		st.Unlock()
+		return fmt.Errorf("promotion %d is not staged", promotionID)
+	}
+	promotion := models.RulesetPromotion{}
+	st.DB.First(&promotion, promotionID)
+	if promotion.Status != models.PromotionPending {
+		st.Unlock()
+		return fmt.Errorf("promotion %d is %s", promotionID, promotion.Status)
+	}
+	st.closeStaged(models.PromotionPromoted, "", actor)
+	st.Unlock()
+	st.provider.promote(staged.candidate, fmt.Sprintf("promotion %d approved by %s", promotionID, actor))
+	return nil
+}
+
+//Reject discards a staged candidate, the active ruleset stays in use
+func (st *Stager) Reject(promotionID uint, actor string) error {
+	st.Lock()
+	defer st.Unlock()
+	if st.staged == nil || st.staged.promotionID != promotionID {
+		return fmt.Errorf("promotion %d is not staged", promotionID)
+	}
+	st.closeStaged(models.PromotionRejected, models.RulesetVersionRejected, actor)
+	return nil
+}
+
+//Stop cancels the evaluation in progress and waits for it to exit
+func (st *Stager) Stop() {
+	st.Lock()
+	if st.staged != nil {
+		st.closeStaged(models.PromotionAbandoned, "", "")
+	}
+	st.Unlock()
+	st.wg.Wait()
+}
@@ -0,0 +1,163 @@
+package yarascanner
+
+import (
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//Test the thresholds of the promotion policy, negative limits and a 0 fraction don't limit
+func TestPromotionPolicy(t *testing.T) {
+	unlimited := PromotionPolicy{MaxNewlyMatched: -1, MaxNoLongerMatched: -1, MaxScanErrors: -1}
+	cases := []struct {
+		policy    PromotionPolicy
+		promotion models.RulesetPromotion
+		expected  bool
+	}{
+		{unlimited, models.RulesetPromotion{NewlyMatched: 1000, NoLongerMatched: 1000, ScanErrors: 1000}, true},
+		{PromotionPolicy{}, models.RulesetPromotion{}, true},
+		{PromotionPolicy{}, models.RulesetPromotion{NewlyMatched: 1}, false},
+		{PromotionPolicy{}, models.RulesetPromotion{NoLongerMatched: 1}, false},
+		{PromotionPolicy{}, models.RulesetPromotion{ScanErrors: 1}, false},
+		{PromotionPolicy{MaxNewlyMatched: 5, MaxNoLongerMatched: -1, MaxScanErrors: -1}, models.RulesetPromotion{NewlyMatched: 5}, true},
+		{PromotionPolicy{MaxNewlyMatched: 5, MaxNoLongerMatched: -1, MaxScanErrors: -1}, models.RulesetPromotion{NewlyMatched: 6}, false},
+		{PromotionPolicy{MaxNewlyMatched: -1, MaxNoLongerMatched: 2, MaxScanErrors: -1}, models.RulesetPromotion{NoLongerMatched: 3}, false},
+		{PromotionPolicy{MaxNewlyMatched: -1, MaxNoLongerMatched: -1, MaxScanErrors: 1, MaxNewlyMatchedFraction: 0.1},
+			models.RulesetPromotion{NewlyMatched: 10, BinariesTotal: 100}, true},
+		{PromotionPolicy{MaxNewlyMatched: -1, MaxNoLongerMatched: -1, MaxScanErrors: 1, MaxNewlyMatchedFraction: 0.1},
+			models.RulesetPromotion{NewlyMatched: 11, BinariesTotal: 100}, false},
+		{PromotionPolicy{MaxNewlyMatched: -1, MaxNoLongerMatched: -1, MaxScanErrors: -1, MaxNewlyMatchedFraction: 0.1},
+			models.RulesetPromotion{NewlyMatched: 11}, true},
+	}
+	for i, c := range cases {
+		if actual := c.policy.Allows(&c.promotion); actual != c.expected {
+			t.Errorf("case %d expected %v got %v", i, c.expected, actual)
+		}
+	}
+}
+
+//Test staged rulesets are evaluated, then promoted or rejected, and only pending promotions can be decided
+func TestStagerApproveReject(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "promotion")
+	defer os.RemoveAll(dir)
+	ruleDir, binDir := filepath.Join(dir, "rules"), filepath.Join(dir, "bins")
+	os.Mkdir(ruleDir, 0755)
+	os.Mkdir(binDir, 0755)
+	writeTestFiles(t, ruleDir, map[string]string{"a.yar": `rule old { condition: true }`})
+	writeTestFiles(t, binDir, map[string]string{"bin": "content"})
+	gdb.Create(&models.Binary{Hash: "bin"})
+	wrp, _ := NewWatchedRulesetProvider(ruleDir, gdb, nil)
+	if err := wrp.LoadRules(); err != nil {
+		t.Fatalf("Error loading rules %v", err)
+	}
+	stager := NewStager(wrp, binDir, PromotionPolicy{})
+	defer wrp.Stop()
+	stage := func(source string) models.RulesetPromotion {
+		writeTestFiles(t, ruleDir, map[string]string{"a.yar": source})
+		if changed, err := wrp.reload("edit"); changed || err != nil {
+			t.Fatalf("Expected the edit staged rather than put into use, got %v %v", changed, err)
+		}
+		promotion := models.RulesetPromotion{}
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if !gdb.Where("status = ?", models.PromotionPending).Last(&promotion).RecordNotFound() {
+				return promotion
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for the evaluation of %q", source)
+			}
+		}
+	}
+	active := func() []string {
+		ruleset, _ := wrp.GetRules()
+		return rulesetRules(ruleset)
+	}
+	version := func(id uint) string {
+		record := models.RulesetVersion{}
+		gdb.First(&record, id)
+		return record.Status
+	}
+
+	rejected := stage(`rule old { condition: true } rule noisy { condition: true }`)
+	if rejected.NewlyMatched != 1 || rejected.NoLongerMatched != 0 || rejected.WithinThresholds {
+		t.Fatalf("Expected the binary newly matched, over the thresholds, got %+v", rejected)
+	}
+	diffs := make([]models.RulesetDiff, 0)
+	if gdb.Where("ruleset_promotion_id = ?", rejected.ID).Find(&diffs); len(diffs) != 1 || diffs[0].RuleName != "noisy" || !diffs[0].Matched {
+		t.Fatalf("Expected the match of noisy recorded as a diff, got %+v", diffs)
+	}
+	if err := stager.Reject(rejected.ID, "tester"); err != nil {
+		t.Fatalf("Error rejecting %v", err)
+	}
+	if status := version(rejected.CandidateVersionID); status != models.RulesetVersionRejected {
+		t.Fatalf("Expected the candidate version rejected, got %s", status)
+	}
+	if err := stager.Approve(rejected.ID, "tester"); err == nil {
+		t.Fatalf("Expected a rejected promotion not approved")
+	}
+	if rules := active(); len(rules) != 1 || rules[0] != "a.yar:old" {
+		t.Fatalf("Expected the active ruleset kept after the rejection, got %v", rules)
+	}
+
+	promoted := stage(`rule renamed { condition: true }`)
+	if promoted.NewlyMatched != 1 || promoted.NoLongerMatched != 1 {
+		t.Fatalf("Expected the binary newly matched and no longer matched, got %+v", promoted)
+	}
+	if err := stager.Approve(promoted.ID, "tester"); err != nil {
+		t.Fatalf("Error approving %v", err)
+	}
+	gdb.First(&promoted, promoted.ID)
+	if promoted.Status != models.PromotionPromoted || promoted.DecidedBy != "tester" || version(promoted.CandidateVersionID) != models.RulesetVersionActive {
+		t.Fatalf("Expected the promotion promoted and its version active, got %+v", promoted)
+	}
+	if rules := active(); len(rules) != 1 || rules[0] != "a.yar:renamed" {
+		t.Fatalf("Expected the promoted ruleset in use, got %v", rules)
+	}
+	if event := <-wrp.OutgoingRulesChan; len(event.Name) == 0 {
+		t.Fatalf("Expected the rule watchers notified of the promotion")
+	}
+	if err := stager.Reject(promoted.ID, "tester"); err == nil {
+		t.Fatalf("Expected a promoted candidate not rejected")
+	}
+}
+
+//Test a candidate that can't be cloned for its evaluation is abandoned and its version rejected
+func TestStagerCloneFailure(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "promotion")
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{"a.yar": `rule old { condition: true }`})
+	wrp, _ := NewWatchedRulesetProvider(dir, gdb, nil)
+	if err := wrp.LoadRules(); err != nil {
+		t.Fatalf("Error loading rules %v", err)
+	}
+	defer wrp.Stop()
+	stager := NewStager(wrp, dir, PromotionPolicy{})
+	base, _ := wrp.GetRules()
+	candidate, err := base.Clone()
+	if err != nil {
+		t.Fatalf("Error cloning %v", err)
+	}
+	//destroyed rules can't be copied
+	candidate.Rules[0].Destroy()
+	version := models.RulesetVersion{Status: models.RulesetVersionCandidate}
+	gdb.Create(&version)
+	candidate.Version = version.ID
+	if err := stager.Stage(base, candidate, "test"); err != nil {
+		t.Fatalf("Error staging %v", err)
+	}
+	promotion := models.RulesetPromotion{}
+	for deadline := time.Now().Add(10 * time.Second); gdb.Where("status = ?", models.PromotionAbandoned).Last(&promotion).RecordNotFound(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the promotion to be abandoned")
+		}
+	}
+	gdb.First(&version, candidate.Version)
+	if version.Status != models.RulesetVersionRejected || stager.Candidate() != nil {
+		t.Fatalf("Expected the candidate version rejected and no longer staged, got %s", version.Status)
+	}
+}
@@ -0,0 +1,353 @@
+package yarascanner
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+//DefaultScanClassWeights share the workers 8:4:2:1 between ingest, on-demand, rule change and periodic scans
+var DefaultScanClassWeights = map[string]int{models.ScanClassIngest: 8, models.ScanClassOnDemand: 4, models.ScanClassRuleChange: 2, models.ScanClassPeriodic: 1}
+
+//ScanQueue is a durable queue of binaries to scan kept in the DB, so pending scans survive restarts.
+//Workers lease jobs for VisibilityTimeout, jobs whose worker died become visible again and failed scans are
+//retried with a growing delay until MaxAttempts. Failed jobs are kept for FailedRetention, then pruned as jobs are leased.
+//Jobs belong to a class, the workers take from the classes with jobs ready in proportion to their Weights, so new binaries
+//aren't held up behind rescans of the whole corpus while rescans still progress. Metrics are kept per class under scanqueue.<class>
+type ScanQueue struct {
+	DB                *gorm.DB
+	//Weights are the shares of the classes, classes missing have a weight of 1
+	Weights           map[string]int
+	VisibilityTimeout time.Duration
+	MaxAttempts       int
+	RetryBackoff      time.Duration
+	//FailedRetention is how long failed jobs are kept for inspection, 0 keeps them
+	FailedRetention time.Duration
+	//PollInterval is how often idle workers look for jobs enqueued by other processes or becoming visible again
+	PollInterval time.Duration
+	notify       chan bool
+	done         chan bool
+	closeOnce    sync.Once
+	//credits are the smooth weighted round robin state of the classes
+	credits     map[string]int
+	creditsLock sync.Mutex
+	//pruned is when the failed jobs were last pruned
+	pruned    time.Time
+	pruneLock sync.Mutex
+}
+
+//failedPruneInterval is how often the failed jobs past their retention are looked for
+const failedPruneInterval = time.Hour
+
+//NewScanQueue returns the queue stored in db, jobs leased by a previous run become visible once their lease expires
+func NewScanQueue(db *gorm.DB) *ScanQueue {
+	return &ScanQueue{DB: db, Weights: DefaultScanClassWeights, credits: make(map[string]int), VisibilityTimeout: 5 * time.Minute, MaxAttempts: 3, RetryBackoff: 30 * time.Second, FailedRetention: 7 * 24 * time.Hour, PollInterval: time.Second,
+		notify: make(chan bool, 1), done: make(chan bool)}
+}
+
+//wake signals an idle worker that a job is available
+func (q *ScanQueue) wake() {
+	select {
+	case q.notify <- true:
+	default:
+	}
+}
+
+//classPriority returns the rank of a class in models.ScanClasses, lower ranks first, unknown classes last
+func classPriority(class string) int {
+	for i, known := range models.ScanClasses {
+		if known == class {
+			return i
+		}
+	}
+	return len(models.ScanClasses)
+}
+
+//classMetric returns the name of a per class queue metric
+func classMetric(class, name string) string {
+	return "scanqueue." + class + "." + name
+}
+
+//enqueue adds a job for a binary within tx from a template holding its class and scan, unless one is already pending
+//as it will scan with the latest rules anyway. A pending job of a lower priority class is moved to the template's class,
+//and one for the delta of another ruleset version becomes a full scan
+func (q *ScanQueue) enqueue(tx *gorm.DB, binaryHash string, template models.ScanJob) error {
+	pending := models.ScanJob{}
+	if !tx.Where("binary_hash = ? AND status = ?", binaryHash, models.ScanJobPending).First(&pending).RecordNotFound() {
+		fields := make(map[string]interface{})
+		if classPriority(template.Class) < classPriority(pending.Class) {
+			fields["class"] = template.Class
+		}
+		if pending.DeltaVersion != 0 && pending.DeltaVersion != template.DeltaVersion {
+			fields["delta_version"] = 0
+		}
+		if len(fields) == 0 {
+			return nil
+		}
+		return tx.Model(&pending).Updates(fields).Error
+	}
+	job := template
+	job.BinaryHash, job.Status, job.AvailableAt = binaryHash, models.ScanJobPending, time.Now()
+	if err := tx.Create(&job).Error; err != nil {
+		return err
+	}
+	metrics.GetOrRegisterCounter(classMetric(job.Class, "enqueued"), nil).Inc(1)
+	return nil
+}
+
+//Enqueue queues a binary to be scanned as a job of class
+func (q *ScanQueue) Enqueue(binaryHash, class string) error {
+	if err := q.enqueue(q.DB, binaryHash, models.ScanJob{Class: class}); err != nil {
+		return err
+	}
+	q.wake()
+	return nil
+}
+
+//EnqueueAll queues binaries to be scanned as jobs of class in a single transaction
+func (q *ScanQueue) EnqueueAll(binaryHashes []string, class string) error {
+	return q.enqueueAll(binaryHashes, models.ScanJob{Class: class})
+}
+
+//EnqueueDelta queues binaries to be scanned with only the rules changed by a ruleset version, see Ruleset.Delta
+func (q *ScanQueue) EnqueueDelta(binaryHashes []string, class string, rulesetVersion uint) error {
+	return q.enqueueAll(binaryHashes, models.ScanJob{Class: class, DeltaVersion: rulesetVersion})
+}
+
+//EnqueueRescan queues binaries to be scanned as periodic jobs of a rescan job
+func (q *ScanQueue) EnqueueRescan(binaryHashes []string, rescanJobID uint) error {
+	return q.enqueueAll(binaryHashes, models.ScanJob{Class: models.ScanClassPeriodic, RescanJobID: rescanJobID})
+}
+
+func (q *ScanQueue) enqueueAll(binaryHashes []string, template models.ScanJob) error {
+	tx := q.DB.Begin()
+	for _, hash := range binaryHashes {
+		if err := q.enqueue(tx, hash, template); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	q.wake()
+	return nil
+}
+
+//visibleJobs is the condition of the jobs that can be leased, taking the statuses and times to compare with
+const visibleJobs = "((status = ? AND available_at <= ?) OR (status = ? AND leased_until < ?))"
+
+//readyClasses returns the number of jobs that can be leased per class, updating the ready gauges of the classes
+func (q *ScanQueue) readyClasses(now time.Time) (map[string]int, error) {
+	rows, err := q.DB.Model(&models.ScanJob{}).Select("class, count(*)").Where(visibleJobs, models.ScanJobPending, now, models.ScanJobLeased, now).
+		Group("class").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ready := make(map[string]int)
+	for rows.Next() {
+		class, jobs := "", 0
+		if err := rows.Scan(&class, &jobs); err != nil {
+			return nil, err
+		}
+		ready[class] = jobs
+	}
+	for _, class := range models.ScanClasses {
+		metrics.GetOrRegisterGauge(classMetric(class, "ready"), nil).Update(int64(ready[class]))
+	}
+	return ready, rows.Err()
+}
+
+//weight returns the share of a class
+func (q *ScanQueue) weight(class string) int {
+	if weight, ok := q.Weights[class]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+//pickClass chooses the class to lease from among those with jobs ready by smooth weighted round robin,
+//so that over time each class gets its share of the leases without long runs of a single class
+func (q *ScanQueue) pickClass(ready map[string]int) string {
+	q.creditsLock.Lock()
+	defer q.creditsLock.Unlock()
+	classes := make([]string, 0, len(ready))
+	total := 0
+	for class := range ready {
+		classes = append(classes, class)
+		total += q.weight(class)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		if classPriority(classes[i]) != classPriority(classes[j]) {
+			return classPriority(classes[i]) < classPriority(classes[j])
+		}
+		return classes[i] < classes[j]
+	})
+	//idle classes don't save up credit to burst with later
+	for class := range q.credits {
+		if _, ok := ready[class]; !ok {
+			delete(q.credits, class)
+		}
+	}
+	picked := ""
+	for _, class := range classes {
+		q.credits[class] += q.weight(class)
+		if len(picked) == 0 || q.credits[class] > q.credits[picked] {
+			picked = class
+		}
+	}
+	q.credits[picked] -= total
+	return picked
+}
+
+//Lease takes the next visible job for owner, choosing its class by weight, or returns nil if there is none.
+//Jobs whose lease expired MaxAttempts times are failed rather than handed out again, they may be crashing the scanner
+func (q *ScanQueue) Lease(owner string) (*models.ScanJob, error) {
+	q.pruneFailed(time.Now())
+	for {
+		now := time.Now()
+		ready, err := q.readyClasses(now)
+		if err != nil {
+			return nil, err
+		}
+		if len(ready) == 0 {
+			return nil, nil
+		}
+		class := q.pickClass(ready)
+		job := models.ScanJob{}
+		err = q.DB.Where("class = ? AND "+visibleJobs, class, models.ScanJobPending, now, models.ScanJobLeased, now).Order("id").First(&job).Error
+		if gorm.IsRecordNotFoundError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if job.Status == models.ScanJobLeased && job.Attempts >= q.MaxAttempts {
+			q.DB.Model(&job).Updates(map[string]interface{}{"status": models.ScanJobFailed, "last_error": fmt.Sprintf("lease expired after %d attempts", job.Attempts)})
+			log.Warnf("Scan job %d of %s failed, its lease expired %d times", job.ID, job.BinaryHash, job.Attempts)
+			metrics.GetOrRegisterCounter(classMetric(job.Class, "failed"), nil).Inc(1)
+			continue
+		}
+		until := now.Add(q.VisibilityTimeout)
+		leased := q.DB.Model(&models.ScanJob{}).Where("id = ? AND "+visibleJobs, job.ID, models.ScanJobPending, now, models.ScanJobLeased, now).
+			Updates(map[string]interface{}{"status": models.ScanJobLeased, "leased_until": &until, "lease_owner": owner, "attempts": gorm.Expr("attempts + 1")})
+		if leased.Error != nil {
+			return nil, leased.Error
+		}
+		if leased.RowsAffected == 0 {
+			//another worker leased it first
+			continue
+		}
+		job.Status = models.ScanJobLeased
+		job.LeasedUntil = &until
+		job.LeaseOwner = owner
+		job.Attempts++
+		metrics.GetOrRegisterCounter(classMetric(job.Class, "leased"), nil).Inc(1)
+		metrics.GetOrRegisterTimer(classMetric(job.Class, "wait"), nil).UpdateSince(job.CreatedAt)
+		return &job, nil
+	}
+}
+
+//Next blocks until a job can be leased for owner, returning nil once the queue is closed
+func (q *ScanQueue) Next(owner string) *models.ScanJob {
+	for {
+		job, err := q.Lease(owner)
+		if err != nil {
+			log.Errorf("Error leasing a scan job %v", err)
+		} else if job != nil {
+			return job
+		}
+		select {
+		case <-q.done:
+			return nil
+		case <-q.notify:
+		case <-time.After(q.PollInterval):
+		}
+	}
+}
+
+//Complete removes a job that was processed
+func (q *ScanQueue) Complete(job *models.ScanJob) {
+	q.DB.Unscoped().Delete(job)
+	metrics.GetOrRegisterCounter(classMetric(job.Class, "completed"), nil).Inc(1)
+}
+
+//Fail records the error of a job and retries it after RetryBackoff times its attempts, until MaxAttempts.
+//Jobs that can't succeed, ie for binaries no longer on disk, fail without retry
+func (q *ScanQueue) Fail(job *models.ScanJob, jobErr error, retry bool) {
+	fields := map[string]interface{}{"last_error": jobErr.Error(), "leased_until": nil, "lease_owner": ""}
+	if retry && job.Attempts < q.MaxAttempts {
+		fields["status"] = models.ScanJobPending
+		fields["available_at"] = time.Now().Add(q.RetryBackoff * time.Duration(job.Attempts))
+		log.Debugf("Retrying scan job %d of %s, attempt %d failed - %v", job.ID, job.BinaryHash, job.Attempts, jobErr)
+		metrics.GetOrRegisterCounter(classMetric(job.Class, "retried"), nil).Inc(1)
+	} else {
+		fields["status"] = models.ScanJobFailed
+		log.Warnf("Scan job %d of %s failed after %d attempts - %v", job.ID, job.BinaryHash, job.Attempts, jobErr)
+		metrics.GetOrRegisterCounter(classMetric(job.Class, "failed"), nil).Inc(1)
+	}
+	q.DB.Model(job).Updates(fields)
+}
+
+//Release hands a job back to the queue without counting its attempt, ie when its scan was cut short by a shutdown
+func (q *ScanQueue) Release(job *models.ScanJob) {
+	q.DB.Model(job).Updates(map[string]interface{}{"status": models.ScanJobPending, "available_at": time.Now(), "leased_until": nil,
+		"lease_owner": "", "attempts": gorm.Expr("attempts - 1")})
+}
+
+//PruneFailed deletes the failed jobs that failed longer than FailedRetention ago, returning how many were deleted
+func (q *ScanQueue) PruneFailed() (int64, error) {
+	if q.FailedRetention <= 0 {
+		return 0, nil
+	}
+	pruned := q.DB.Unscoped().Where("status = ? AND updated_at < ?", models.ScanJobFailed, time.Now().Add(-q.FailedRetention)).Delete(models.ScanJob{})
+	return pruned.RowsAffected, pruned.Error
+}
+
+//pruneFailed runs PruneFailed once per failedPruneInterval at most, the workers leasing jobs share the pass
+func (q *ScanQueue) pruneFailed(now time.Time) {
+	q.pruneLock.Lock()
+	if now.Sub(q.pruned) < failedPruneInterval {
+		q.pruneLock.Unlock()
+		return
+	}
+	q.pruned = now
+	q.pruneLock.Unlock()
+	if pruned, err := q.PruneFailed(); err != nil {
+		log.Errorf("Error pruning failed scan jobs %v", err)
+	} else if pruned > 0 {
+		log.Infof("Pruned %d failed scan jobs older than %v", pruned, q.FailedRetention)
+	}
+}
+
+//Depth returns the number of jobs with the given status
+func (q *ScanQueue) Depth(status string) int {
+	count := 0
+	q.DB.Model(&models.ScanJob{}).Where("status = ?", status).Count(&count)
+	return count
+}
+
+//ScanQueueStat is the number of jobs of a class in a status
+type ScanQueueStat struct {
+	Class  string
+	Status string
+	Jobs   int
+}
+
+//Stats returns the number of jobs per class and status
+func (q *ScanQueue) Stats() ([]ScanQueueStat, error) {
+	stats := make([]ScanQueueStat, 0)
+	err := q.DB.Model(&models.ScanJob{}).Select("class, status, count(*) as jobs").Group("class, status").Order("class, status").Scan(&stats).Error
+	return stats, err
+}
+
+//Close wakes the workers waiting for jobs and makes them exit
+func (q *ScanQueue) Close() {
+	q.closeOnce.Do(func() { close(q.done) })
+}
@@ -0,0 +1,136 @@
+package yarascanner
+
+import (
+	"fmt"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"testing"
+	"time"
+)
+
+//Test leasing, retries and expired leases of the scan queue
+func TestScanQueue(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	queue := NewScanQueue(gdb)
+	queue.RetryBackoff = 0
+	queue.MaxAttempts = 2
+
+	if err := queue.EnqueueAll([]string{"a", "b", "a"}, models.ScanClassIngest); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if depth := queue.Depth(models.ScanJobPending); depth != 2 {
+		t.Fatalf("Expected 2 pending jobs, pending binaries are coalesced, got %d", depth)
+	}
+	first, _ := queue.Lease("w1")
+	second, _ := queue.Lease("w2")
+	if first == nil || second == nil || first.BinaryHash != "a" || second.BinaryHash != "b" {
+		t.Fatalf("Expected jobs a and b leased in order, got %v %v", first, second)
+	}
+	if job, _ := queue.Lease("w3"); job != nil {
+		t.Fatalf("Expected no visible job, got %v", job)
+	}
+	queue.Complete(first)
+	queue.Fail(second, fmt.Errorf("scan timeout"), true)
+	retried, _ := queue.Lease("w1")
+	if retried == nil || retried.BinaryHash != "b" || retried.Attempts != 2 {
+		t.Fatalf("Expected job b retried on its second attempt, got %v", retried)
+	}
+	queue.Fail(retried, fmt.Errorf("scan timeout"), true)
+	if depth := queue.Depth(models.ScanJobFailed); depth != 1 {
+		t.Fatalf("Expected job b failed after MaxAttempts, got %d failed", depth)
+	}
+
+	//a worker dying leaves its job leased until the visibility timeout
+	queue.VisibilityTimeout = -time.Second
+	queue.Enqueue("c", models.ScanClassIngest)
+	if job, _ := queue.Lease("w1"); job == nil || job.BinaryHash != "c" {
+		t.Fatalf("Expected job c leased, got %v", job)
+	}
+	if job, _ := queue.Lease("w2"); job == nil || job.BinaryHash != "c" || job.LeaseOwner != "w2" {
+		t.Fatalf("Expected job c leased again once its lease expired, got %v", job)
+	}
+	if job, _ := queue.Lease("w3"); job != nil {
+		t.Fatalf("Expected job c failed after its lease expired MaxAttempts times, got %v", job)
+	}
+	if depth := queue.Depth(models.ScanJobFailed); depth != 2 {
+		t.Fatalf("Expected 2 failed jobs, got %d", depth)
+	}
+
+	//a scan cut short by a shutdown doesn't count as an attempt
+	queue.VisibilityTimeout = time.Minute
+	queue.Enqueue("d", models.ScanClassIngest)
+	leased, _ := queue.Lease("w1")
+	queue.Release(leased)
+	if job, _ := queue.Lease("w2"); job == nil || job.BinaryHash != "d" || job.Attempts != 1 {
+		t.Fatalf("Expected job d released and leased again on its first attempt, got %v", job)
+	}
+}
+
+//Test failed jobs are pruned once past their retention, as jobs are leased
+func TestScanQueuePruneFailed(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	queue := NewScanQueue(gdb)
+	queue.FailedRetention = 24 * time.Hour
+	for _, job := range []models.ScanJob{
+		{BinaryHash: "old", Status: models.ScanJobFailed},
+		{BinaryHash: "recent", Status: models.ScanJobFailed},
+		{BinaryHash: "waiting", Status: models.ScanJobPending, AvailableAt: time.Now().Add(time.Hour)},
+	} {
+		gdb.Create(&job)
+	}
+	gdb.Model(&models.ScanJob{}).Where("binary_hash IN (?)", []string{"old", "waiting"}).UpdateColumn("updated_at", time.Now().Add(-48*time.Hour))
+	if job, err := queue.Lease("w"); job != nil || err != nil {
+		t.Fatalf("Expected no job to lease, got %v %v", job, err)
+	}
+	jobs := make([]models.ScanJob, 0)
+	gdb.Unscoped().Order("binary_hash").Find(&jobs)
+	if len(jobs) != 2 || jobs[0].BinaryHash != "recent" || jobs[1].BinaryHash != "waiting" {
+		t.Fatalf("Expected only the failed job past its retention pruned, got %+v", jobs)
+	}
+}
+
+//Test the classes share the leases by weight and new binaries go ahead of rescans
+func TestScanQueueClasses(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	queue := NewScanQueue(gdb)
+	queue.Weights = map[string]int{models.ScanClassIngest: 3, models.ScanClassRuleChange: 1}
+
+	rescans := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		rescans = append(rescans, fmt.Sprintf("old%d", i))
+	}
+	queue.EnqueueAll(rescans, models.ScanClassRuleChange)
+	for i := 0; i < 6; i++ {
+		queue.Enqueue(fmt.Sprintf("new%d", i), models.ScanClassIngest)
+	}
+	//a rescan pending when the binary is requested again on demand moves up
+	queue.Enqueue("old19", models.ScanClassOnDemand)
+	queue.Enqueue("old18", models.ScanClassPeriodic)
+
+	leased := make(map[string]int)
+	for i := 0; i < 5; i++ {
+		job, err := queue.Lease("w")
+		if err != nil || job == nil {
+			t.Fatalf("Expected a job, got %v %v", job, err)
+		}
+		leased[job.Class]++
+		if job.Class == models.ScanClassOnDemand && job.BinaryHash != "old19" {
+			t.Fatalf("Expected old19 moved to on demand, got %s", job.BinaryHash)
+		}
+	}
+	if leased[models.ScanClassIngest] != 3 || leased[models.ScanClassRuleChange] != 1 || leased[models.ScanClassOnDemand] != 1 {
+		t.Fatalf("Expected the leases shared 3:1:1 while the classes have jobs, got %v", leased)
+	}
+	stats, _ := queue.Stats()
+	pending := make(map[string]int)
+	for _, stat := range stats {
+		if stat.Status == models.ScanJobPending {
+			pending[stat.Class] = stat.Jobs
+		}
+	}
+	if pending[models.ScanClassIngest] != 3 || pending[models.ScanClassRuleChange] != 18 || pending[models.ScanClassOnDemand] != 0 {
+		t.Fatalf("Expected 3 ingest and 18 rescan jobs left pending, got %v", stats)
+	}
+}
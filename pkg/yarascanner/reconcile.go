@@ -0,0 +1,145 @@
+package yarascanner
+
+import (
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"time"
+)
+
+//replaceResultDetails swaps the string matches, tags and metadata of a result for those of its latest match
+func replaceResultDetails(tx *gorm.DB, result *models.Result) error {
+	for _, details := range []interface{}{models.ResultString{}, models.ResultTag{}, models.ResultMeta{}} {
+		if err := tx.Where("result_id = ?", result.ID).Delete(details).Error; err != nil {
+			return err
+		}
+	}
+	for i := range result.Strings {
+		result.Strings[i].ResultID = result.ID
+		if err := tx.Create(&result.Strings[i]).Error; err != nil {
+			return err
+		}
+	}
+	for i := range result.Tags {
+		result.Tags[i].ResultID = result.ID
+		if err := tx.Create(&result.Tags[i]).Error; err != nil {
+			return err
+		}
+	}
+	for i := range result.Metas {
+		result.Metas[i].ResultID = result.ID
+		if err := tx.Create(&result.Metas[i]).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//recordResultChange logs a result being opened, closed or reopened
+func recordResultChange(tx *gorm.DB, result *models.Result, change string, rulesetVersion uint) error {
+	return tx.Create(&models.ResultChange{ResultID: result.ID, BinaryHash: result.BinaryHash, Namespace: result.Namespace, RuleName: result.RuleName,
+		Change: change, RulesetVersionID: rulesetVersion, Shadow: result.Shadow}).Error
+}
+
+//firstSeen returns when a result was first seen, results recorded before reconciliation only have their creation time
+func firstSeen(result *models.Result) time.Time {
+	if result.FirstSeenAt.IsZero() {
+		return result.CreatedAt
+	}
+	return result.FirstSeenAt
+}
+
+//ReconcileResults brings the results of a binary in line with its latest scan and returns the open ones.
+//Results still matching are updated and keep their first seen time, new matches are opened or reopened and results
+//no longer matching are closed. Matches of a delta ruleset only reconcile the results of the rules in their Scope, the other
+//results are left as they are. Duplicates left by earlier versions, which appended results on every scan, are removed
+func ReconcileResults(db *gorm.DB, matches BinaryMatches, scoring ScoringPolicy) ([]models.Result, error) {
+	now := time.Now()
+	tx := db.Begin()
+	existing := make([]models.Result, 0)
+	if err := tx.Where("binary_hash = ? AND shadow = ?", matches.FileHash, matches.Shadow).Order("id").Find(&existing).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	keyed := make(map[string]*models.Result, len(existing))
+	for i := range existing {
+		result := &existing[i]
+		key := ruleKey(result.Namespace, result.RuleName)
+		if previous, ok := keyed[key]; ok {
+			//keep the latest duplicate, first seen when the earliest one was
+			result.FirstSeenAt = firstSeen(previous)
+			if err := tx.Delete(previous).Error; err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		keyed[key] = result
+	}
+	open := make([]models.Result, 0, len(matches.Matches))
+	matched := make(map[string]bool, len(matches.Matches))
+	for _, match := range matches.Matches {
+		key := ruleKey(match.Namespace, match.Rule)
+		if matched[key] || (matches.Scope != nil && !matches.Scope[key]) {
+			continue
+		}
+		matched[key] = true
+		strs, tags, metas := matchDetails(match)
+		result, ok := keyed[key]
+		change := ""
+		if !ok {
+			result = &models.Result{BinaryHash: matches.FileHash, RuleName: match.Rule, Namespace: match.Namespace, Shadow: matches.Shadow, FirstSeenAt: now}
+			change = models.ResultOpened
+		} else if result.ClosedAt != nil {
+			result.ClosedAt = nil
+			change = models.ResultReopened
+		}
+		result.FirstSeenAt = firstSeen(result)
+		result.LastSeenAt = now
+		result.Score = scoring.ScoreMatch(match)
+		result.RulesetVersionID = matches.RulesetVersion
+		result.Strings, result.Tags, result.Metas = nil, nil, nil
+		if err := tx.Save(result).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		result.Strings, result.Tags, result.Metas = strs, tags, metas
+		if err := replaceResultDetails(tx, result); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if len(change) > 0 {
+			if err := recordResultChange(tx, result, change, matches.RulesetVersion); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		open = append(open, *result)
+	}
+	closed := 0
+	for key, result := range keyed {
+		if matches.Scope != nil && !matches.Scope[key] {
+			if result.ClosedAt == nil {
+				open = append(open, *result)
+			}
+			continue
+		}
+		if matched[key] || result.ClosedAt != nil {
+			continue
+		}
+		result.ClosedAt = &now
+		err := tx.Model(result).Update("closed_at", &now).Error
+		if err == nil {
+			err = recordResultChange(tx, result, models.ResultClosed, matches.RulesetVersion)
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		closed++
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	log.Debugf("Reconciled results of %s, %d open, %d closed", matches.FileHash, len(open), closed)
+	return open, nil
+}
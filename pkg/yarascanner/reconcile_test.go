@@ -0,0 +1,90 @@
+package yarascanner
+
+import (
+	"github.com/hillu/go-yara"
+	"github.com/jinzhu/gorm"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Test results are opened, kept, closed and reopened across scans, with a change logged for each transition
+func TestReconcileResults(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	firstSeenAt := time.Now().Add(-48 * time.Hour)
+	//duplicates appended by earlier versions on every scan
+	gdb.Create(&models.Result{BinaryHash: "bin", Namespace: "n", RuleName: "dup", Model: gorm.Model{CreatedAt: firstSeenAt}})
+	gdb.Create(&models.Result{BinaryHash: "bin", Namespace: "n", RuleName: "dup", Model: gorm.Model{CreatedAt: time.Now().Add(-time.Hour)}})
+	match := func(rules ...string) []yara.MatchRule {
+		matches := make([]yara.MatchRule, 0, len(rules))
+		for _, rule := range rules {
+			matches = append(matches, yara.MatchRule{Namespace: "n", Rule: rule})
+		}
+		return matches
+	}
+	steps := []struct {
+		name    string
+		matches []yara.MatchRule
+		scope   map[string]bool
+		open    string
+		changes string
+	}{
+		{"baseline", match("a", "dup"), nil, "a dup", "a:opened"},
+		{"still matching", match("a", "dup", "a"), nil, "a dup", ""},
+		{"no longer matching", match("dup"), nil, "dup", "a:closed"},
+		{"matching again", match("a", "dup", "b"), nil, "a b dup", "a:reopened b:opened"},
+		{"delta of b", nil, map[string]bool{"n:b": true, "n:c": true}, "a dup", "b:closed"},
+		{"delta of c", match("a", "c"), map[string]bool{"n:c": true}, "a c dup", "c:opened"},
+	}
+	logged := uint(0)
+	for version, step := range steps {
+		open, err := ReconcileResults(gdb, BinaryMatches{FileHash: "bin", Matches: step.matches, RulesetVersion: uint(version + 1), Scope: step.scope}, DefaultScoringPolicy)
+		if err != nil {
+			t.Fatalf("%s - error reconciling %v", step.name, err)
+		}
+		names := make([]string, 0, len(open))
+		for _, result := range open {
+			names = append(names, result.RuleName)
+		}
+		sort.Strings(names)
+		stored := make([]models.Result, 0)
+		gdb.Where("binary_hash = ? AND closed_at IS NULL", "bin").Order("rule_name").Find(&stored)
+		storedNames := make([]string, 0, len(stored))
+		for _, result := range stored {
+			storedNames = append(storedNames, result.RuleName)
+		}
+		if strings.Join(names, " ") != step.open || strings.Join(storedNames, " ") != step.open {
+			t.Fatalf("%s - expected %s open, got %v returned and %v stored", step.name, step.open, names, storedNames)
+		}
+		changes := make([]models.ResultChange, 0)
+		gdb.Where("id > ?", logged).Order("id").Find(&changes)
+		described := make([]string, 0, len(changes))
+		for _, change := range changes {
+			if change.RulesetVersionID != uint(version+1) {
+				t.Fatalf("%s - expected the change logged for version %d, got %+v", step.name, version+1, change)
+			}
+			described = append(described, change.RuleName+":"+change.Change)
+			logged = change.ID
+		}
+		sort.Strings(described)
+		if strings.Join(described, " ") != step.changes {
+			t.Fatalf("%s - expected changes %q, got %v", step.name, step.changes, described)
+		}
+	}
+
+	results := make([]models.Result, 0)
+	gdb.Where("binary_hash = ? AND rule_name IN (?)", "bin", []string{"dup", "a"}).Order("rule_name").Find(&results)
+	if len(results) != 2 {
+		t.Fatalf("Expected the duplicates of dup collapsed into a single result, got %+v", results)
+	}
+	if !results[1].FirstSeenAt.Equal(firstSeenAt) {
+		t.Fatalf("Expected dup first seen when its earliest duplicate was, got %v", results[1].FirstSeenAt)
+	}
+	//a matched the delta of c too, but is out of its scope, it was last reconciled by the full scan of version 4
+	if !results[0].FirstSeenAt.Before(results[0].LastSeenAt) || results[0].RulesetVersionID != 4 {
+		t.Fatalf("Expected a kept since it was opened and left alone by the deltas, got %+v", results[0])
+	}
+}
@@ -0,0 +1,260 @@
+package yarascanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//RescanSchedule rescans the binaries on a cron expression, ie nightly those not scanned within a few days
+type RescanSchedule struct {
+	Name string
+	//Cron is a standard 5 field cron expression or a descriptor like @weekly
+	Cron string
+	//MaxAge rescans the binaries not scanned within it, every binary is rescanned when it is 0
+	MaxAge   time.Duration
+	schedule cron.Schedule
+}
+
+//rescanScheduleJSON is the format of a schedule, max_age accepts Go durations and days like 7d
+type rescanScheduleJSON struct {
+	Name   string `json:"name"`
+	Cron   string `json:"cron"`
+	MaxAge string `json:"max_age"`
+}
+
+//parseAge parses a duration, allowing a number of days like 7d
+func parseAge(raw string) (time.Duration, error) {
+	if days := strings.TrimSuffix(raw, "d"); days != raw {
+		count, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(raw)
+}
+
+//NewRescanSchedule returns a schedule, or an error if the cron expression doesn't parse
+func NewRescanSchedule(name, spec string, maxAge time.Duration) (RescanSchedule, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return RescanSchedule{}, fmt.Errorf("schedule %s - %v", name, err)
+	}
+	return RescanSchedule{Name: name, Cron: spec, MaxAge: maxAge, schedule: schedule}, nil
+}
+
+//ParseRescanSchedules parses a JSON list of schedules, ie [{"name":"nightly","cron":"0 2 * * *","max_age":"3d"}]
+func ParseRescanSchedules(data []byte) ([]RescanSchedule, error) {
+	raw := make([]rescanScheduleJSON, 0)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	schedules := make([]RescanSchedule, 0, len(raw))
+	names := make(map[string]bool)
+	for _, entry := range raw {
+		if len(entry.Name) == 0 || names[entry.Name] {
+			return nil, fmt.Errorf("schedules need distinct names, got %q", entry.Name)
+		}
+		names[entry.Name] = true
+		maxAge := time.Duration(0)
+		if len(entry.MaxAge) > 0 {
+			var err error
+			if maxAge, err = parseAge(entry.MaxAge); err != nil {
+				return nil, fmt.Errorf("schedule %s max_age - %v", entry.Name, err)
+			}
+		}
+		schedule, err := NewRescanSchedule(entry.Name, entry.Cron, maxAge)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, nil
+}
+
+//RescanScheduler starts rescan jobs when their schedule is due and feeds their binaries to the scan queue in batches,
+//as periodic jobs, so a rescan of the corpus never floods the queue and new binaries keep their share of the workers.
+//The last run of each schedule is kept in the DB, a run missed while the scanner was down starts once it is back
+type RescanScheduler struct {
+	DB        *gorm.DB
+	Queue     *ScanQueue
+	Schedules []RescanSchedule
+	//BatchSize is how many scans of a job are kept queued at once
+	BatchSize int
+	//Interval is how often schedules are checked and running jobs fed
+	Interval time.Duration
+	started  time.Time
+	stop     chan bool
+	lock     sync.Mutex
+}
+
+//NewRescanScheduler returns a scheduler without schedules, rescan jobs can still be started through Run
+func NewRescanScheduler(db *gorm.DB, queue *ScanQueue) *RescanScheduler {
+	return &RescanScheduler{DB: db, Queue: queue, BatchSize: 500, Interval: time.Minute, started: time.Now(), stop: make(chan bool)}
+}
+
+//Schedule returns the schedule with the given name
+func (rs *RescanScheduler) Schedule(name string) (RescanSchedule, bool) {
+	for _, schedule := range rs.Schedules {
+		if schedule.Name == name {
+			return schedule, true
+		}
+	}
+	return RescanSchedule{}, false
+}
+
+//binariesDue selects the binaries of a job left to queue
+func (rs *RescanScheduler) binariesDue(job *models.RescanJob) *gorm.DB {
+	query := rs.DB.Model(&models.Binary{}).Where("id > ? AND quarantined_at IS NULL", job.Cursor)
+	if job.Cutoff != nil {
+		query = query.Where("last_scaned_at IS NULL OR last_scaned_at < ?", *job.Cutoff)
+	}
+	return query
+}
+
+//Run starts a rescan job for a schedule, unless one is already running
+func (rs *RescanScheduler) Run(schedule RescanSchedule) (*models.RescanJob, error) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	running := 0
+	rs.DB.Model(&models.RescanJob{}).Where("schedule = ? AND status = ?", schedule.Name, models.RescanJobRunning).Count(&running)
+	if running > 0 {
+		return nil, fmt.Errorf("a rescan of %s is already running", schedule.Name)
+	}
+	now := time.Now()
+	job := &models.RescanJob{Schedule: schedule.Name, Status: models.RescanJobRunning, StartedAt: now}
+	if schedule.MaxAge > 0 {
+		cutoff := now.Add(-schedule.MaxAge)
+		job.Cutoff = &cutoff
+	}
+	rs.binariesDue(job).Count(&job.Total)
+	if err := rs.DB.Create(job).Error; err != nil {
+		return nil, err
+	}
+	log.Infof("Started rescan job %d of %s, %d binaries", job.ID, schedule.Name, job.Total)
+	rs.feed(job)
+	return job, nil
+}
+
+//Cancel stops a running rescan job and removes its scans not started yet
+func (rs *RescanScheduler) Cancel(id uint) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	job := models.RescanJob{}
+	if rs.DB.First(&job, id).RecordNotFound() {
+		return fmt.Errorf("no rescan job %d", id)
+	}
+	if job.Status != models.RescanJobRunning {
+		return fmt.Errorf("rescan job %d is %s", id, job.Status)
+	}
+	now := time.Now()
+	tx := rs.DB.Begin()
+	removed := tx.Unscoped().Where("rescan_job_id = ? AND status = ?", job.ID, models.ScanJobPending).Delete(models.ScanJob{}).RowsAffected
+	tx.Model(&job).Updates(map[string]interface{}{"status": models.RescanJobCancelled, "finished_at": &now, "queued": job.Queued - int(removed)})
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	log.Infof("Cancelled rescan job %d of %s", job.ID, job.Schedule)
+	return nil
+}
+
+//feed tops up the scans queued by a job to BatchSize, and finishes it once every binary was queued and scanned
+func (rs *RescanScheduler) feed(job *models.RescanJob) {
+	inFlight := 0
+	rs.DB.Model(&models.ScanJob{}).Where("rescan_job_id = ? AND status IN (?)", job.ID, []string{models.ScanJobPending, models.ScanJobLeased}).Count(&inFlight)
+	if inFlight >= rs.BatchSize {
+		return
+	}
+	binaries := make([]models.Binary, 0)
+	rs.binariesDue(job).Select("id, hash").Order("id").Limit(rs.BatchSize - inFlight).Find(&binaries)
+	if len(binaries) == 0 {
+		if inFlight == 0 {
+			now := time.Now()
+			rs.DB.Model(job).Updates(map[string]interface{}{"status": models.RescanJobDone, "finished_at": &now})
+			log.Infof("Rescan job %d of %s done, %d binaries queued", job.ID, job.Schedule, job.Queued)
+		}
+		return
+	}
+	hashes := make([]string, 0, len(binaries))
+	for _, bin := range binaries {
+		hashes = append(hashes, bin.Hash)
+	}
+	if err := rs.Queue.EnqueueRescan(hashes, job.ID); err != nil {
+		log.Errorf("Error queueing binaries of rescan job %d %v", job.ID, err)
+		return
+	}
+	rs.DB.Model(job).Updates(map[string]interface{}{"queued": job.Queued + len(hashes), "cursor": binaries[len(binaries)-1].ID})
+}
+
+//due returns whether a schedule should run, from its last run or the scheduler's start when it never ran
+func (rs *RescanScheduler) due(schedule RescanSchedule, now time.Time) bool {
+	last := models.RescanJob{}
+	from := rs.started
+	if !rs.DB.Where("schedule = ?", schedule.Name).Order("id desc").First(&last).RecordNotFound() {
+		if last.Status == models.RescanJobRunning {
+			return false
+		}
+		from = last.StartedAt
+	}
+	return !schedule.schedule.Next(from).After(now)
+}
+
+//tick starts the schedules due and feeds the running jobs
+func (rs *RescanScheduler) tick() {
+	now := time.Now()
+	for _, schedule := range rs.Schedules {
+		if schedule.schedule != nil && rs.due(schedule, now) {
+			if _, err := rs.Run(schedule); err != nil {
+				log.Errorf("Error starting rescan %s - %v", schedule.Name, err)
+			}
+		}
+	}
+	running := make([]models.RescanJob, 0)
+	rs.DB.Where("status = ?", models.RescanJobRunning).Find(&running)
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	for i := range running {
+		rs.feed(&running[i])
+	}
+}
+
+//Go runs the scheduler until Stop is called
+func (rs *RescanScheduler) Go(wg *sync.WaitGroup) {
+	wg.Add(1)
+	defer log.Debugf("Rescan scheduler exiting")
+	defer wg.Done()
+	ticker := time.NewTicker(rs.Interval)
+	defer ticker.Stop()
+	for {
+		rs.tick()
+		select {
+		case <-rs.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//Stop stops the scheduler, running jobs resume on the next start
+func (rs *RescanScheduler) Stop() {
+	close(rs.stop)
+}
+
+//RescanJobProgress counts the scans of a rescan job still queued, failed and completed.
+//Binaries that were already queued by something else when the job reached them count as completed
+func RescanJobProgress(db *gorm.DB, job *models.RescanJob) {
+	db.Model(&models.ScanJob{}).Where("rescan_job_id = ? AND status IN (?)", job.ID, []string{models.ScanJobPending, models.ScanJobLeased}).Count(&job.Pending)
+	db.Model(&models.ScanJob{}).Where("rescan_job_id = ? AND status = ?", job.ID, models.ScanJobFailed).Count(&job.Failed)
+	job.Completed = job.Queued - job.Pending - job.Failed
+	if job.Completed < 0 {
+		job.Completed = 0
+	}
+}
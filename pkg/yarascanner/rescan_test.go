@@ -0,0 +1,62 @@
+package yarascanner
+
+import (
+	"fmt"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"testing"
+	"time"
+)
+
+//Test rescan jobs feed the queue in batches, skip binaries scanned recently and finish once their scans are done
+func TestRescanScheduler(t *testing.T) {
+	if _, err := ParseRescanSchedules([]byte(`[{"name":"bad","cron":"61 * * * *"}]`)); err == nil {
+		t.Fatalf("Expected an invalid cron expression refused")
+	}
+	schedules, err := ParseRescanSchedules([]byte(`[{"name":"nightly","cron":"0 2 * * *","max_age":"3d"}]`))
+	if err != nil || schedules[0].MaxAge != 72*time.Hour {
+		t.Fatalf("Expected the nightly schedule parsed, got %v %v", schedules, err)
+	}
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	recent := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		bin := models.Binary{Hash: fmt.Sprintf("bin%d", i)}
+		if i == 2 {
+			bin.LastScanedAt = recent
+		}
+		gdb.Create(&bin)
+	}
+	queue := NewScanQueue(gdb)
+	rescans := NewRescanScheduler(gdb, queue)
+	rescans.BatchSize = 2
+	rescans.Schedules = schedules
+
+	job, err := rescans.Run(schedules[0])
+	if err != nil || job.Total != 4 {
+		t.Fatalf("Expected a job over the 4 binaries not scanned within 3 days, got %v %v", job, err)
+	}
+	if _, err := rescans.Run(schedules[0]); err == nil {
+		t.Fatalf("Expected a second run refused while the first is running")
+	}
+	for scanned := 0; ; scanned++ {
+		scan, _ := queue.Lease("w")
+		if scan == nil {
+			rescans.tick()
+			if scan, _ = queue.Lease("w"); scan == nil {
+				break
+			}
+		}
+		if scan.Class != models.ScanClassPeriodic || scan.BinaryHash == "bin2" || queue.Depth(models.ScanJobPending) > 1 {
+			t.Fatalf("Expected periodic scans of the binaries due, in batches of 2, got %+v", scan)
+		}
+		queue.Complete(scan)
+	}
+	gdb.First(job, job.ID)
+	RescanJobProgress(gdb, job)
+	if job.Status != models.RescanJobDone || job.Queued != 4 || job.Completed != 4 {
+		t.Fatalf("Expected the job done with 4 scans completed, got %+v", job)
+	}
+	if rescans.due(schedules[0], time.Now()) {
+		t.Fatalf("Expected the nightly schedule not due again right after its run")
+	}
+}
@@ -0,0 +1,156 @@
+package yarascanner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/hillu/go-yara"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//CompiledRulesExt is the extension of precompiled yara rulesets, as written by yarac or the RuleCache
+const CompiledRulesExt = ".yarc"
+
+//DefaultRuleCacheEntries is the number of compiled rulesets a RuleCache keeps on disk
+const DefaultRuleCacheEntries = 3
+
+//listRuleFiles returns the sorted names of the rule sources, the precompiled rulesets and the rule bundles in dir, skipping their signatures
+func listRuleFiles(dir string) (sources []string, compiled []string, bundles []string, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") || isSignatureFile(name) {
+			continue
+		}
+		if strings.EqualFold(filepath.Ext(name), CompiledRulesExt) {
+			compiled = append(compiled, name)
+		} else if len(bundleExt(name)) > 0 {
+			bundles = append(bundles, name)
+		} else {
+			sources = append(sources, name)
+		}
+	}
+	sort.Strings(sources)
+	sort.Strings(compiled)
+	sort.Strings(bundles)
+	return sources, compiled, bundles, nil
+}
+
+//hashFile returns the sha256 of a file's contents
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+//hashRuleFiles returns the content hash of each of the given files in dir
+func hashRuleFiles(dir string, names []string) (map[string]string, error) {
+	hashes := make(map[string]string, len(names))
+	for _, name := range names {
+		hash, err := hashFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		hashes[name] = hash
+	}
+	return hashes, nil
+}
+
+//combineHashes returns a single sha256 over the names and content hashes of a set of files
+func combineHashes(names []string, hashes map[string]string) string {
+	hasher := sha256.New()
+	for _, name := range names {
+		io.WriteString(hasher, name)
+		hasher.Write([]byte{0})
+		io.WriteString(hasher, hashes[name])
+		hasher.Write([]byte{0})
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+//RuleCache keeps compiled rulesets on disk keyed by the content hash of their sources, so unchanged rules are not recompiled
+type RuleCache struct {
+	Dir        string
+	MaxEntries int
+}
+
+//NewRuleCache returns a RuleCache storing rulesets in dir, creating it if needed
+func NewRuleCache(dir string) (*RuleCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &RuleCache{Dir: dir, MaxEntries: DefaultRuleCacheEntries}, nil
+}
+
+func (rc *RuleCache) path(hash string) string {
+	return filepath.Join(rc.Dir, hash+CompiledRulesExt)
+}
+
+//Load returns the cached ruleset for hash, or nil if there is none
+func (rc *RuleCache) Load(hash string) (*yara.Rules, error) {
+	path := rc.path(hash)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	rules, err := yara.LoadRules(path)
+	if err != nil {
+		return nil, err
+	}
+	//touch the entry so pruning keeps the most recently used rulesets
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return rules, nil
+}
+
+//Save stores rules in the cache under hash and prunes the oldest entries
+func (rc *RuleCache) Save(hash string, rules *yara.Rules) error {
+	tmpPath := rc.path(hash) + ".tmp"
+	if err := rules.Save(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, rc.path(hash)); err != nil {
+		return err
+	}
+	rc.prune()
+	return nil
+}
+
+//prune removes all but the MaxEntries most recently used rulesets
+func (rc *RuleCache) prune() {
+	if rc.MaxEntries <= 0 {
+		return
+	}
+	files, err := ioutil.ReadDir(rc.Dir)
+	if err != nil {
+		log.Errorf("Error listing rule cache %s %v", rc.Dir, err)
+		return
+	}
+	entries := make([]os.FileInfo, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == CompiledRulesExt {
+			entries = append(entries, file)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime().After(entries[j].ModTime()) })
+	for i := rc.MaxEntries; i < len(entries); i++ {
+		log.Debugf("Pruning cached ruleset %s", entries[i].Name())
+		os.Remove(filepath.Join(rc.Dir, entries[i].Name()))
+	}
+}
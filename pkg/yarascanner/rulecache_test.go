@@ -0,0 +1,85 @@
+package yarascanner
+
+import (
+	"fmt"
+	"github.com/hillu/go-yara"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//Test unchanged sources load from the cache, edited sources are compiled again and corrupt entries are recompiled
+func TestRuleCache(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "rulecache")
+	defer os.RemoveAll(dir)
+	ruleDir, cacheDir := filepath.Join(dir, "rules"), filepath.Join(dir, "cache")
+	os.Mkdir(ruleDir, 0755)
+	writeTestFiles(t, ruleDir, map[string]string{"a.yar": "rule first { condition: true }"})
+	load := func() *Ruleset {
+		wrp, err := NewWatchedRulesetProvider(ruleDir, gdb, nil)
+		if err != nil {
+			t.Fatalf("Error creating provider %v", err)
+		}
+		wrp.CacheDir = cacheDir
+		if err := wrp.LoadRules(); err != nil {
+			t.Fatalf("Error loading rules %v", err)
+		}
+		ruleset, _ := wrp.GetRules()
+		return ruleset
+	}
+	entry := func() string {
+		wrp := &WatchedRulesetProvider{}
+		hashes, err := hashRuleFiles(ruleDir, []string{"a.yar"})
+		if err != nil {
+			t.Fatalf("Error hashing rules %v", err)
+		}
+		return filepath.Join(cacheDir, wrp.cacheKey(combineHashes([]string{"a.yar"}, hashes))+CompiledRulesExt)
+	}
+
+	if rules := rulesetRules(load()); fmt.Sprint(rules) != "[a.yar:first]" {
+		t.Fatalf("Expected the rules compiled, got %v", rules)
+	}
+	if _, err := os.Stat(entry()); err != nil {
+		t.Fatalf("Expected the compiled rules cached, got %v", err)
+	}
+	//swap the cached entry for other rules, a cache hit loads them rather than compiling the sources
+	compiler, _ := yara.NewCompiler()
+	DefaultExternals(nil).Declare(compiler)
+	compiler.AddString("rule cached { condition: true }", "a.yar")
+	cached, err := compiler.GetRules()
+	if err != nil {
+		t.Fatalf("Error compiling %v", err)
+	}
+	if err := cached.Save(entry()); err != nil {
+		t.Fatalf("Error saving %v", err)
+	}
+	if rules := rulesetRules(load()); fmt.Sprint(rules) != "[a.yar:cached]" {
+		t.Fatalf("Expected the unchanged sources loaded from the cache, got %v", rules)
+	}
+
+	writeTestFiles(t, ruleDir, map[string]string{"a.yar": "rule first { condition: true }\nrule second { condition: false }"})
+	if rules := rulesetRules(load()); fmt.Sprint(rules) != "[a.yar:first a.yar:second]" {
+		t.Fatalf("Expected the edited sources compiled, got %v", rules)
+	}
+
+	ioutil.WriteFile(entry(), []byte("not compiled rules"), 0644)
+	if rules := rulesetRules(load()); fmt.Sprint(rules) != "[a.yar:first a.yar:second]" {
+		t.Fatalf("Expected the sources compiled in place of a corrupt cache entry, got %v", rules)
+	}
+	if rules, err := yara.LoadRules(entry()); err != nil || rules == nil {
+		t.Fatalf("Expected the corrupt entry replaced, got %v", err)
+	}
+
+	cache, _ := NewRuleCache(cacheDir)
+	cache.MaxEntries = 1
+	cache.Save("latest", cached)
+	if files, _ := ioutil.ReadDir(cacheDir); len(files) != 1 || files[0].Name() != "latest"+CompiledRulesExt {
+		t.Fatalf("Expected all but the latest entry pruned, got %v", files)
+	}
+	if rules, err := cache.Load("missing"); rules != nil || err != nil {
+		t.Fatalf("Expected no rules for a missing entry, got %v %v", rules, err)
+	}
+}
@@ -0,0 +1,124 @@
+package yarascanner
+
+import (
+	"fmt"
+	"github.com/hillu/go-yara"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"sort"
+)
+
+//metaString returns the string form of a rule metadata value
+func metaString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+//ruleSourceFile returns the file a rule of the given compiled unit of the ruleset came from.
+//Rules compiled from sources are namespaced by their file name
+func ruleSourceFile(ruleset *Ruleset, unit int, rule *yara.Rule) string {
+	if unit < len(ruleset.Origins) && len(ruleset.Origins[unit]) > 0 {
+		return ruleset.Origins[unit]
+	}
+	return rule.Namespace()
+}
+
+//IndexRules records every rule of the ruleset in the DB, along with its tags, metadata and score under the scoring policy.
+//Rules whose source file is unchanged are left alone and rules no longer in the ruleset are deleted
+func IndexRules(db *gorm.DB, ruleset *Ruleset, scoring ScoringPolicy) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	active := make(map[uint]bool)
+	for unit, rules := range ruleset.Rules {
+		for _, rule := range rules.GetRules() {
+			record := models.Rule{}
+			if err := tx.Unscoped().Where(models.Rule{Namespace: rule.Namespace(), Identifier: rule.Identifier()}).FirstOrInit(&record).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+			sourceFile := ruleSourceFile(ruleset, unit, &rule)
+			sourceHash := ruleset.Files[sourceFile]
+			metas := rule.Metas()
+			state := record.StateOverride
+			if len(state) == 0 {
+				state = metaRuleState(metas)
+			}
+			score := scoring.Score(rule.Namespace(), rule.Tags(), metas)
+			if record.ID != 0 && record.DeletedAt == nil && record.SourceFile == sourceFile && record.SourceHash == sourceHash && record.State == state && record.Score == score {
+				active[record.ID] = true
+				continue
+			}
+			fromState := record.State
+			record.DeletedAt = nil
+			record.SourceFile = sourceFile
+			record.SourceHash = sourceHash
+			record.State = state
+			record.Author = metaString(metas["author"])
+			record.Description = metaString(metas["description"])
+			record.Reference = metaString(metas["reference"])
+			record.Score = score
+			if err := tx.Unscoped().Save(&record).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+			if len(fromState) > 0 && fromState != state {
+				if err := tx.Create(&models.RuleStateChange{RuleID: record.ID, FromState: fromState, ToState: state, Actor: "metadata"}).Error; err != nil {
+					tx.Rollback()
+					return err
+				}
+				log.Infof("Rule %s:%s changed from %q to %s by its metadata", record.Namespace, record.Identifier, fromState, state)
+			}
+			active[record.ID] = true
+			if err := tx.Where("rule_id = ?", record.ID).Delete(models.RuleTag{}).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+			if err := tx.Where("rule_id = ?", record.ID).Delete(models.RuleMeta{}).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+			for _, tag := range rule.Tags() {
+				if err := tx.Create(&models.RuleTag{RuleID: record.ID, Tag: tag}).Error; err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+			keys := make([]string, 0, len(metas))
+			for key := range metas {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if err := tx.Create(&models.RuleMeta{RuleID: record.ID, Key: key, Value: metaString(metas[key])}).Error; err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+		}
+	}
+	indexed := make([]models.Rule, 0)
+	if err := tx.Find(&indexed).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	removed := 0
+	for _, record := range indexed {
+		if !active[record.ID] {
+			if err := tx.Delete(&record).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+			removed++
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	log.Infof("Indexed %d rules of ruleset %s, %d removed", len(active), ruleset.Hash, removed)
+	return nil
+}
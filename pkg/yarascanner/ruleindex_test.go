@@ -0,0 +1,101 @@
+package yarascanner
+
+import (
+	"fmt"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"os"
+	"testing"
+)
+
+const indexTestRules = `rule tagged : evil dropper {
+	meta:
+		author = "analyst"
+		description = "drops things"
+		score = 80
+		status = "testing"
+	condition:
+		true
+}
+
+rule plain { condition: false }
+`
+
+//Test rules are indexed with their tags and metadata, rules removed from the ruleset are marked removed and
+//states set through the API survive re-indexing
+func TestIndexRules(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "ruleindex")
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{"a.yar": indexTestRules})
+	wrp, err := NewWatchedRulesetProvider(dir, gdb, nil)
+	if err != nil {
+		t.Fatalf("Error creating provider %v", err)
+	}
+	if err := wrp.LoadRules(); err != nil {
+		t.Fatalf("Error loading rules %v", err)
+	}
+
+	tagged := models.Rule{}
+	if gdb.Preload("Tags").Preload("Metas").Where("namespace = ? AND identifier = ?", "a.yar", "tagged").First(&tagged).RecordNotFound() {
+		t.Fatalf("Expected rule tagged indexed")
+	}
+	if tagged.Author != "analyst" || tagged.Description != "drops things" || tagged.State != models.RuleStateTesting || tagged.SourceFile != "a.yar" {
+		t.Fatalf("Expected the rule's metadata and state indexed, got %+v", tagged)
+	}
+	tags := make([]string, 0)
+	for _, tag := range tagged.Tags {
+		tags = append(tags, tag.Tag)
+	}
+	metas := make(map[string]string)
+	for _, meta := range tagged.Metas {
+		metas[meta.Key] = meta.Value
+	}
+	if fmt.Sprint(tags) != "[evil dropper]" || len(metas) != 4 || metas["score"] != "80" || metas["status"] != "testing" {
+		t.Fatalf("Expected the tags and metadata indexed, got %v %v", tags, metas)
+	}
+
+	plain := models.Rule{}
+	gdb.Where("identifier = ?", "plain").First(&plain)
+	if plain.State != models.RuleStateProduction {
+		t.Fatalf("Expected a rule without a status in production, got %s", plain.State)
+	}
+	gdb.Model(&plain).Updates(map[string]interface{}{"state": models.RuleStateRetired, "state_override": models.RuleStateRetired})
+	writeTestFiles(t, dir, map[string]string{"a.yar": "rule plain { condition: filesize > 10 }"})
+	if _, err := wrp.reload("test"); err != nil {
+		t.Fatalf("Error reloading rules %v", err)
+	}
+
+	removed := models.Rule{}
+	gdb.Unscoped().Where("identifier = ?", "tagged").First(&removed)
+	if removed.DeletedAt == nil || !gdb.Where("identifier = ?", "tagged").First(&models.Rule{}).RecordNotFound() {
+		t.Fatalf("Expected the rule removed from the ruleset marked removed, got %+v", removed)
+	}
+	reindexed := models.Rule{}
+	gdb.First(&reindexed, plain.ID)
+	if reindexed.State != models.RuleStateRetired || reindexed.StateOverride != models.RuleStateRetired || reindexed.SourceHash == plain.SourceHash {
+		t.Fatalf("Expected the edited rule re-indexed keeping its state override, got %+v", reindexed)
+	}
+}
+
+//Test a failed write rolls the whole index back
+func TestIndexRulesRollback(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "ruleindex")
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{"a.yar": indexTestRules})
+	wrp, _ := NewWatchedRulesetProvider(dir, gdb, nil)
+	if err := wrp.LoadRules(); err != nil {
+		t.Fatalf("Error loading rules %v", err)
+	}
+	ruleset, _ := wrp.GetRules()
+	gdb.Delete(models.Rule{})
+	gdb.DropTable(&models.RuleMeta{})
+	if err := IndexRules(gdb, ruleset, DefaultScoringPolicy); err == nil {
+		t.Fatalf("Expected indexing to fail without the rule_meta table")
+	}
+	if count := 0; gdb.Model(&models.Rule{}).Count(&count).Error != nil || count != 0 {
+		t.Fatalf("Expected the rules indexed before the failure rolled back, got %d", count)
+	}
+}
@@ -0,0 +1,110 @@
+package yarascanner
+
+import (
+	"context"
+	"github.com/hillu/go-yara"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+//Ruleset is a compiled set of yara rules handed out by a RulesetProvider.
+//Precompiled .yarc files can't be merged with rules compiled from source, so a ruleset may be made of several compiled units
+type Ruleset struct {
+	//Hash is the content hash of every rule file the ruleset was built from
+	Hash  string
+	Rules []*yara.Rules
+	//Origins holds, for each compiled unit, the .yarc file or bundle it was loaded from, or "" for the unit compiled from sources
+	Origins []string
+	//Files maps the name of every rule file the ruleset was built from to its content hash
+	Files map[string]string
+	//Revision identifies where the rule files came from, ie the git commit they were checked out at
+	Revision string
+	//Version is the ID of the models.RulesetVersion recorded for the ruleset
+	Version uint
+	//ScanOptions are the flags and timeout binaries are scanned with
+	ScanOptions ScanOptions
+	//Shadow holds the draft and testing rules, whose matches are recorded apart from production, it is nil when there are none
+	Shadow *Ruleset
+	//Fingerprints maps the ruleKey of every rule to a hash of its source, States to its lifecycle state
+	Fingerprints map[string]string
+	States       map[string]string
+	sources      map[string]*namespaceSource
+	//Delta holds only the rules changed since the ruleset version Base, the binaries are rescanned with it when a routine edit
+	//is put into use. It is nil when they must be rescanned with the whole ruleset
+	Delta *Ruleset
+	Base  uint
+	//Scope is set on a delta to the ruleKeys of the rules changed or removed, only their results are reconciled with its scans
+	Scope map[string]bool
+}
+
+//Scan scans a file with every compiled unit of the ruleset using its ScanOptions, without cancellation
+func (rs *Ruleset) Scan(filename string) ([]yara.MatchRule, error) {
+	return rs.ScanContext(context.Background(), filename)
+}
+
+//ScanContext scans a file with every compiled unit of the ruleset using its ScanOptions, stopping once MaxMatches rules matched.
+//With FullRescanOnMatch, units matching in fast mode are scanned again in full mode and their full matches returned.
+//Once ctx is done the scan is aborted and ctx's error returned. libyara only calls back as it evaluates the rules,
+//so a scan cancelled during the string search of a unit stops when that search ends
+func (rs *Ruleset) ScanContext(ctx context.Context, filename string) ([]yara.MatchRule, error) {
+	options := rs.ScanOptions
+	matches := make([]yara.MatchRule, 0)
+	for _, rules := range rs.Rules {
+		limit := 0
+		if options.MaxMatches > 0 {
+			limit = options.MaxMatches - len(matches)
+		}
+		unitMatches, err := scanUnit(ctx, rules, filename, options.Flags, options.Timeout, limit)
+		if err != nil {
+			return nil, err
+		}
+		if len(unitMatches) > 0 && options.FullRescanOnMatch && options.Flags&yara.ScanFlagsFastMode != 0 {
+			log.Debugf("Rescanning %s in full mode after %d fast mode matches", filename, len(unitMatches))
+			if unitMatches, err = scanUnit(ctx, rules, filename, options.Flags&^yara.ScanFlagsFastMode, options.Timeout, limit); err != nil {
+				return nil, err
+			}
+		}
+		matches = append(matches, unitMatches...)
+		if options.MaxMatches > 0 && len(matches) >= options.MaxMatches {
+			log.Debugf("Stopped scanning %s after %d matches", filename, len(matches))
+			break
+		}
+	}
+	return matches, nil
+}
+
+//scanCallback collects the matches of a scan, aborting it once ctx is done or limit rules matched
+type scanCallback struct {
+	ctx     context.Context
+	limit   int
+	matches yara.MatchRules
+}
+
+//RuleMatching records the match and aborts the scan at the limit
+func (cb *scanCallback) RuleMatching(rule *yara.Rule) (bool, error) {
+	if cb.ctx.Err() != nil {
+		return true, nil
+	}
+	cb.matches.RuleMatching(rule)
+	return cb.limit > 0 && len(cb.matches) >= cb.limit, nil
+}
+
+//RuleNotMatching aborts the scan once ctx is done
+func (cb *scanCallback) RuleNotMatching(rule *yara.Rule) (bool, error) {
+	return cb.ctx.Err() != nil, nil
+}
+
+//scanUnit scans a file with a compiled unit, returning at most limit matches when it isn't 0
+func scanUnit(ctx context.Context, rules *yara.Rules, filename string, flags yara.ScanFlags, timeout time.Duration, limit int) ([]yara.MatchRule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cb := &scanCallback{ctx: ctx, limit: limit}
+	if err := rules.ScanFileWithCallback(filename, flags, timeout, cb); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return cb.matches, nil
+}
@@ -0,0 +1,55 @@
+package yarascanner
+
+import (
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"sort"
+	"time"
+)
+
+//RecordRulesetVersion records the ruleset as a models.RulesetVersion with the given status and sets its Version.
+//When the latest recorded version has the same hash, ie after a restart with unchanged rules, it is reused
+func RecordRulesetVersion(db *gorm.DB, ruleset *Ruleset, trigger, status string) error {
+	latest := models.RulesetVersion{}
+	if !db.Order("id desc").First(&latest).RecordNotFound() && latest.Hash == ruleset.Hash {
+		ruleset.Version = latest.ID
+		log.Debugf("Ruleset %s is still version %d", ruleset.Hash, latest.ID)
+		if latest.Status != status {
+			return db.Model(&latest).Update("status", status).Error
+		}
+		return nil
+	}
+	names := make([]string, 0, len(ruleset.Files))
+	for name := range ruleset.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	version := models.RulesetVersion{Hash: ruleset.Hash, CompiledAt: time.Now(), Trigger: trigger, Status: status, Revision: ruleset.Revision}
+	for _, name := range names {
+		version.Files = append(version.Files, models.RulesetFile{Name: name, Hash: ruleset.Files[name]})
+	}
+	if err := db.Create(&version).Error; err != nil {
+		return err
+	}
+	ruleset.Version = version.ID
+	log.Infof("Recorded ruleset %s as %s version %d (%s) %s", ruleset.Hash, status, version.ID, trigger, ruleset.Revision)
+	return nil
+}
+
+//ActivateRulesetVersion marks a version as the active one, the previously active version becomes inactive
+func ActivateRulesetVersion(db *gorm.DB, version uint) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := tx.Model(&models.RulesetVersion{}).Where("status = ? AND id <> ?", models.RulesetVersionActive, version).Update("status", models.RulesetVersionInactive).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Model(&models.RulesetVersion{}).Where("id = ?", version).Update("status", models.RulesetVersionActive).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
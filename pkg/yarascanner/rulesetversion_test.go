@@ -0,0 +1,43 @@
+package yarascanner
+
+import (
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"testing"
+)
+
+//Test an unchanged ruleset keeps its version and activating a version deactivates the previously active one
+func TestRulesetVersions(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	first := &Ruleset{Hash: "one", Files: map[string]string{"b.yar": "2", "a.yar": "1"}, Revision: "abc123"}
+	if err := RecordRulesetVersion(gdb, first, "startup", models.RulesetVersionActive); err != nil || first.Version == 0 {
+		t.Fatalf("Expected the ruleset recorded, got version %d %v", first.Version, err)
+	}
+	version := models.RulesetVersion{}
+	gdb.Preload("Files").First(&version, first.Version)
+	if version.Revision != "abc123" || len(version.Files) != 2 || version.Files[0].Name != "a.yar" || version.Files[0].Hash != "1" {
+		t.Fatalf("Expected the version recorded with its revision and sorted files, got %+v", version)
+	}
+	restarted := &Ruleset{Hash: "one"}
+	if err := RecordRulesetVersion(gdb, restarted, "startup", models.RulesetVersionActive); err != nil || restarted.Version != first.Version {
+		t.Fatalf("Expected the identical ruleset to reuse version %d, got %d %v", first.Version, restarted.Version, err)
+	}
+
+	second := &Ruleset{Hash: "two"}
+	RecordRulesetVersion(gdb, second, "edit", models.RulesetVersionCandidate)
+	if second.Version == first.Version {
+		t.Fatalf("Expected a new version for a new hash")
+	}
+	if err := ActivateRulesetVersion(gdb, second.Version); err != nil {
+		t.Fatalf("Error activating version %v", err)
+	}
+	active := make([]models.RulesetVersion, 0)
+	gdb.Where("status = ?", models.RulesetVersionActive).Find(&active)
+	if len(active) != 1 || active[0].ID != second.Version {
+		t.Fatalf("Expected only version %d active, got %+v", second.Version, active)
+	}
+	gdb.First(&version, first.Version)
+	if version.Status != models.RulesetVersionInactive {
+		t.Fatalf("Expected the previous version inactive, got %s", version.Status)
+	}
+}
@@ -0,0 +1,153 @@
+package yarascanner
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/hillu/go-yara"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"sort"
+	"strings"
+)
+
+//RuleStateMetaKeys are the rule metadata keys read for a rule's lifecycle state, in order of precedence
+var RuleStateMetaKeys = []string{"status", "state"}
+
+//ruleKey identifies a rule across compiled units
+func ruleKey(namespace, identifier string) string {
+	return namespace + ":" + identifier
+}
+
+//IsShadowState returns whether rules in state run in the shadow ruleset
+func IsShadowState(state string) bool {
+	return state == models.RuleStateDraft || state == models.RuleStateTesting
+}
+
+//metaRuleState returns the lifecycle state declared in a rule's metadata, production if none is
+func metaRuleState(metas map[string]interface{}) string {
+	for _, key := range RuleStateMetaKeys {
+		state := strings.ToLower(strings.TrimSpace(metaString(metas[key])))
+		if models.ValidRuleState(state) {
+			return state
+		}
+	}
+	return models.RuleStateProduction
+}
+
+//ruleState returns the effective lifecycle state of a rule, an override from the DB wins over the metadata
+func ruleState(rule *yara.Rule, overrides map[string]string) string {
+	if state, ok := overrides[ruleKey(rule.Namespace(), rule.Identifier())]; ok {
+		return state
+	}
+	return metaRuleState(rule.Metas())
+}
+
+//loadRuleStateOverrides returns the states set through the API keyed by ruleKey
+func loadRuleStateOverrides(db *gorm.DB) (map[string]string, error) {
+	rules := make([]models.Rule, 0)
+	if err := db.Where("state_override <> ''").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	overrides := make(map[string]string, len(rules))
+	for _, rule := range rules {
+		overrides[ruleKey(rule.Namespace, rule.Identifier)] = rule.StateOverride
+	}
+	return overrides, nil
+}
+
+//hashRuleStates folds the state overrides into a ruleset hash, so a state change makes a new ruleset version
+func hashRuleStates(hash string, overrides map[string]string) string {
+	if len(overrides) == 0 {
+		return hash
+	}
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return combineHashes(append([]string{hash}, keys...), overrides)
+}
+
+//copyRules duplicates a compiled unit so its rules can be enabled independently
+func copyRules(rules *yara.Rules) (*yara.Rules, error) {
+	buf := bytes.Buffer{}
+	if err := rules.Write(&buf); err != nil {
+		return nil, err
+	}
+	return yara.ReadRules(&buf)
+}
+
+//applyRuleStates enables only production rules in the ruleset and moves draft and testing rules to its Shadow ruleset.
+//Retired rules are disabled in both
+func applyRuleStates(ruleset *Ruleset, overrides map[string]string) error {
+	shadow := &Ruleset{Hash: ruleset.Hash, Files: ruleset.Files, ScanOptions: ruleset.ScanOptions}
+	ruleset.States = make(map[string]string)
+	for unit, rules := range ruleset.Rules {
+		states := make(map[string]string)
+		shadowCount := 0
+		for _, rule := range rules.GetRules() {
+			state := ruleState(&rule, overrides)
+			states[ruleKey(rule.Namespace(), rule.Identifier())] = state
+			ruleset.States[ruleKey(rule.Namespace(), rule.Identifier())] = state
+			if IsShadowState(state) {
+				shadowCount++
+			}
+		}
+		if shadowCount > 0 {
+			shadowRules, err := copyRules(rules)
+			if err != nil {
+				return fmt.Errorf("copying rules for the shadow ruleset - %v", err)
+			}
+			for _, rule := range shadowRules.GetRules() {
+				if IsShadowState(states[ruleKey(rule.Namespace(), rule.Identifier())]) {
+					rule.Enable()
+				} else {
+					rule.Disable()
+				}
+			}
+			shadow.Rules = append(shadow.Rules, shadowRules)
+			shadow.Origins = append(shadow.Origins, ruleset.Origins[unit])
+			log.Debugf("%d shadow rules in unit %d of ruleset %s", shadowCount, unit, ruleset.Hash)
+		}
+		for _, rule := range rules.GetRules() {
+			if states[ruleKey(rule.Namespace(), rule.Identifier())] == models.RuleStateProduction {
+				rule.Enable()
+			} else {
+				rule.Disable()
+			}
+		}
+	}
+	if len(shadow.Rules) > 0 {
+		ruleset.Shadow = shadow
+	}
+	return nil
+}
+
+//SetRuleState changes the lifecycle state of an indexed rule, logs the transition and reloads the ruleset.
+//The rule watchers are notified when the new ruleset is put into use, so the binaries get rescanned with the rule in its new state
+func (wrp *WatchedRulesetProvider) SetRuleState(ruleID uint, state, actor string) error {
+	if !models.ValidRuleState(state) {
+		return fmt.Errorf("invalid rule state %q", state)
+	}
+	record := models.Rule{}
+	if wrp.RuleDB.First(&record, ruleID).RecordNotFound() {
+		return fmt.Errorf("no rule %d", ruleID)
+	}
+	fromState := record.State
+	tx := wrp.RuleDB.Begin()
+	tx.Model(&record).Updates(map[string]interface{}{"state": state, "state_override": state})
+	tx.Create(&models.RuleStateChange{RuleID: record.ID, FromState: fromState, ToState: state, Actor: actor})
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	log.Infof("Rule %s:%s changed from %s to %s by %s", record.Namespace, record.Identifier, fromState, state, actor)
+	trigger := fmt.Sprintf("rule %s:%s set to %s by %s", record.Namespace, record.Identifier, state, actor)
+	changed, err := wrp.reload(trigger)
+	if err != nil || !changed {
+		return err
+	}
+	wrp.notify(fsnotify.Event{Name: trigger})
+	return nil
+}
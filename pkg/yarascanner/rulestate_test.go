@@ -0,0 +1,77 @@
+package yarascanner
+
+import (
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Test rule state changes rescan the binaries and move their results between the production and shadow sides
+func TestSetRuleState(t *testing.T) {
+	for _, deltaRescans := range []bool{true, false} {
+		gdb := openTestDB(t)
+		dir := testDir(t, "rulestate")
+		ruleDir, binDir := filepath.Join(dir, "rules"), filepath.Join(dir, "bins")
+		os.Mkdir(ruleDir, 0755)
+		os.Mkdir(binDir, 0755)
+		writeTestFiles(t, ruleDir, map[string]string{"a.yar": `rule candidate { meta: status = "testing" condition: true }
+rule steady { condition: true }`})
+		writeTestFiles(t, binDir, map[string]string{"bin": "content"})
+		wrp, _ := NewWatchedRulesetProvider(ruleDir, gdb, nil)
+		wrp.DeltaRescans = deltaRescans
+		if err := wrp.LoadRules(); err != nil {
+			t.Fatalf("Error loading rules %v", err)
+		}
+		queue := NewScanQueue(gdb)
+		wg := &sync.WaitGroup{}
+		go BinaryRescanRuleWatcher(gdb, wrp.OutgoingRulesChan, wrp, queue, wg)
+		queue.Enqueue("bin", models.ScanClassIngest)
+		scanAll := func() {
+			runScanningWorker(t, NewScanQueue(gdb), wrp, binDir, func() bool {
+				return queue.Depth(models.ScanJobPending)+queue.Depth(models.ScanJobLeased) == 0
+			})
+		}
+		open := func(rule string, shadow bool) bool {
+			result := models.Result{}
+			return !gdb.Where("rule_name = ? AND shadow = ? AND closed_at IS NULL", rule, shadow).First(&result).RecordNotFound()
+		}
+		scanAll()
+		if !open("steady", false) || !open("candidate", true) || open("candidate", false) {
+			t.Fatalf("Expected steady matched in production and candidate in the shadow ruleset (delta %v)", deltaRescans)
+		}
+
+		setState := func(identifier, state string) {
+			rule := models.Rule{}
+			gdb.Where("identifier = ?", identifier).First(&rule)
+			if err := wrp.SetRuleState(rule.ID, state, "tester"); err != nil {
+				t.Fatalf("Error setting %s %s %v", identifier, state, err)
+			}
+			for deadline := time.Now().Add(10 * time.Second); queue.Depth(models.ScanJobPending) == 0; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected a rescan queued after %s was set %s (delta %v)", identifier, state, deltaRescans)
+				}
+			}
+			scanAll()
+		}
+
+		setState("candidate", models.RuleStateProduction)
+		if !open("candidate", false) || open("candidate", true) || !open("steady", false) {
+			t.Fatalf("Expected candidate moved from the shadow results to production (delta %v)", deltaRescans)
+		}
+		setState("steady", models.RuleStateRetired)
+		if open("steady", false) || !open("candidate", false) {
+			t.Fatalf("Expected the result of the retired rule closed (delta %v)", deltaRescans)
+		}
+		setState("candidate", models.RuleStateTesting)
+		if open("candidate", false) || !open("candidate", true) {
+			t.Fatalf("Expected candidate moved back to the shadow results (delta %v)", deltaRescans)
+		}
+		wrp.Stop()
+		wg.Wait()
+		gdb.Close()
+		os.RemoveAll(dir)
+	}
+}
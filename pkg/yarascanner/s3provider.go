@@ -0,0 +1,206 @@
+package yarascanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/fsnotify/fsnotify"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//s3ManifestFile records which S3 objects, at which ETag, the files of the mirror came from
+const s3ManifestFile = ".s3manifest.json"
+
+//s3RuleExts are the extensions of the S3 objects mirrored besides rule bundles, signatures are mirrored along with the rules
+var s3RuleExts = map[string]bool{".yar": true, ".yara": true, ".minisig": true, ".sig": true}
+
+//isS3RuleObject returns whether an object key is a rule file, bundle or signature to mirror
+func isS3RuleObject(key string) bool {
+	return s3RuleExts[strings.ToLower(path.Ext(key))] || len(bundleExt(key)) > 0
+}
+
+//s3MirrorEntry is the ETag of a mirrored object and the rule files written for it
+type s3MirrorEntry struct {
+	ETag  string   `json:"etag"`
+	Files []string `json:"files"`
+}
+
+//S3RulesetProvider is a RulesetProvider for the rules stored under a prefix of an S3 bucket.
+//Rule files and bundles are mirrored into MirrorDir and reloaded when their ETag changes
+type S3RulesetProvider struct {
+	mirroredProvider
+	S3SVC     *s3.S3
+	Bucket    string
+	Prefix    string
+	MirrorDir string
+	manifest  map[string]s3MirrorEntry
+}
+
+//NewS3RulesetProvider mirrors the rules under prefix in bucket into mirrorDir and returns a provider for them
+func NewS3RulesetProvider(s3svc *s3.S3, bucket, prefix, mirrorDir string, interval time.Duration, ruleDb *gorm.DB) (*S3RulesetProvider, error) {
+	log.Debugf("NewS3RulesetProvider %s %s", bucket, prefix)
+	if err := os.MkdirAll(mirrorDir, 0755); err != nil {
+		return nil, err
+	}
+	sp := &S3RulesetProvider{S3SVC: s3svc, Bucket: bucket, Prefix: prefix, MirrorDir: mirrorDir, manifest: make(map[string]s3MirrorEntry)}
+	if raw, err := ioutil.ReadFile(filepath.Join(mirrorDir, s3ManifestFile)); err == nil {
+		if err := json.Unmarshal(raw, &sp.manifest); err != nil {
+			log.Errorf("Error reading S3 rule manifest, mirroring every rule again - %v", err)
+		}
+	}
+	if _, err := sp.update(); err != nil {
+		return nil, err
+	}
+	sp.pruneMirror()
+	wrp, err := NewWatchedRulesetProvider(mirrorDir, ruleDb, make(chan fsnotify.Event, 10))
+	if err != nil {
+		return nil, err
+	}
+	wrp.Revision = sp.revision
+	sp.mirroredProvider = newMirroredProvider(wrp, "s3://"+path.Join(bucket, prefix), interval, sp.update)
+	return sp, nil
+}
+
+//s3NameEscaper flattens object keys into file names, _ is doubled so a/b_c and a_b/c don't end up as the same file
+var s3NameEscaper = strings.NewReplacer("_", "__", "/", "_-")
+
+//localName flattens an object key below Prefix into a file name of the mirror
+func (sp *S3RulesetProvider) localName(key string) string {
+	return s3NameEscaper.Replace(strings.TrimLeft(strings.TrimPrefix(key, sp.Prefix), "/"))
+}
+
+//writeMirrorFile writes a rule file into the mirror, replacing any previous version atomically
+func (sp *S3RulesetProvider) writeMirrorFile(name string, data []byte) error {
+	tmpPath := filepath.Join(sp.MirrorDir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(sp.MirrorDir, name))
+}
+
+//fetch downloads an object into the mirror and returns the rule files written
+func (sp *S3RulesetProvider) fetch(key string) ([]string, error) {
+	buf := aws.NewWriteAtBuffer([]byte{})
+	downloader := s3manager.NewDownloaderWithClient(sp.S3SVC)
+	if _, err := downloader.Download(buf, &s3.GetObjectInput{Bucket: aws.String(sp.Bucket), Key: aws.String(key)}); err != nil {
+		return nil, err
+	}
+	name := sp.localName(key)
+	return []string{name}, sp.writeMirrorFile(name, buf.Bytes())
+}
+
+//removeMirrorFiles deletes the given files from the mirror, except those in keep
+func (sp *S3RulesetProvider) removeMirrorFiles(files []string, keep []string) {
+	kept := make(map[string]bool, len(keep))
+	for _, name := range keep {
+		kept[name] = true
+	}
+	for _, name := range files {
+		if !kept[name] {
+			os.Remove(filepath.Join(sp.MirrorDir, name))
+		}
+	}
+}
+
+//update mirrors the objects whose ETag changed and removes those deleted from the bucket, describing the change if any
+func (sp *S3RulesetProvider) update() (string, error) {
+	objects := make(map[string]string)
+	err := sp.S3SVC.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(sp.Bucket), Prefix: aws.String(sp.Prefix)},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, item := range page.Contents {
+				if isS3RuleObject(*item.Key) {
+					objects[*item.Key] = aws.StringValue(item.ETag)
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return "", err
+	}
+	changed, removed := 0, 0
+	defer func() {
+		if changed+removed > 0 {
+			sp.saveManifest()
+		}
+	}()
+	for key, etag := range objects {
+		entry, ok := sp.manifest[key]
+		if ok && entry.ETag == etag {
+			continue
+		}
+		files, err := sp.fetch(key)
+		if err != nil {
+			return "", err
+		}
+		sp.removeMirrorFiles(entry.Files, files)
+		sp.manifest[key] = s3MirrorEntry{ETag: etag, Files: files}
+		changed++
+		log.Debugf("Mirrored rules s3://%s/%s %s", sp.Bucket, key, etag)
+	}
+	for key, entry := range sp.manifest {
+		if _, ok := objects[key]; !ok {
+			sp.removeMirrorFiles(entry.Files, nil)
+			delete(sp.manifest, key)
+			removed++
+			log.Debugf("Removed rules s3://%s/%s", sp.Bucket, key)
+		}
+	}
+	if changed+removed == 0 {
+		return "", nil
+	}
+	log.Infof("Mirrored rules from s3://%s/%s, %d objects changed, %d removed", sp.Bucket, sp.Prefix, changed, removed)
+	return fmt.Sprintf("s3 %d changed %d removed", changed, removed), nil
+}
+
+//pruneMirror removes the files of the mirror that don't come from a mirrored object, ie left over from a lost manifest
+func (sp *S3RulesetProvider) pruneMirror() {
+	mirrored := make([]string, 0)
+	for _, entry := range sp.manifest {
+		mirrored = append(mirrored, entry.Files...)
+	}
+	files, err := ioutil.ReadDir(sp.MirrorDir)
+	if err != nil {
+		log.Errorf("Error listing rule mirror %s %v", sp.MirrorDir, err)
+		return
+	}
+	stale := make([]string, 0)
+	for _, file := range files {
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			stale = append(stale, file.Name())
+		}
+	}
+	sp.removeMirrorFiles(stale, mirrored)
+}
+
+//saveManifest writes the mirror manifest, hidden from the rule directory listing
+func (sp *S3RulesetProvider) saveManifest() {
+	raw, err := json.Marshal(sp.manifest)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(sp.MirrorDir, s3ManifestFile), raw, 0644)
+	}
+	if err != nil {
+		log.Errorf("Error saving S3 rule manifest %v", err)
+	}
+}
+
+//revision returns a hash over the keys and ETags of the mirrored objects
+func (sp *S3RulesetProvider) revision() string {
+	keys := make([]string, 0, len(sp.manifest))
+	etags := make(map[string]string, len(sp.manifest))
+	for key, entry := range sp.manifest {
+		keys = append(keys, key)
+		etags[key] = entry.ETag
+	}
+	sort.Strings(keys)
+	return "s3:" + combineHashes(keys, etags)
+}
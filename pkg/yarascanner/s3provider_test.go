@@ -0,0 +1,21 @@
+package yarascanner
+
+import (
+	"testing"
+)
+
+//Test object keys flatten into distinct mirror file names
+func TestS3LocalName(t *testing.T) {
+	sp := &S3RulesetProvider{Prefix: "rules/"}
+	names := make(map[string]string)
+	for _, key := range []string{"rules/a.yar", "rules/a/b_c.yar", "rules/a_b/c.yar", "rules/a_/b.yar", "rules/a/_b.yar", "rules/a/b/c.yar", "rules/a_b_c.yar"} {
+		name := sp.localName(key)
+		if previous, ok := names[name]; ok {
+			t.Fatalf("Expected distinct names, %s and %s both mirrored as %s", previous, key, name)
+		}
+		names[name] = key
+	}
+	if name := sp.localName("rules/a/b.yar.minisig"); name != sp.localName("rules/a/b.yar")+".minisig" {
+		t.Fatalf("Expected a signature mirrored next to its rule file, got %s", name)
+	}
+}
@@ -1,6 +1,8 @@
 package yarascanner
 
 import (
+	"bytes"
+	"context"
 	"github.com/fsnotify/fsnotify"
 	"github.com/hillu/go-yara"
 	"github.com/jinzhu/gorm"
@@ -9,11 +11,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	//sqlitedilact for gorm
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
-	"time"
 	"sync"
 	"fmt"
+	"time"
 )
 
 //Scanner type monitors a rule directory, a bin directory, and timely scans binaries and records the results in the configured DB
@@ -21,13 +24,32 @@ type Scanner struct {
 	RuleDir      string
 	BinDir       string
 	resultsDB    *gorm.DB
+	//RulesetProvider serves the rules, Provider runs it and may be a provider built on top of it, like a GitRulesetProvider
 	RulesetProvider *WatchedRulesetProvider
+	Provider        RulesetProvider
 	watcherBins  *fsnotify.Watcher
 	watcherRules *fsnotify.Watcher
-	resultsChan  chan BinaryMatches
 	started      bool
 	workerwaitgroup *sync.WaitGroup
+	//scanwaitgroup tracks the scanning workers, Close waits for them to hand back or finish the jobs they leased
+	scanwaitgroup *sync.WaitGroup
+	//scanContext is cancelled on Close to abort the scans in progress
+	scanContext context.Context
+	cancelScans context.CancelFunc
+	//ScanningChan takes binaries to scan from other sources, they are moved to the Queue as they come
 	ScanningChan chan fsnotify.Event
+	//Queue is the durable queue of the binaries to scan, pending scans resume after a restart
+	Queue *ScanQueue
+	//Rescans runs the periodic rescans of the binaries
+	Rescans *RescanScheduler
+	//Hunts runs the retro-hunts over the binaries
+	Hunts *HuntRunner
+	//Isolation runs the scans in child processes when set, those of the hunts, the profiler and the stager too, it must be set before Start
+	Isolation *ScanIsolation
+	//Profiler profiles the rules when set, it must be set before Start
+	Profiler *RuleProfiler
+	//Verdicts aggregates the results of each binary into its verdict
+	Verdicts VerdictPolicy
 }
 //NewScannerDBString returns a scanner, or error if construction fails 
 func NewScannerDBString(binDir,ruleDir,db string) (*Scanner, error) { 
@@ -41,11 +63,6 @@ func NewScannerDBString(binDir,ruleDir,db string) (*Scanner, error) {
 //NewScanner returns a new scanner, or an error if construction fails
 func NewScanner(binDir,ruleDir string, db * gorm.DB) (*Scanner, error) {
 	log.Debugf("NewScanner %s %s",ruleDir,binDir)
-	watcherBins, err := fsnotify.NewWatcher()
-	err = watcherBins.Add(binDir)
-	if err != nil {
-		return nil, err
-	}
 	watcherRules, err := fsnotify.NewWatcher()
 	err = watcherRules.Add(ruleDir)
 	if err != nil {
@@ -56,47 +73,147 @@ func NewScanner(binDir,ruleDir string, db * gorm.DB) (*Scanner, error) {
 		log.Debugf("Error watcher contstruction %v",err)
 		return nil, err
 	}
-	resultschan := make(chan BinaryMatches, 1000)
+	scanr, err := NewScannerWithProvider(binDir, wrp, db)
+	if err != nil {
+		return nil, err
+	}
+	scanr.watcherRules = watcherRules
+	return scanr, nil
+}
+
+//watchedProvider is implemented by WatchedRulesetProvider and the providers embedding one
+type watchedProvider interface {
+	watched() *WatchedRulesetProvider
+}
+
+//NewScannerWithProvider returns a new scanner using rules from provider, which must be built on a WatchedRulesetProvider
+func NewScannerWithProvider(binDir string, provider RulesetProvider, db *gorm.DB) (*Scanner, error) {
+	wp, ok := provider.(watchedProvider)
+	if !ok {
+		return nil, fmt.Errorf("ruleset provider %T is not built on a WatchedRulesetProvider", provider)
+	}
+	wrp := wp.watched()
+	watcherBins, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = watcherBins.Add(binDir)
+	if err != nil {
+		return nil, err
+	}
 	scanningChan := make(chan fsnotify.Event, 10000)
-	return &Scanner{ScanningChan : scanningChan,RulesetProvider: wrp,workerwaitgroup: &sync.WaitGroup{},RuleDir: ruleDir, BinDir: binDir, resultsDB: db, watcherRules: watcherRules, watcherBins: watcherBins, resultsChan: resultschan, started: false}, nil
+	//sqlite takes one writer at a time, transactions of the workers on connections of their own fail as the database is locked
+	if db.Dialect().GetName() == "sqlite3" {
+		db.DB().SetMaxOpenConns(1)
+	}
+	queue := NewScanQueue(db)
+	scanContext, cancelScans := context.WithCancel(context.Background())
+	return &Scanner{ScanningChan : scanningChan,Queue: queue,scanContext: scanContext,cancelScans: cancelScans,Rescans: NewRescanScheduler(db, queue),Hunts: NewHuntRunner(binDir, wrp, db),RulesetProvider: wrp,Provider: provider,workerwaitgroup: &sync.WaitGroup{},scanwaitgroup: &sync.WaitGroup{},RuleDir: wrp.RuleDir, BinDir: binDir, resultsDB: db, Verdicts: DefaultVerdictPolicy, watcherBins: watcherBins, started: false}, nil
 }
 
 //RulesetProvider is any source of yara rules providing a GetRules function
 type RulesetProvider interface {
 	LoadRules()	(error)
-	GetRules() (* yara.Rules, error)
+	GetRules() (* Ruleset, error)
 	Go(wg * sync.WaitGroup) 
 	Stop()
 }
 
-//BinaryRescanRuleWatcher Uses rule notifications to query the DB, and send a list of binary-hash-names to be scanned-again with the new ruleset (ie , all of the bins)
-func BinaryRescanRuleWatcher(bindb * gorm.DB, ruleChanged <-chan fsnotify.Event, tobeScanned chan<- fsnotify.Event, wg * sync.WaitGroup) {
+//BinaryRescanRuleWatcher Uses rule notifications to query the DB, and queue every binary to be scanned-again with the new ruleset,
+//behind the binaries newly ingested. Binaries are rescanned with only the rules changed when the new ruleset has a delta
+//against the version they were last queued for
+func BinaryRescanRuleWatcher(bindb * gorm.DB, ruleChanged <-chan fsnotify.Event, provider RulesetProvider, queue *ScanQueue, wg * sync.WaitGroup) {
 	wg.Add(1)
 	defer log.Debug("BinaryRescanRuleWatcher exiting...")
 	defer wg.Done()
+	queued := uint(0)
+	if ruleset, _ := provider.GetRules(); ruleset != nil {
+		queued = ruleset.Version
+	}
 	for range ruleChanged { 
-		bins := make([] models.Binary,0)
-		bindb.Find(bins)
-		for _, bin := range bins {
-			tobeScanned <- fsnotify.Event{Name: bin.Hash}
+		ruleset, _ := provider.GetRules()
+		if ruleset == nil || ruleset.Version == queued {
+			continue
+		}
+		delta := ruleset.Delta
+		if delta != nil && delta.Base != queued {
+			//a ruleset came in between, its changes aren't part of the delta
+			delta = nil
+		}
+		queued = ruleset.Version
+		if delta != nil && len(delta.Scope) == 0 {
+			log.Infof("No rules changed in ruleset %s, not rescanning", ruleset.Hash)
+			continue
+		}
+		hashes := make([]string, 0)
+		bindb.Model(&models.Binary{}).Pluck("DISTINCT hash", &hashes)
+		var err error
+		if delta != nil {
+			err = queue.EnqueueDelta(hashes, models.ScanClassRuleChange, ruleset.Version)
+		} else {
+			err = queue.EnqueueAll(hashes, models.ScanClassRuleChange)
+		}
+		if err != nil {
+			log.Errorf("Error queueing %d binaries for rescan %v", len(hashes), err)
 		}
 	}
 }
 
 //WatchedRulesetProvider is a RulesetProvider that updates the rules when they change
 type WatchedRulesetProvider struct { 
-	Compiler * yara.Compiler
 	IncomingRulesChan chan fsnotify.Event
 	OutgoingRulesChan chan fsnotify.Event
 	RuleDB * gorm.DB
 	sync.RWMutex
-	rules * yara.Rules
+	rules * Ruleset
 	RuleDir string
+	//CacheDir is where compiled rulesets are cached between restarts, caching is disabled when empty
+	CacheDir   string
+	cache      *RuleCache
+	//Revision returns the revision of the rules in RuleDir to record on ruleset versions, ie a git commit, it may be nil
+	Revision func() string
+	//Stager evaluates new rulesets against the stored binaries before they are promoted, they are put into use right away when nil
+	Stager     *Stager
+	//TrustedKeys when set requires every rule file to carry a detached signature by one of them, rules failing verification are refused
+	TrustedKeys []TrustedKey
+	//ExternalMetaKeys are the S3 user metadata keys exposed to rules as externals of their own, see DefaultExternals
+	ExternalMetaKeys []string
+	//ScanOptions are the flags and timeout of the rulesets built, a ScanOptionsFile in RuleDir overrides them
+	ScanOptions ScanOptions
+	//Scoring scores the rules indexed and the results recorded
+	Scoring ScoringPolicy
+	//DeltaRescans rescans the binaries with only the rules changed when a new ruleset is put into use
+	DeltaRescans bool
+	//MaxRulesetClones caps the clones of the ruleset the workers scanning in process hold at once, see WorkerScanner
+	MaxRulesetClones int
+	clones     *clonePool
+	clonesOnce sync.Once
+	reloadLock  sync.Mutex
+	stopped    bool
+}
+
+func (wrp *WatchedRulesetProvider) watched() *WatchedRulesetProvider {
+	return wrp
 }
 
-//Stop closes output channel
+//clonePool returns the pool of clones of the provider's ruleset, sized by MaxRulesetClones when first used
+func (wrp *WatchedRulesetProvider) clonePool() *clonePool {
+	wrp.clonesOnce.Do(func() {
+		wrp.clones = newClonePool(wrp.MaxRulesetClones)
+	})
+	return wrp.clones
+}
+
+//Stop closes output channel and destroys the clones of the ruleset handed back to it
 func (wrp * WatchedRulesetProvider) Stop() { 
+	if wrp.Stager != nil {
+		wrp.Stager.Stop()
+	}
+	wrp.reloadLock.Lock()
+	defer wrp.reloadLock.Unlock()
+	wrp.stopped = true
 	close(wrp.OutgoingRulesChan)
+	wrp.clonePool().close()
 }
 
 //NewWatchedRulesetProvider factory method constructing a working RulesetProvider
@@ -110,14 +227,8 @@ func NewWatchedRulesetProvider(ruleDir string, ruleDb * gorm.DB, rulesUpdateChan
 	if ruleDb == nil { 
 		return nil, fmt.Errorf("rules db may not be nil")
 	}
-	compiler,err := yara.NewCompiler()
-	if err != nil { 
-		
-		return nil , fmt.Errorf("YC error %v ",err)
-	}
-	wrp := WatchedRulesetProvider{Compiler: compiler, RuleDir: ruleDir, RuleDB: ruleDb , IncomingRulesChan: rulesUpdateChan, OutgoingRulesChan: make(chan fsnotify.Event,1000)}
-	//err = wrp.LoadRules()
-	return &wrp,err
+	wrp := WatchedRulesetProvider{RuleDir: ruleDir, RuleDB: ruleDb , ScanOptions: DefaultScanOptions, Scoring: DefaultScoringPolicy, DeltaRescans: true, MaxRulesetClones: runtime.NumCPU(), IncomingRulesChan: rulesUpdateChan, OutgoingRulesChan: make(chan fsnotify.Event,1000)}
+	return &wrp, nil
 }
 
 //Go -- run in a goroutine and update rules 
@@ -126,69 +237,260 @@ func (wrp * WatchedRulesetProvider) Go(wg * sync.WaitGroup) {
 	defer log.Debug("WatchedRuleSetProvider -> Go exiting")
 	defer wg.Done()
 	for ruleEvent := range wrp.IncomingRulesChan { 
-		log.Debugf("WRP providing outgoing rule event")
-		wrp.OutgoingRulesChan <- ruleEvent
-		wrp.Lock()
-		defer wrp.Unlock()
-		err := wrp.loadRule(wrp.RuleDir,ruleEvent.Name)
-		if err != nil {
-			log.Fatalf("Error loading rule %s %s", ruleEvent.Name, err)
+		//rule drops arrive as bursts of events, rebuild the ruleset once for all of them
+	drain:
+		for {
+			select {
+			case next, ok := <-wrp.IncomingRulesChan:
+				if !ok {
+					break drain
+				}
+				ruleEvent = next
+			default:
+				break drain
+			}
 		}
-		rules, err:= wrp.Compiler.GetRules()
-		if err != nil { 
-			log.Fatalf("Error loading rule %s %v", ruleEvent.Name, err)
-		} else { 
-			wrp.rules = rules
+		changed, err := wrp.reload(ruleEvent.String())
+		if err != nil {
+			log.Errorf("Error reloading rules after %s, keeping the current ruleset - %v", ruleEvent.Name, err)
+		} else if changed {
+			log.Debugf("WRP providing outgoing rule event")
+			wrp.OutgoingRulesChan <- ruleEvent
 		}
 	}
 }
 
 //GetRules returns the current rules from the underlying provider
-func (wrp * WatchedRulesetProvider) GetRules() (rules * yara.Rules, err error) {
-	wrp.Lock()
-	defer wrp.Unlock()
+func (wrp * WatchedRulesetProvider) GetRules() (rules * Ruleset, err error) {
+	wrp.RLock()
+	defer wrp.RUnlock()
 	return wrp.rules, nil
 }
 
-func (wrp * WatchedRulesetProvider ) loadRule(dir,fileName string) error { 
+func (wrp * WatchedRulesetProvider ) loadRule(compiler *yara.Compiler, dir,fileName string, verified []byte) error { 
+	if verified != nil {
+		//compile the contents that were verified rather than reopening the file
+		return compiler.AddString(string(verified), fileName)
+	}
 	file, err := os.Open(filepath.Join(dir,fileName))
 	if err != nil  {
 		return err
 	}
-	err = wrp.Compiler.AddFile(file, fileName)
-	if err != nil { 
-		return err
+	defer file.Close()
+	return compiler.AddFile(file, fileName)
+}
+
+//ruleCache returns the cache for compiled rulesets, or nil when caching is disabled
+func (wrp *WatchedRulesetProvider) ruleCache() *RuleCache {
+	if wrp.cache == nil && len(wrp.CacheDir) > 0 {
+		cache, err := NewRuleCache(wrp.CacheDir)
+		if err != nil {
+			log.Errorf("Error creating rule cache %s, caching disabled - %v", wrp.CacheDir, err)
+			wrp.CacheDir = ""
+			return nil
+		}
+		wrp.cache = cache
 	}
-	wrp.RuleDB.Create(&models.Rule{Name:fileName})
-	return nil
+	return wrp.cache
 }
 
-//LoadRules load a directory of yara rules and generates a ruleset for yara
-func (wrp * WatchedRulesetProvider) LoadRules() error {
-	wrp.Lock()
-	defer wrp.Unlock()
-	files, err := ioutil.ReadDir(wrp.RuleDir)
+//compileSources compiles the rule sources in RuleDir, or their verified contents when given, reusing a cached ruleset when the sources are unchanged
+func (wrp *WatchedRulesetProvider) compileSources(sources []string, sourceHash string, verified map[string][]byte) (*yara.Rules, error) {
+	cache := wrp.ruleCache()
+	cacheKey := wrp.cacheKey(sourceHash)
+	if cache != nil {
+		rules, err := cache.Load(cacheKey)
+		if err != nil {
+			log.Errorf("Error loading cached ruleset %s, recompiling - %v", sourceHash, err)
+		} else if rules != nil {
+			log.Infof("Loaded cached ruleset %s", sourceHash)
+			return rules, nil
+		}
+	}
+	compiler, err := wrp.newCompiler()
+	if err != nil {
+		return nil, err
+	}
+	defer compiler.Destroy()
+	for _, name := range sources {
+		if err := wrp.loadRule(compiler, wrp.RuleDir, name, verified[name]); err != nil {
+			return nil, fmt.Errorf("rule %s - %v", name, err)
+		}
+	}
+	rules, err := compiler.GetRules()
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Compiled %d rule files", len(sources))
+	if cache != nil {
+		if err := cache.Save(cacheKey, rules); err != nil {
+			log.Errorf("Error caching ruleset %s - %v", sourceHash, err)
+		}
+	}
+	return rules, nil
+}
+
+//buildRuleset builds a ruleset from the rule sources, precompiled .yarc files and rule bundles in RuleDir.
+//A bundle is a single unit of the ruleset, so a new version of it replaces all of its rules at once
+func (wrp *WatchedRulesetProvider) buildRuleset() (*Ruleset, error) {
+	sources, compiled, bundles, err := listRuleFiles(wrp.RuleDir)
+	if err != nil {
+		return nil, err
+	}
+	all := append(append(append([]string{}, sources...), compiled...), bundles...)
+	if hasScanOptionsFile(wrp.RuleDir) {
+		all = append(all, ScanOptionsFile)
+	}
+	hashes, err := hashRuleFiles(wrp.RuleDir, all)
+	if err != nil {
+		return nil, err
+	}
+	var verified map[string][]byte
+	if len(wrp.TrustedKeys) > 0 {
+		if verified, err = wrp.verifyRuleFiles(all, hashes); err != nil {
+			return nil, err
+		}
+	}
+	overrides, err := loadRuleStateOverrides(wrp.RuleDB)
 	if err != nil {
-		log.Fatalf("Error loadind rule %v", err)
+		return nil, err
+	}
+	ruleset := &Ruleset{Hash: hashRuleStates(combineHashes(all, hashes), overrides), Files: hashes}
+	if wrp.Revision != nil {
+		ruleset.Revision = wrp.Revision()
+	}
+	if ruleset.ScanOptions, err = wrp.scanOptions(verified[ScanOptionsFile]); err != nil {
+		return nil, err
 	}
-	for _, file := range files {
-		err := wrp.loadRule(wrp.RuleDir,file.Name())
+	if len(sources) > 0 {
+		rules, err := wrp.compileSources(sources, combineHashes(sources, hashes), verified)
 		if err != nil {
-			log.Errorf("Errro loading rule %s %v",file.Name(),err)
-			return err 
+			return nil, err
 		}
+		ruleset.Rules = append(ruleset.Rules, rules)
+		ruleset.Origins = append(ruleset.Origins, "")
 	}
-	newrules, err := wrp.Compiler.GetRules()
-	if err == nil {
-		wrp.rules = newrules
-		return nil
-	} else {
-		return err
+	for _, name := range compiled {
+		var rules *yara.Rules
+		if data, ok := verified[name]; ok {
+			rules, err = yara.ReadRules(bytes.NewReader(data))
+		} else {
+			rules, err = yara.LoadRules(filepath.Join(wrp.RuleDir, name))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("compiled rules %s - %v", name, err)
+		}
+		ruleset.Rules = append(ruleset.Rules, rules)
+		ruleset.Origins = append(ruleset.Origins, name)
+	}
+	//each bundle is cached on its own, keep as many versions of each as of the sources
+	if cache := wrp.ruleCache(); cache != nil && cache.MaxEntries < DefaultRuleCacheEntries*(len(bundles)+1) {
+		cache.MaxEntries = DefaultRuleCacheEntries * (len(bundles) + 1)
+	}
+	for _, name := range bundles {
+		rules, err := wrp.compileBundle(name, combineHashes([]string{name}, hashes), verified[name])
+		if err != nil {
+			return nil, fmt.Errorf("rule bundle %s - %v", name, err)
+		}
+		ruleset.Rules = append(ruleset.Rules, rules)
+		ruleset.Origins = append(ruleset.Origins, name)
+	}
+	wrp.fingerprintRules(ruleset, verified)
+	if err := applyRuleStates(ruleset, overrides); err != nil {
+		return nil, err
+	}
+	return ruleset, nil
+}
+
+//reload rebuilds the ruleset and puts it into use, or stages it when a Stager is configured, returning whether the active rules changed.
+//trigger is recorded on the new ruleset version
+func (wrp *WatchedRulesetProvider) reload(trigger string) (bool, error) {
+	wrp.reloadLock.Lock()
+	defer wrp.reloadLock.Unlock()
+	ruleset, err := wrp.buildRuleset()
+	if err != nil {
+		return false, err
+	}
+	current, _ := wrp.GetRules()
+	if current != nil && current.Hash == ruleset.Hash {
+		return false, nil
+	}
+	if wrp.Stager != nil && current != nil {
+		if candidate := wrp.Stager.Candidate(); candidate != nil && candidate.Hash == ruleset.Hash {
+			return false, nil
+		}
+		if err := RecordRulesetVersion(wrp.RuleDB, ruleset, trigger, models.RulesetVersionCandidate); err != nil {
+			return false, err
+		}
+		return false, wrp.Stager.Stage(current, ruleset, trigger)
+	}
+	if err := RecordRulesetVersion(wrp.RuleDB, ruleset, trigger, models.RulesetVersionActive); err != nil {
+		return false, err
+	}
+	wrp.activate(ruleset)
+	return true, nil
+}
+
+//activate puts a recorded ruleset into use and indexes its rules
+func (wrp *WatchedRulesetProvider) activate(ruleset *Ruleset) {
+	if ruleset.Shadow != nil {
+		ruleset.Shadow.Version = ruleset.Version
+	}
+	if wrp.DeltaRescans {
+		previous, _ := wrp.GetRules()
+		delta, err := wrp.buildDelta(previous, ruleset)
+		if err != nil {
+			log.Errorf("Error compiling the delta of ruleset %s, rescanning with the whole ruleset - %v", ruleset.Hash, err)
+		} else if delta != nil {
+			delta.Version = ruleset.Version
+			if delta.Shadow != nil {
+				delta.Shadow.Version = ruleset.Version
+			}
+			ruleset.Delta = delta
+		}
+	}
+	if err := ActivateRulesetVersion(wrp.RuleDB, ruleset.Version); err != nil {
+		log.Errorf("Error activating ruleset version %d - %v", ruleset.Version, err)
+	}
+	wrp.Lock()
+	wrp.rules = ruleset
+	wrp.Unlock()
+	log.Infof("Loaded ruleset %s", ruleset.Hash)
+	if err := IndexRules(wrp.RuleDB, ruleset, wrp.Scoring); err != nil {
+		log.Errorf("Error indexing ruleset %s - %v", ruleset.Hash, err)
+	}
+}
+
+//notify tells the rule watchers the active rules changed, unless the provider was stopped and closed its channel
+func (wrp *WatchedRulesetProvider) notify(event fsnotify.Event) {
+	wrp.reloadLock.Lock()
+	defer wrp.reloadLock.Unlock()
+	if wrp.stopped {
+		return
+	}
+	wrp.OutgoingRulesChan <- event
+}
+
+//promote puts a staged ruleset into use and notifies the rule watchers so the binaries get rescanned
+func (wrp *WatchedRulesetProvider) promote(ruleset *Ruleset, trigger string) {
+	wrp.reloadLock.Lock()
+	defer wrp.reloadLock.Unlock()
+	if wrp.stopped {
+		log.Infof("Not promoting ruleset %s, provider stopped", ruleset.Hash)
+		return
 	}
+	wrp.activate(ruleset)
+	wrp.OutgoingRulesChan <- fsnotify.Event{Name: trigger}
+}
+
+//LoadRules load a directory of yara rules and generates a ruleset for yara
+func (wrp * WatchedRulesetProvider) LoadRules() error {
+	_, err := wrp.reload("startup")
+	return err
 }
 
 //GetRules returns the rules from the underlying provider, or an error if that fails
-func (scanr * Scanner) GetRules() (*yara.Rules, error) { 
+func (scanr * Scanner) GetRules() (*Ruleset, error) { 
 	return scanr.RulesetProvider.GetRules()
 }
 
@@ -204,24 +506,54 @@ func PipeWorker(dest chan<- fsnotify.Event, source <-chan fsnotify.Event, wg * s
 	}
 }
 
+//QueueWorker moves the binaries sent on source to the durable scan queue as newly ingested, removed or renamed files are skipped
+func QueueWorker(queue *ScanQueue, source <-chan fsnotify.Event, wg * sync.WaitGroup) {
+	wg.Add(1)
+	defer log.Debugf("Queueworker exiting...")
+	defer wg.Done()
+	for msg := range source {
+		if msg.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+			continue
+		}
+		if err := queue.Enqueue(filepath.Base(msg.Name), models.ScanClassIngest); err != nil {
+			log.Errorf("Error queueing %s for scanning %v", msg.Name, err)
+		}
+	}
+}
+
 
 //Start startup routine launches workers
 func (scanr *Scanner) Start(workerNum int) {
 	scanr.LoadBins()
-	err := scanr.RulesetProvider.LoadRules()
+	//hunts, profiling and staging scan in child processes of their own too
+	scanr.Hunts.Isolation = scanr.Isolation
+	if scanr.Profiler != nil {
+		scanr.Profiler.Isolation = scanr.Isolation
+	}
+	if scanr.RulesetProvider.Stager != nil {
+		scanr.RulesetProvider.Stager.Isolation = scanr.Isolation
+	}
+	err := scanr.Provider.LoadRules()
 	if err != nil { 
 		log.Fatalf("Error starting scanner - %v",err)
 	}
-	go BinaryRescanRuleWatcher(scanr.resultsDB,scanr.RulesetProvider.OutgoingRulesChan, scanr.ScanningChan, scanr.workerwaitgroup)
+	go BinaryRescanRuleWatcher(scanr.resultsDB,scanr.RulesetProvider.OutgoingRulesChan, scanr.Provider, scanr.Queue, scanr.workerwaitgroup)
 	if !scanr.started {
+		hostname, _ := os.Hostname()
 		for i := 0; i < workerNum; i++ {
-			go ScanningWorker(scanr.BinDir, scanr.ScanningChan, scanr.resultsChan, scanr.RulesetProvider,scanr.workerwaitgroup)
+			owner := fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), i)
+			go ScanningWorker(scanr.scanContext, scanr.BinDir, scanr.Queue, owner, scanr.RulesetProvider, scanr.resultsDB, scanr.Isolation, scanr.Verdicts, scanr.scanwaitgroup)
 		}
-		//Pipeworker sends fsnotify events from the watcher to the 'ScanningChan' that yara-scanning workers will monitor
-		//This allows other sources of bin-events, like when a binary needs to be rescanned
+		//Pipeworker sends fsnotify events from the watcher to the 'ScanningChan', which the Queueworker moves to the durable queue
+		//the yara-scanning workers lease from. This allows other sources of bin-events, like when a binary needs to be rescanned
 		go PipeWorker(scanr.ScanningChan,scanr.watcherBins.Events, scanr.workerwaitgroup)
-		go ResultDBWorker(scanr.resultsDB, scanr.resultsChan, scanr.workerwaitgroup)
-		go scanr.RulesetProvider.Go(scanr.workerwaitgroup)
+		go QueueWorker(scanr.Queue, scanr.ScanningChan, scanr.workerwaitgroup)
+		go scanr.Provider.Go(scanr.workerwaitgroup)
+		go scanr.Rescans.Go(scanr.workerwaitgroup)
+		go scanr.Hunts.Go(scanr.workerwaitgroup)
+		if scanr.Profiler != nil {
+			go scanr.Profiler.Go(scanr.workerwaitgroup)
+		}
 		scanr.started = true
 	} else {
 		log.Debugf("Scanner already started...")
@@ -231,30 +563,54 @@ func (scanr *Scanner) Start(workerNum int) {
 //Close requisite close
 func (scanr *Scanner) Close() {
 
-	close(scanr.resultsChan)
+	//the scans in progress are aborted, unfinished jobs stay queued for the next run
+	scanr.Rescans.Stop()
+	scanr.Hunts.Stop()
+	if scanr.Profiler != nil {
+		scanr.Profiler.Stop()
+	}
+	scanr.Queue.Close()
+	scanr.cancelScans()
+	scanr.scanwaitgroup.Wait()
 	close(scanr.ScanningChan)
 	//scanr.resultsDB.Close()
 
-	scanr.watcherRules.Close()
+	if scanr.watcherRules != nil {
+		scanr.watcherRules.Close()
+	}
 	scanr.watcherBins.Close()
 
-	scanr.RulesetProvider.Stop() 
+	scanr.Provider.Stop()
 
 	scanr.workerwaitgroup.Wait()
 
 	log.Debugf("Scanner - all workers done -")
 }
 
-//LoadBins loads bins from disk into the db
+//LoadBins loads bins from disk into the db and queues them for scanning, the binaries never scanned successfully
+//as newly ingested and the others as rescans for rules that may have changed since
 func (scanr * Scanner) LoadBins() {
 	bins, err := ioutil.ReadDir(scanr.BinDir)
 	if err != nil {
 		log.Fatalf("Error loading binary dir %s %v", scanr.BinDir, err)
 	}
+	fresh := make([]string, 0)
+	rescans := make([]string, 0, len(bins))
 	for _, bin := range bins {
 		log.Debugf("Loaded bin - %s",bin.Name())
-		scanr.resultsDB.Create(&models.Binary{Hash: bin.Name()})
-		scanr.ScanningChan <- fsnotify.Event{Name: bin.Name()}
+		record := models.Binary{}
+		scanr.resultsDB.Where(models.Binary{Hash: bin.Name()}).FirstOrCreate(&record)
+		if record.LastScanSucceededAt == nil {
+			fresh = append(fresh, bin.Name())
+		} else {
+			rescans = append(rescans, bin.Name())
+		}
+	}
+	if err := scanr.Queue.EnqueueAll(fresh, models.ScanClassIngest); err != nil {
+		log.Fatalf("Error queueing binaries of %s %v", scanr.BinDir, err)
+	}
+	if err := scanr.Queue.EnqueueAll(rescans, models.ScanClassRuleChange); err != nil {
+		log.Fatalf("Error queueing binaries of %s %v", scanr.BinDir, err)
 	}
 }
 
@@ -262,54 +618,115 @@ func (scanr * Scanner) LoadBins() {
 type BinaryMatches struct {
 	Matches  []yara.MatchRule
 	FileHash string
+	RulesetVersion uint
+	//Shadow is set for matches of the shadow ruleset
+	Shadow bool
+	//Scope is set for matches of a delta ruleset, only the results of the rules in it are reconciled
+	Scope map[string]bool
 }
 
-//ScanningWorker go routine worker that knows how to scan files by name using a configured ruleset
-func ScanningWorker(binDir string, toScan <-chan fsnotify.Event, scanResults chan<- BinaryMatches, rulesetProvider * WatchedRulesetProvider, wg * sync.WaitGroup) {
+//ScanningWorker go routine worker that knows how to scan files by name using a configured ruleset, leasing them from queue as owner.
+//The externals of each binary are looked up in bindb and set on the clone of the ruleset the worker takes for the job, every scan is recorded as a ScanRun.
+//The results of the scans are reconciled and the verdict of the binary updated under the verdicts policy before its job is completed,
+//so a job whose results didn't make it to the DB stays queued and is retried.
+//Jobs for the delta of the ruleset in use scan with the delta, the whole ruleset is used once another ruleset replaced it.
+//Failed scans are retried by the queue, except for binaries no longer on disk. With an isolation the scans run in the worker's
+//child process and binaries crashing it are quarantined, quarantined binaries are never scanned.
+//When the worker can't get its rules the job is handed back to the queue and the worker backs off for the queue's RetryBackoff.
+//Once ctx is done the scan in progress is aborted and its job handed back to the queue
+func ScanningWorker(ctx context.Context, binDir string, queue *ScanQueue, owner string, rulesetProvider * WatchedRulesetProvider, bindb * gorm.DB, isolation *ScanIsolation, verdicts VerdictPolicy, wg * sync.WaitGroup) {
 	wg.Add(1)
 	defer log.Debugf("scanning worker exiting")
 	defer wg.Done()
-	for binFileEvent := range toScan {
-		log.Debugf("Scanning worker going to scan %s", binFileEvent.Name)
-		ruleset,err := rulesetProvider.GetRules()
-		if err != nil {
-			log.Fatalf("Error scanning - %v",err)
+	scanner := NewWorkerScanner(rulesetProvider, isolation)
+	defer scanner.Close()
+	for job := queue.Next(owner); job != nil; job = queue.Next(owner) {
+		log.Debugf("Scanning worker going to scan %s", job.BinaryHash)
+		fileHash := job.BinaryHash
+		if binaryQuarantined(bindb, fileHash) {
+			log.Warnf("Not scanning quarantined binary %s", fileHash)
+			queue.Fail(job, fmt.Errorf("%s is quarantined", fileHash), false)
+			continue
 		}
-		if ruleset == nil { 
-			log.Fatalf("Got no rules from provider")
+		ruleset, err := scanner.Ruleset(ctx)
+		if err == context.Canceled {
+			queue.Release(job)
+			return
 		}
-		matches, err := ruleset.ScanFile(filepath.Join(binDir, binFileEvent.Name), yara.ScanFlagsFastMode, 5*time.Second)
 		if err != nil {
-			log.Debugf("Error scanning %s %v", binFileEvent.Name, err)
+			//the job isn't at fault, it is handed back and the worker waits out RetryBackoff before leasing again
+			log.Errorf("Error getting the rules to scan %s with, handing it back - %v", job.BinaryHash, err)
+			queue.Release(job)
+			select {
+			case <-ctx.Done():
+				return
+			case <-queue.done:
+				return
+			case <-time.After(queue.RetryBackoff):
+			}
+			continue
+		}
+		scanWith, kind := ruleset, "full"
+		if job.DeltaVersion != 0 && job.DeltaVersion == ruleset.Version && ruleset.Delta != nil {
+			scanWith, kind = ruleset.Delta, "delta"
+		}
+		externals := binaryExternals(bindb, fileHash, rulesetProvider.ExternalMetaKeys)
+		matches, err := scanRecorded(bindb, scanWith, filepath.Join(binDir, fileHash), fileHash, false, scanner.Scanner(ctx, scanWith, kind, externals))
+		scans := make([]BinaryMatches, 0, 2)
+		if err == nil {
+			log.Infof("Scanned %s succesfully...%d results", fileHash, len(matches))
+			scans = append(scans, BinaryMatches{Matches: matches, FileHash: fileHash, RulesetVersion: scanWith.Version, Scope: scanWith.Scope})
+		}
+		if scanWith.Shadow != nil && err == nil {
+			shadowMatches, shadowErr := scanRecorded(bindb, scanWith.Shadow, filepath.Join(binDir, fileHash), fileHash, true, scanner.Scanner(ctx, scanWith.Shadow, kind+"-shadow", externals))
+			if _, crashed := shadowErr.(*ScanCrashError); crashed {
+				isolation.Quarantine(bindb, binDir, fileHash, shadowErr)
+			} else if shadowErr == context.Canceled {
+				//the binary is scanned again, with the shadow ruleset too
+				err = shadowErr
+			} else if shadowErr == nil {
+				scans = append(scans, BinaryMatches{Matches: shadowMatches, FileHash: fileHash, RulesetVersion: scanWith.Version, Shadow: true, Scope: scanWith.Scope})
+			} else {
+				//the job is failed for a retry, so the shadow results get reconciled by a later scan
+				err = shadowErr
+			}
+		} else if err == nil {
+			//without shadow rules to scan with, the shadow results are closed all the same, those of the rules in scope for a delta,
+			//ie moved to production, and all of them for a full scan
+			scans = append(scans, BinaryMatches{FileHash: fileHash, RulesetVersion: scanWith.Version, Shadow: true, Scope: scanWith.Scope})
+		}
+		if err == nil {
+			err = recordResults(bindb, scans, rulesetProvider.Scoring, verdicts)
+		}
+		if _, crashed := err.(*ScanCrashError); crashed {
+			isolation.Quarantine(bindb, binDir, fileHash, err)
+			queue.Fail(job, err, false)
+		} else if err == context.Canceled {
+			log.Debugf("Scan of %s cancelled, handing it back to the queue", fileHash)
+			queue.Release(job)
+		} else if err != nil {
+			queue.Fail(job, err, !os.IsNotExist(err))
 		} else {
-			log.Infof("Scanned %s succesfully...%d results", binFileEvent.Name, len(matches))
-			scanResults <- BinaryMatches{Matches: matches, FileHash: filepath.Base(binFileEvent.Name)}
+			queue.Complete(job)
 		}
+		scanner.Release()
 	}
 }
 
-//ResultDBWorker enters Results into the DB
-func ResultDBWorker(db *gorm.DB, scanResults <-chan BinaryMatches, wg *sync.WaitGroup) {
-	/*type MatchRule struct {
-		Rule      string
-		Namespace string
-		Tags      []string
-		Meta      map[string]interface{}
-		Strings   []MatchString
-	}*/
-	wg.Add(1)
-	defer log.Debugf("DB Worker exiting")
-	defer wg.Done()
-
-	for matches := range scanResults {
-		log.Debugf("Results worker procesing result set %v",matches)
-		for _, match := range matches.Matches {
-			log.Debugf("Match is : %s %s %d %s ",matches.FileHash,match.Rule,int(match.Meta["score"].(int32)), match.Namespace)
-			intscore := int(match.Meta["score"].(int32))
-			//db.Create(&models.Result{Score: intscore, BinaryHash: matches.FileHash})
-			db.Create(&models.Result{BinaryHash: matches.FileHash, RuleName: match.Rule, Score: intscore, Namespace: match.Namespace})
+//recordResults reconciles the Results of a binary in the DB with the matches of its latest scans, scored by the scoring policy,
+//and updates the verdict of the binary from its open production results
+func recordResults(db *gorm.DB, scans []BinaryMatches, scoring ScoringPolicy, verdicts VerdictPolicy) error {
+	for _, matches := range scans {
+		results, err := ReconcileResults(db, matches, scoring)
+		if err != nil {
+			return fmt.Errorf("recording the results of %s - %v", matches.FileHash, err)
 		}
-		log.Debugf("Results worker done processing results for ... %s", matches.FileHash)
+		if !matches.Shadow {
+			if err := RecordVerdict(db, matches.FileHash, matches.RulesetVersion, results, verdicts); err != nil {
+				return fmt.Errorf("recording the verdict of %s - %v", matches.FileHash, err)
+			}
+		}
+		log.Debugf("Recorded %d results of %s", len(results), matches.FileHash)
 	}
- 
+	return nil
 }
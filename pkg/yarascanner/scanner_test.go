@@ -8,6 +8,7 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/zacharyestep/s3yarascanner/pkg/models"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -23,7 +24,7 @@ func TestScanner(t *testing.T) {
 		t.Fatalf("Error opening db for tests ... %s %v","test/results.db",err)
 	}
 
-	gdb.AutoMigrate(&models.Binary{},&models.Rule{},&models.Result{})
+	models.AutoMigrate(gdb)
 
 	scanner, err := NewScanner("test/bins","test/rules",gdb)
 	if err != nil { 
@@ -44,4 +45,83 @@ func TestScanner(t *testing.T) {
 
 	scanner.Close()
 	gdb.Close()
-}
\ No newline at end of file
+}
+
+//Test a scan job is only completed once its results are recorded, a job whose results can't be recorded stays queued
+func TestScanningWorkerRecordsBeforeCompleting(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "worker")
+	defer os.RemoveAll(dir)
+	ruleDir, binDir := filepath.Join(dir, "rules"), filepath.Join(dir, "bins")
+	os.Mkdir(ruleDir, 0755)
+	os.Mkdir(binDir, 0755)
+	writeTestFiles(t, ruleDir, map[string]string{"a.yar": `rule found { strings: $a = "payload" condition: $a }`})
+	writeTestFiles(t, binDir, map[string]string{"bin": "a payload"})
+	wrp, _ := NewWatchedRulesetProvider(ruleDir, gdb, nil)
+	if err := wrp.LoadRules(); err != nil {
+		t.Fatalf("Error loading rules %v", err)
+	}
+	queue := NewScanQueue(gdb)
+	queue.RetryBackoff = time.Hour
+	queue.Enqueue("bin", models.ScanClassIngest)
+
+	gdb.DropTable(&models.Result{})
+	job := models.ScanJob{}
+	runScanningWorker(t, queue, wrp, binDir, func() bool {
+		return !gdb.Where("status = ? AND last_error <> ''", models.ScanJobPending).First(&job).RecordNotFound()
+	})
+	if job.BinaryHash != "bin" || job.Attempts != 1 {
+		t.Fatalf("Expected the job kept for a retry after its results failed to record, got %+v", job)
+	}
+
+	gdb.AutoMigrate(&models.Result{})
+	gdb.Model(&job).Update("available_at", time.Now())
+	runScanningWorker(t, NewScanQueue(gdb), wrp, binDir, func() bool {
+		return queue.Depth(models.ScanJobPending)+queue.Depth(models.ScanJobLeased) == 0
+	})
+	results := make([]models.Result, 0)
+	gdb.Find(&results)
+	if len(results) != 1 || results[0].RuleName != "found" {
+		t.Fatalf("Expected the result recorded by the retry, got %+v", results)
+	}
+	if verdict := (models.Verdict{}); gdb.Where("binary_hash = ?", "bin").First(&verdict).RecordNotFound() {
+		t.Fatalf("Expected the verdict recorded before the job completed")
+	}
+}
+
+//Test a worker without rules to scan with hands its job back and backs off rather than exiting, scanning it once it has rules
+func TestScanningWorkerWithoutRules(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "worker")
+	defer os.RemoveAll(dir)
+	ruleDir, binDir := filepath.Join(dir, "rules"), filepath.Join(dir, "bins")
+	os.Mkdir(ruleDir, 0755)
+	os.Mkdir(binDir, 0755)
+	writeTestFiles(t, ruleDir, map[string]string{"a.yar": `rule found { strings: $a = "payload" condition: $a }`})
+	writeTestFiles(t, binDir, map[string]string{"bin": "a payload"})
+	wrp, _ := NewWatchedRulesetProvider(ruleDir, gdb, nil)
+	queue := NewScanQueue(gdb)
+	queue.RetryBackoff = 20 * time.Millisecond
+	queue.Enqueue("bin", models.ScanClassIngest)
+
+	loadAt, loaded := time.Now().Add(200*time.Millisecond), false
+	runScanningWorker(t, queue, wrp, binDir, func() bool {
+		if !loaded && time.Now().After(loadAt) {
+			job := models.ScanJob{}
+			if gdb.First(&job); job.Status == models.ScanJobFailed || job.Attempts > 1 || job.LastError != "" {
+				t.Fatalf("Expected the job handed back without an attempt counted while there are no rules, got %+v", job)
+			}
+			if err := wrp.LoadRules(); err != nil {
+				t.Fatalf("Error loading rules %v", err)
+			}
+			loaded = true
+		}
+		return loaded && queue.Depth(models.ScanJobPending)+queue.Depth(models.ScanJobLeased) == 0
+	})
+	results := make([]models.Result, 0)
+	if gdb.Find(&results); len(results) != 1 || results[0].RuleName != "found" {
+		t.Fatalf("Expected the binary scanned once the rules were loaded, got %+v", results)
+	}
+}
@@ -0,0 +1,100 @@
+package yarascanner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/hillu/go-yara"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//ScanOptionsFile in a rule directory overrides the provider's ScanOptions for the rulesets built from it
+const ScanOptionsFile = ".scanoptions.json"
+
+//ScanOptions control how the binaries are scanned with a ruleset
+type ScanOptions struct {
+	//Flags are passed to yara, ie yara.ScanFlagsFastMode which stops at the first match of each string
+	Flags   yara.ScanFlags
+	Timeout time.Duration
+	//FullRescanOnMatch rescans the compiled units matching in fast mode without it, so every string match gets recorded
+	FullRescanOnMatch bool
+	//MaxMatches stops a scan once that many rules matched, 0 scans for every rule
+	MaxMatches int
+}
+
+//DefaultScanOptions scan in fast mode with a 5 second timeout
+var DefaultScanOptions = ScanOptions{Flags: yara.ScanFlagsFastMode, Timeout: 5 * time.Second}
+
+//scanOptionsJSON is the format of ScanOptionsFile, fields left out keep the provider's value
+type scanOptionsJSON struct {
+	FastMode          *bool   `json:"fast_mode"`
+	Timeout           *string `json:"timeout"`
+	FullRescanOnMatch *bool   `json:"full_rescan_on_match"`
+	MaxMatches        *int    `json:"max_matches"`
+}
+
+//ParseScanOptions applies the options of a ScanOptionsFile to base, unknown fields are refused so a misspelled option isn't ignored
+func ParseScanOptions(data []byte, base ScanOptions) (ScanOptions, error) {
+	raw := scanOptionsJSON{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&raw); err != nil {
+		return base, err
+	}
+	options := base
+	if raw.FastMode != nil {
+		options.Flags &^= yara.ScanFlagsFastMode
+		if *raw.FastMode {
+			options.Flags |= yara.ScanFlagsFastMode
+		}
+	}
+	if raw.Timeout != nil {
+		timeout, err := time.ParseDuration(*raw.Timeout)
+		if err != nil {
+			return base, err
+		}
+		if timeout <= 0 {
+			return base, fmt.Errorf("timeout must be positive")
+		}
+		options.Timeout = timeout
+	}
+	if raw.FullRescanOnMatch != nil {
+		options.FullRescanOnMatch = *raw.FullRescanOnMatch
+	}
+	if raw.MaxMatches != nil {
+		if *raw.MaxMatches < 0 {
+			return base, fmt.Errorf("max_matches can't be negative")
+		}
+		options.MaxMatches = *raw.MaxMatches
+	}
+	return options, nil
+}
+
+//hasScanOptionsFile returns whether dir holds a ScanOptionsFile
+func hasScanOptionsFile(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ScanOptionsFile))
+	return err == nil
+}
+
+//scanOptions returns the options for a ruleset built from RuleDir, from the ScanOptionsFile's verified contents when given
+func (wrp *WatchedRulesetProvider) scanOptions(verified []byte) (ScanOptions, error) {
+	data := verified
+	if data == nil {
+		var err error
+		if data, err = ioutil.ReadFile(filepath.Join(wrp.RuleDir, ScanOptionsFile)); os.IsNotExist(err) {
+			return wrp.ScanOptions, nil
+		} else if err != nil {
+			return wrp.ScanOptions, err
+		}
+	}
+	options, err := ParseScanOptions(data, wrp.ScanOptions)
+	if err != nil {
+		return options, fmt.Errorf("%s - %v", ScanOptionsFile, err)
+	}
+	log.Debugf("Scan options from %s %+v", ScanOptionsFile, options)
+	return options, nil
+}
@@ -0,0 +1,35 @@
+package yarascanner
+
+import (
+	"github.com/hillu/go-yara"
+	"testing"
+	"time"
+)
+
+//Test scan options files override only the options they set, and invalid files leave the base options
+func TestParseScanOptions(t *testing.T) {
+	base := ScanOptions{Flags: yara.ScanFlagsFastMode, Timeout: 5 * time.Second, MaxMatches: 10}
+	cases := []struct {
+		data     string
+		expected ScanOptions
+		err      bool
+	}{
+		{`{}`, base, false},
+		{`{"timeout":"30s"}`, ScanOptions{Flags: yara.ScanFlagsFastMode, Timeout: 30 * time.Second, MaxMatches: 10}, false},
+		{`{"fast_mode":false,"max_matches":0}`, ScanOptions{Timeout: 5 * time.Second}, false},
+		{`{"full_rescan_on_match":true}`, ScanOptions{Flags: yara.ScanFlagsFastMode, Timeout: 5 * time.Second, MaxMatches: 10, FullRescanOnMatch: true}, false},
+		{`{"timeout":"soon"}`, base, true},
+		{`{"timeout":"-1s"}`, base, true},
+		{`{"timeout":"0s"}`, base, true},
+		{`{"max_matches":-1}`, base, true},
+		{`{"timout":"30s"}`, base, true},
+		{`{"fast_mode":"yes"}`, base, true},
+		{`not json`, base, true},
+	}
+	for _, c := range cases {
+		options, err := ParseScanOptions([]byte(c.data), base)
+		if (err != nil) != c.err || options != c.expected {
+			t.Errorf("%s expected %+v error %v got %+v %v", c.data, c.expected, c.err, options, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package yarascanner
+
+import (
+	"context"
+	"github.com/hillu/go-yara"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"os"
+	"time"
+)
+
+//scanTimeoutError is the error go-yara returns when a scan runs out of time
+const scanTimeoutError = "scan timeout"
+
+//scanOutcome classifies the error of a scan
+func scanOutcome(err error) string {
+	switch {
+	case err == nil:
+		return models.ScanSucceeded
+	case os.IsNotExist(err):
+		return models.ScanMissing
+	case err.Error() == scanTimeoutError:
+		return models.ScanTimedOut
+	}
+	if _, crashed := err.(*ScanCrashError); crashed {
+		return models.ScanCrashed
+	}
+	return models.ScanFailed
+}
+
+//scanRecorded scans a binary with a ruleset through scan, ruleset.Scan or an isolated scan, and records the attempt as a ScanRun.
+//The last scan fields of the binary are maintained for production runs, creating its record if needed.
+//Scans cancelled by a shutdown aren't recorded, they didn't get to an outcome
+func scanRecorded(db *gorm.DB, ruleset *Ruleset, path, binaryHash string, shadow bool, scan func(string) ([]yara.MatchRule, error)) ([]yara.MatchRule, error) {
+	run := models.ScanRun{BinaryHash: binaryHash, RulesetVersionID: ruleset.Version, Shadow: shadow, Delta: ruleset.Scope != nil, StartedAt: time.Now()}
+	info, err := os.Stat(path)
+	var matches []yara.MatchRule
+	if err == nil {
+		run.Bytes = info.Size()
+		matches, err = scan(path)
+	}
+	if err == context.Canceled {
+		return nil, err
+	}
+	run.FinishedAt = time.Now()
+	run.DurationMs = int64(run.FinishedAt.Sub(run.StartedAt) / time.Millisecond)
+	run.Outcome = scanOutcome(err)
+	run.Matches = len(matches)
+	if err != nil {
+		run.Error = err.Error()
+		log.Warnf("Scan of %s with ruleset version %d failed (%s) - %v", binaryHash, ruleset.Version, run.Outcome, err)
+	}
+	if dbErr := db.Create(&run).Error; dbErr != nil {
+		log.Errorf("Error recording scan run of %s %v", binaryHash, dbErr)
+	}
+	if !shadow {
+		//binaries dropped into the bin dir after startup are recorded on their first scan
+		if info != nil {
+			db.Where(models.Binary{Hash: binaryHash}).FirstOrCreate(&models.Binary{})
+		}
+		fields := map[string]interface{}{"last_scaned_at": run.FinishedAt, "last_scan_outcome": run.Outcome, "last_scan_error": run.Error}
+		if err == nil {
+			fields["last_scan_succeeded_at"] = &run.FinishedAt
+		}
+		db.Model(&models.Binary{}).Where("hash = ?", binaryHash).Updates(fields)
+	}
+	return matches, err
+}
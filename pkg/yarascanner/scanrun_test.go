@@ -0,0 +1,123 @@
+package yarascanner
+
+import (
+	"context"
+	"fmt"
+	"github.com/hillu/go-yara"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Test every scan is recorded as a run with its outcome, and only production runs update the binary's last scan
+func TestScanRecorded(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "scanrun")
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{"bin": "content"})
+	ruleset := &Ruleset{Version: 3}
+	matched := func(string) ([]yara.MatchRule, error) { return []yara.MatchRule{{Rule: "a"}, {Rule: "b"}}, nil }
+	failed := func(string) ([]yara.MatchRule, error) { return nil, fmt.Errorf("internal error: 30") }
+	timedOut := func(string) ([]yara.MatchRule, error) { return nil, fmt.Errorf(scanTimeoutError) }
+	crashed := func(string) ([]yara.MatchRule, error) { return nil, &ScanCrashError{Reason: "signal: segmentation fault"} }
+	binary := func() models.Binary {
+		bin := models.Binary{}
+		gdb.Where("hash = ?", "bin").First(&bin)
+		return bin
+	}
+
+	cases := []struct {
+		name    string
+		file    string
+		shadow  bool
+		scan    func(string) ([]yara.MatchRule, error)
+		outcome string
+		err     string
+		matches int
+	}{
+		{"success", "bin", false, matched, models.ScanSucceeded, "", 2},
+		{"shadow failure", "bin", true, failed, models.ScanFailed, "internal error: 30", 0},
+		{"failure", "bin", false, failed, models.ScanFailed, "internal error: 30", 0},
+		{"timeout", "bin", false, timedOut, models.ScanTimedOut, scanTimeoutError, 0},
+		{"crash", "bin", false, crashed, models.ScanCrashed, "signal: segmentation fault", 0},
+		{"missing", "gone", false, matched, models.ScanMissing, "no such file", 0},
+	}
+	var succeededAt *time.Time
+	for _, c := range cases {
+		before := binary()
+		matches, err := scanRecorded(gdb, ruleset, filepath.Join(dir, c.file), "bin", c.shadow, c.scan)
+		if len(matches) != c.matches || (err == nil) != (len(c.err) == 0) {
+			t.Fatalf("%s - expected %d matches, got %v %v", c.name, c.matches, matches, err)
+		}
+		run := models.ScanRun{}
+		gdb.Last(&run)
+		if run.Outcome != c.outcome || run.Matches != c.matches || run.Shadow != c.shadow || run.RulesetVersionID != 3 ||
+			(len(c.err) == 0) != (len(run.Error) == 0) || len(c.err) > 0 && !strings.Contains(run.Error, c.err) {
+			t.Fatalf("%s - expected a %s run with error %q, got %+v", c.name, c.outcome, c.err, run)
+		}
+		after := binary()
+		if c.shadow {
+			if after.LastScanOutcome != before.LastScanOutcome || !after.LastScanedAt.Equal(before.LastScanedAt) {
+				t.Fatalf("%s - expected the binary's last scan left to the production runs, got %+v", c.name, after)
+			}
+			continue
+		}
+		if after.LastScanOutcome != c.outcome || after.LastScanError != run.Error || !after.LastScanedAt.Equal(run.FinishedAt) {
+			t.Fatalf("%s - expected the binary's last scan to be the run, got %+v", c.name, after)
+		}
+		if c.outcome == models.ScanSucceeded {
+			succeededAt = after.LastScanSucceededAt
+		}
+		if succeededAt == nil || !after.LastScanSucceededAt.Equal(*succeededAt) {
+			t.Fatalf("%s - expected the last successful scan kept, got %v", c.name, after.LastScanSucceededAt)
+		}
+	}
+}
+
+//Test scans stop at MaxMatches and a scan cancelled before it starts is handed back without a run recorded
+func TestScanLimitAndCancel(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "scanlimit")
+	defer os.RemoveAll(dir)
+	ruleDir := filepath.Join(dir, "rules")
+	os.Mkdir(ruleDir, 0755)
+	writeTestFiles(t, ruleDir, map[string]string{"a.yar": `rule first { condition: true } rule second { condition: true }`})
+	writeTestFiles(t, dir, map[string]string{"bin": "content"})
+	wrp, _ := NewWatchedRulesetProvider(ruleDir, gdb, nil)
+	wrp.ScanOptions.MaxMatches = 1
+	if err := wrp.LoadRules(); err != nil {
+		t.Fatalf("Error loading rules %v", err)
+	}
+	scanner := NewWorkerScanner(wrp, nil)
+	defer scanner.Close()
+	ruleset, err := scanner.Ruleset(context.Background())
+	if err != nil || len(ruleset.Rules) != 1 {
+		t.Fatalf("Expected a ruleset of one unit, got %v", err)
+	}
+	path := filepath.Join(dir, "bin")
+
+	matches, err := scanRecorded(gdb, ruleset, path, "bin", false, scanner.Scanner(context.Background(), ruleset, "full", nil))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("Expected the scan stopped after 1 of the 2 matching rules, got %v %v", matches, err)
+	}
+	runs := 0
+	if gdb.Model(&models.ScanRun{}).Count(&runs); runs != 1 {
+		t.Fatalf("Expected the limited scan recorded as a run, got %d runs", runs)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if matches, err := scanRecorded(gdb, ruleset, path, "bin", false, scanner.Scanner(ctx, ruleset, "full", nil)); err != context.Canceled || matches != nil {
+		t.Fatalf("Expected the cancelled scan to return context.Canceled, got %v %v", matches, err)
+	}
+	cancelledRuns := 0
+	gdb.Model(&models.ScanRun{}).Count(&cancelledRuns)
+	if cancelledRuns != runs {
+		t.Fatalf("Expected no run recorded for the cancelled scan, got %d runs after %d", cancelledRuns, runs)
+	}
+}
@@ -0,0 +1,111 @@
+package yarascanner
+
+import (
+	"github.com/hillu/go-yara"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//ScoringPolicy turns the metadata and tags of a rule into the score of its results
+type ScoringPolicy struct {
+	//ScoreMetaKeys are the metadata keys holding a numeric score, in order of precedence
+	ScoreMetaKeys []string
+	//SeverityMetaKeys are the metadata keys holding a severity, mapped to a score through Severities
+	SeverityMetaKeys []string
+	//Severities maps lowercased severity names, from metadata or tags, to scores
+	Severities map[string]int
+	//NamespaceDefaults are the scores of the rules of a namespace declaring none
+	NamespaceDefaults map[string]int
+	//DefaultScore is the score of rules declaring none outside of NamespaceDefaults
+	DefaultScore int
+	//MinScore and MaxScore are the range of the feed, scores are clamped to it
+	MinScore int
+	MaxScore int
+}
+
+//DefaultScoringPolicy reads score, then severity and threat_level, within the -100 to 100 range of the feed
+var DefaultScoringPolicy = ScoringPolicy{
+	ScoreMetaKeys:     []string{"score"},
+	SeverityMetaKeys:  []string{"severity", "threat_level"},
+	Severities:        map[string]int{"info": 10, "informational": 10, "low": 25, "medium": 50, "moderate": 50, "high": 75, "critical": 100},
+	NamespaceDefaults: map[string]int{},
+	DefaultScore:      0,
+	MinScore:          -100,
+	MaxScore:          100,
+}
+
+//metaNumber returns a metadata value as a number, accepting integers and numeric strings
+func metaNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err == nil && !math.IsNaN(number) && !math.IsInf(number, 0) {
+			return number, true
+		}
+	}
+	return 0, false
+}
+
+//severityScore returns the score of a severity name, or of a numeric severity listed in Severities
+func (policy ScoringPolicy) severityScore(value interface{}) (int, bool) {
+	score, ok := policy.Severities[strings.ToLower(strings.TrimSpace(metaString(value)))]
+	return score, ok
+}
+
+//Score returns the score of a rule, from its score metadata, else its severity metadata, else the highest severity
+//among its tags, else the default of its namespace. Metadata of any type is accepted, values that don't parse are skipped
+func (policy ScoringPolicy) Score(namespace string, tags []string, metas map[string]interface{}) int {
+	return policy.clamp(policy.rawScore(namespace, tags, metas))
+}
+
+func (policy ScoringPolicy) rawScore(namespace string, tags []string, metas map[string]interface{}) int {
+	for _, key := range policy.ScoreMetaKeys {
+		if number, ok := metaNumber(metas[key]); ok {
+			return int(math.Round(number))
+		}
+	}
+	for _, key := range policy.SeverityMetaKeys {
+		if score, ok := policy.severityScore(metas[key]); ok {
+			return score
+		}
+	}
+	tagged := false
+	tagScore := 0
+	for _, tag := range tags {
+		if score, ok := policy.severityScore(tag); ok && (!tagged || score > tagScore) {
+			tagScore, tagged = score, true
+		}
+	}
+	if tagged {
+		return tagScore
+	}
+	if score, ok := policy.NamespaceDefaults[namespace]; ok {
+		return score
+	}
+	return policy.DefaultScore
+}
+
+//clamp bounds a score to the feed's range
+func (policy ScoringPolicy) clamp(score int) int {
+	if score < policy.MinScore {
+		return policy.MinScore
+	}
+	if score > policy.MaxScore {
+		return policy.MaxScore
+	}
+	return score
+}
+
+//ScoreMatch returns the score of a match
+func (policy ScoringPolicy) ScoreMatch(match yara.MatchRule) int {
+	return policy.Score(match.Namespace, match.Tags, match.Meta)
+}
@@ -0,0 +1,54 @@
+package yarascanner
+
+import (
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"testing"
+)
+
+//Test scores from every kind of metadata, including values that used to panic the results worker
+func TestScoringPolicy(t *testing.T) {
+	policy := DefaultScoringPolicy
+	policy.NamespaceDefaults = map[string]int{"vendor": 40}
+	cases := []struct {
+		namespace string
+		tags      []string
+		metas     map[string]interface{}
+		expected  int
+	}{
+		{"", nil, map[string]interface{}{"score": int32(80)}, 80},
+		{"", nil, map[string]interface{}{"score": int64(60)}, 60},
+		{"", nil, map[string]interface{}{"score": " 70 "}, 70},
+		{"", nil, map[string]interface{}{"score": 500}, 100},
+		{"", nil, map[string]interface{}{"score": "-500"}, -100},
+		{"", nil, map[string]interface{}{"score": true, "severity": "High"}, 75},
+		{"", nil, map[string]interface{}{"score": "n/a", "threat_level": "critical"}, 100},
+		{"", []string{"low", "medium"}, map[string]interface{}{"author": "x"}, 50},
+		{"vendor", nil, map[string]interface{}{"severity": "unknown"}, 40},
+		{"other", nil, nil, 0},
+	}
+	for i, c := range cases {
+		if actual := policy.Score(c.namespace, c.tags, c.metas); actual != c.expected {
+			t.Errorf("case %d expected %d got %d", i, c.expected, actual)
+		}
+	}
+}
+
+//Test aggregating results into verdicts with both formulas and namespace weights
+func TestVerdictPolicy(t *testing.T) {
+	results := []models.Result{{Score: 40, Namespace: "a"}, {Score: 30, Namespace: "b"}, {Score: -10, Namespace: "c"}}
+	policy := DefaultVerdictPolicy
+	if score, verdict := policy.Aggregate(results); score != 40 || verdict != models.VerdictSuspicious {
+		t.Errorf("max expected 40 suspicious got %d %s", score, verdict)
+	}
+	policy.Formula = VerdictFormulaSum
+	if score, verdict := policy.Aggregate(results); score != 60 || verdict != models.VerdictSuspicious {
+		t.Errorf("sum expected 60 suspicious got %d %s", score, verdict)
+	}
+	policy.NamespaceWeights = map[string]float64{"b": 3}
+	if score, verdict := policy.Aggregate(results); score != 100 || verdict != models.VerdictMalicious {
+		t.Errorf("weighted sum expected 100 malicious got %d %s", score, verdict)
+	}
+	if score, verdict := policy.Aggregate(nil); score != 0 || verdict != models.VerdictClean {
+		t.Errorf("no results expected 0 clean got %d %s", score, verdict)
+	}
+}
@@ -0,0 +1,200 @@
+package yarascanner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	metrics "github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+//SignatureExts are the extensions of the detached signatures of rule files, in order of preference
+var SignatureExts = []string{".minisig", ".sig"}
+
+//isSignatureFile returns whether name is a detached signature rather than a rule file
+func isSignatureFile(name string) bool {
+	for _, ext := range SignatureExts {
+		if strings.EqualFold(filepath.Ext(name), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+//TrustedKey is an ed25519 public key rule files may be signed with.
+//KeyID is the minisign key id, it is zero for bare ed25519 keys
+type TrustedKey struct {
+	KeyID     [8]byte
+	PublicKey ed25519.PublicKey
+}
+
+//String returns the key id as minisign prints it, or a prefix of the key for bare keys
+func (key TrustedKey) String() string {
+	if key.KeyID == [8]byte{} {
+		return hex.EncodeToString(key.PublicKey[:8])
+	}
+	id := make([]byte, 8)
+	for i := range id {
+		id[i] = key.KeyID[7-i]
+	}
+	return strings.ToUpper(hex.EncodeToString(id))
+}
+
+//ParseTrustedKeys reads public keys, one per line, either minisign public keys (with or without their comment line)
+//or base64 encoded raw ed25519 keys. Empty lines and lines starting with # are ignored
+func ParseTrustedKeys(data []byte) ([]TrustedKey, error) {
+	keys := make([]TrustedKey, 0)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("trusted key line %d - %v", i+1, err)
+		}
+		key := TrustedKey{}
+		switch {
+		case len(raw) == 2+8+ed25519.PublicKeySize && string(raw[:2]) == "Ed":
+			copy(key.KeyID[:], raw[2:10])
+			key.PublicKey = ed25519.PublicKey(raw[10:])
+		case len(raw) == ed25519.PublicKeySize:
+			key.PublicKey = ed25519.PublicKey(raw)
+		default:
+			return nil, fmt.Errorf("trusted key line %d is not an ed25519 or minisign public key", i+1)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+//LoadTrustedKeys reads the public keys in a file, or in every file of a directory
+func LoadTrustedKeys(path string) ([]TrustedKey, error) {
+	files, err := filepath.Glob(filepath.Join(path, "*"))
+	if err != nil || len(files) == 0 {
+		files = []string{path}
+	}
+	keys := make([]TrustedKey, 0)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		fileKeys, err := ParseTrustedKeys(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s - %v", file, err)
+		}
+		keys = append(keys, fileKeys...)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no trusted keys in %s", path)
+	}
+	return keys, nil
+}
+
+//verifyMinisign checks a minisign signature of data, including the global signature over its trusted comment
+func verifyMinisign(keys []TrustedKey, data, sig []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(sig)), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return fmt.Errorf("malformed minisign signature")
+	}
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(blob) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("malformed minisign signature")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return fmt.Errorf("malformed minisign global signature")
+	}
+	message := data
+	switch string(blob[:2]) {
+	case "Ed":
+	case "ED":
+		prehash := blake2b.Sum512(data)
+		message = prehash[:]
+	default:
+		return fmt.Errorf("unsupported minisign algorithm %q", blob[:2])
+	}
+	for _, key := range keys {
+		if !bytes.Equal(key.KeyID[:], blob[2:10]) {
+			continue
+		}
+		if !ed25519.Verify(key.PublicKey, message, blob[10:]) {
+			return fmt.Errorf("signature by key %s does not match", key)
+		}
+		trustedComment := strings.TrimSuffix(strings.TrimPrefix(lines[2], "trusted comment: "), "\r")
+		if !ed25519.Verify(key.PublicKey, append(append([]byte{}, blob[10:]...), trustedComment...), globalSig) {
+			return fmt.Errorf("trusted comment signature by key %s does not match", key)
+		}
+		return nil
+	}
+	return fmt.Errorf("signed by an untrusted key")
+}
+
+//verifySignature checks a detached signature of data against the trusted keys.
+//Minisign signature files are accepted, as are raw ed25519 signatures, binary or base64 encoded
+func verifySignature(keys []TrustedKey, data, sig []byte) error {
+	if bytes.HasPrefix(sig, []byte("untrusted comment:")) {
+		return verifyMinisign(keys, data, sig)
+	}
+	raw := sig
+	if len(sig) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+		if err != nil || len(decoded) != ed25519.SignatureSize {
+			return fmt.Errorf("malformed signature")
+		}
+		raw = decoded
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key.PublicKey, data, raw) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature does not match any trusted key")
+}
+
+//readSignature returns the detached signature of a rule file in dir
+func readSignature(dir, name string) ([]byte, error) {
+	for _, ext := range SignatureExts {
+		sig, err := ioutil.ReadFile(filepath.Join(dir, name+ext))
+		if err == nil {
+			return sig, nil
+		}
+	}
+	return nil, fmt.Errorf("unsigned, no %s file", strings.Join(SignatureExts, " or "))
+}
+
+//verifyRuleFiles checks the signature of each rule file in RuleDir and returns their verified contents.
+//The contents must match the hashes the ruleset is built with, so a file swapped after hashing is refused too
+func (wrp *WatchedRulesetProvider) verifyRuleFiles(names []string, hashes map[string]string) (map[string][]byte, error) {
+	contents := make(map[string][]byte, len(names))
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(wrp.RuleDir, name))
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != hashes[name] {
+			err = fmt.Errorf("changed while being verified")
+		} else if sig, sigErr := readSignature(wrp.RuleDir, name); sigErr != nil {
+			err = sigErr
+		} else {
+			err = verifySignature(wrp.TrustedKeys, data, sig)
+		}
+		if err != nil {
+			metrics.GetOrRegisterCounter("rules.signature.rejected", nil).Inc(1)
+			log.Warnf("ALERT refusing rule file %s in %s - %v", name, wrp.RuleDir, err)
+			return nil, fmt.Errorf("rule file %s failed signature verification - %v", name, err)
+		}
+		contents[name] = data
+	}
+	log.Debugf("Verified the signatures of %d rule files", len(names))
+	return contents, nil
+}
@@ -0,0 +1,160 @@
+package yarascanner
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/hillu/go-yara"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//minisignKey is a signing key of the tests, with its minisign key id
+type minisignKey struct {
+	id      [8]byte
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+func newMinisignKey(t *testing.T, id byte) minisignKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key %v", err)
+	}
+	return minisignKey{id: [8]byte{id, 1, 2, 3, 4, 5, 6, 7}, public: public, private: private}
+}
+
+//publicKey returns the key as minisign writes it in a .pub file
+func (key minisignKey) publicKey() string {
+	raw := append(append([]byte("Ed"), key.id[:]...), key.public...)
+	return "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(raw) + "\n"
+}
+
+//sign returns a minisign signature of data, prehashed with the ED algorithm
+func (key minisignKey) sign(data []byte, prehashed bool, comment string) []byte {
+	algorithm, message := "Ed", data
+	if prehashed {
+		prehash := blake2b.Sum512(data)
+		algorithm, message = "ED", prehash[:]
+	}
+	sig := ed25519.Sign(key.private, message)
+	blob := append(append([]byte(algorithm), key.id[:]...), sig...)
+	global := ed25519.Sign(key.private, append(append([]byte{}, sig...), comment...))
+	return []byte("untrusted comment: signature from minisign secret key\n" + base64.StdEncoding.EncodeToString(blob) + "\n" +
+		"trusted comment: " + comment + "\n" + base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+//Test minisign and raw ed25519 signatures verify against the trusted keys only
+func TestVerifySignature(t *testing.T) {
+	trusted, untrusted := newMinisignKey(t, 1), newMinisignKey(t, 2)
+	keys, err := ParseTrustedKeys([]byte("# rule signers\n" + trusted.publicKey() + "\n" + base64.StdEncoding.EncodeToString(untrusted.public) + "\n"))
+	if err != nil || len(keys) != 2 || keys[0].KeyID != trusted.id || keys[1].KeyID != [8]byte{} {
+		t.Fatalf("Expected a minisign and a bare key parsed, got %v %v", keys, err)
+	}
+	if _, err := ParseTrustedKeys([]byte("bm90IGEga2V5")); err == nil {
+		t.Fatalf("Expected a line that isn't a key refused")
+	}
+	keys = keys[:1]
+	data := []byte(`rule signed { condition: true }`)
+	tampered := []byte(`rule signed { condition: false }`)
+	legacy := trusted.sign(data, false, "timestamp:1")
+	prehashed := trusted.sign(data, true, "timestamp:1")
+	badComment := bytes.Replace(prehashed, []byte("timestamp:1"), []byte("timestamp:2"), 1)
+	cases := []struct {
+		name string
+		data []byte
+		sig  []byte
+		err  string
+	}{
+		{"legacy Ed", data, legacy, ""},
+		{"prehashed ED", data, prehashed, ""},
+		{"tampered file", tampered, prehashed, "does not match"},
+		{"tampered legacy file", tampered, legacy, "does not match"},
+		{"untrusted key", data, untrusted.sign(data, true, "timestamp:1"), "untrusted key"},
+		{"bad trusted comment", data, badComment, "trusted comment"},
+		{"truncated", data, legacy[:40], "malformed"},
+		{"raw ed25519", data, ed25519.Sign(trusted.private, data), ""},
+		{"base64 ed25519", data, []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(trusted.private, data))), ""},
+		{"raw ed25519 by an untrusted key", data, ed25519.Sign(untrusted.private, data), "does not match"},
+	}
+	for _, c := range cases {
+		err := verifySignature(keys, c.data, c.sig)
+		if (len(c.err) == 0) != (err == nil) || (err != nil && !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s expected %q got %v", c.name, c.err, err)
+		}
+	}
+}
+
+//Test rule files, compiled rules and bundles are loaded only when signed, and a refused file keeps the active ruleset
+func TestVerifyRuleFiles(t *testing.T) {
+	gdb := openTestDB(t)
+	defer gdb.Close()
+	dir := testDir(t, "signed")
+	defer os.RemoveAll(dir)
+	key := newMinisignKey(t, 1)
+	keys, _ := ParseTrustedKeys([]byte(key.publicKey()))
+	write := func(name string, data []byte, signed bool) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatalf("Error writing %s %v", name, err)
+		}
+		if signed {
+			ioutil.WriteFile(filepath.Join(dir, name+".minisig"), key.sign(data, true, "file:"+name), 0644)
+		}
+	}
+	compiler, _ := yara.NewCompiler()
+	compiler.AddString(`rule precompiled { condition: true }`, "precompiled")
+	rules, _ := compiler.GetRules()
+	compiled := &bytes.Buffer{}
+	if err := rules.Write(compiled); err != nil {
+		t.Fatalf("Error writing compiled rules %v", err)
+	}
+	write("a.yar", []byte(`rule source { condition: true }`), true)
+	write("c.yarc", compiled.Bytes(), true)
+	write("b.zip", zipArchive(t, map[string]string{"b.yar": `rule bundled { condition: true }`}), true)
+
+	wrp, _ := NewWatchedRulesetProvider(dir, gdb, nil)
+	wrp.TrustedKeys = keys
+	if err := wrp.LoadRules(); err != nil {
+		t.Fatalf("Error loading signed rules %v", err)
+	}
+	expected := "a.yar:source b:bundled precompiled:precompiled"
+	active := func() string {
+		ruleset, _ := wrp.GetRules()
+		return strings.Join(rulesetRules(ruleset), " ")
+	}
+	if rules := active(); rules != expected {
+		t.Fatalf("Expected the signed source, bundle and compiled rules, got %s", rules)
+	}
+
+	refused := []struct {
+		name   string
+		change func()
+	}{
+		{"tampered", func() { write("a.yar", []byte(`rule source { condition: false }`), false) }},
+		{"unsigned", func() { write("d.yar", []byte(`rule unsigned { condition: true }`), false) }},
+		{"untrusted", func() {
+			data := []byte(`rule untrusted { condition: true }`)
+			write("d.yar", data, false)
+			ioutil.WriteFile(filepath.Join(dir, "d.yar.minisig"), newMinisignKey(t, 2).sign(data, true, "x"), 0644)
+		}},
+		{"tampered bundle", func() { write("b.zip", zipArchive(t, map[string]string{"b.yar": `rule swapped { condition: true }`}), false) }},
+	}
+	for _, c := range refused {
+		c.change()
+		if changed, err := wrp.reload(c.name); changed || err == nil || !strings.Contains(err.Error(), "signature verification") {
+			t.Fatalf("Expected the %s file refused, got %v %v", c.name, changed, err)
+		}
+		if rules := active(); rules != expected {
+			t.Fatalf("Expected the active ruleset kept after refusing the %s file, got %s", c.name, rules)
+		}
+		os.Remove(filepath.Join(dir, "d.yar"))
+		os.Remove(filepath.Join(dir, "d.yar.minisig"))
+		write("a.yar", []byte(`rule source { condition: true }`), true)
+		write("b.zip", zipArchive(t, map[string]string{"b.yar": `rule bundled { condition: true }`}), true)
+	}
+}
@@ -0,0 +1,74 @@
+package yarascanner
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/zacharyestep/s3yarascanner/pkg/models"
+	"math"
+)
+
+//Formulas aggregating the scores of a binary's results
+const (
+	//VerdictFormulaMax takes the highest weighted score
+	VerdictFormulaMax = "max"
+	//VerdictFormulaSum adds up the weighted scores up to SumCap
+	VerdictFormulaSum = "sum"
+)
+
+//VerdictPolicy aggregates the scores of a binary's results into a score and a verdict
+type VerdictPolicy struct {
+	Formula string
+	//SumCap bounds the aggregate score of the sum formula
+	SumCap int
+	//NamespaceWeights multiply the scores of the results of a namespace, scores of other namespaces count as they are
+	NamespaceWeights map[string]float64
+	//SuspiciousScore and MaliciousScore are the aggregate scores from which a binary is suspicious or malicious
+	SuspiciousScore int
+	MaliciousScore  int
+}
+
+//DefaultVerdictPolicy takes the highest score, suspicious from 25 and malicious from 75
+var DefaultVerdictPolicy = VerdictPolicy{Formula: VerdictFormulaMax, SumCap: 100, NamespaceWeights: map[string]float64{}, SuspiciousScore: 25, MaliciousScore: 75}
+
+//weight returns the weight of the results of a namespace
+func (policy VerdictPolicy) weight(namespace string) float64 {
+	if weight, ok := policy.NamespaceWeights[namespace]; ok {
+		return weight
+	}
+	return 1
+}
+
+//Aggregate returns the aggregate score of a binary's results and its verdict
+func (policy VerdictPolicy) Aggregate(results []models.Result) (int, string) {
+	aggregate := 0.0
+	for i, result := range results {
+		score := float64(result.Score) * policy.weight(result.Namespace)
+		if policy.Formula == VerdictFormulaSum {
+			aggregate += score
+		} else if i == 0 || score > aggregate {
+			aggregate = score
+		}
+	}
+	if policy.Formula == VerdictFormulaSum && aggregate > float64(policy.SumCap) {
+		aggregate = float64(policy.SumCap)
+	}
+	score := int(math.Round(aggregate))
+	switch {
+	case len(results) > 0 && score >= policy.MaliciousScore:
+		return score, models.VerdictMalicious
+	case len(results) > 0 && score >= policy.SuspiciousScore:
+		return score, models.VerdictSuspicious
+	}
+	return score, models.VerdictClean
+}
+
+//RecordVerdict stores the verdict of a binary from the production results of its latest scan, replacing the previous one
+func RecordVerdict(db *gorm.DB, binaryHash string, rulesetVersion uint, results []models.Result, policy VerdictPolicy) error {
+	score, verdict := policy.Aggregate(results)
+	record := models.Verdict{}
+	db.Where(models.Verdict{BinaryHash: binaryHash}).FirstOrInit(&record)
+	record.Score = score
+	record.Verdict = verdict
+	record.Matches = len(results)
+	record.RulesetVersionID = rulesetVersion
+	return db.Save(&record).Error
+}
@@ -0,0 +1,177 @@
+package yarascanner
+
+import (
+	"context"
+	"fmt"
+	"github.com/hillu/go-yara"
+	"sync"
+)
+
+//WorkerScanner is the scanner of one scanning worker, scanning in the worker's child process when the scans are isolated.
+//go-yara v1.1.0 has no yara.Scanner, externals are set on the compiled rules themselves, so a worker scanning in process
+//can't share the provider's ruleset with the others. It substitutes a clone of it, a full copy of the compiled rules
+//made by saving and loading them, taken from the provider's clone pool for a job and handed back after it. The pool
+//bounds the clones alive to the provider's MaxRulesetClones, so the memory of the rules is that many times their size
+//at most, whatever the number of workers. Workers scanning in child processes scan with the provider's ruleset and
+//take no clone. Scans are driven by a context, libyara only calls back as it evaluates the rules so a cancelled scan
+//stops once the string search of the unit in progress ends, its Timeout bounds that search
+type WorkerScanner struct {
+	provider *WatchedRulesetProvider
+	isolated *IsolatedScan
+	provided *Ruleset
+	ruleset  *Ruleset
+}
+
+//NewWorkerScanner returns a scanner for a worker, scanning in a child process of isolation unless it is nil
+func NewWorkerScanner(provider *WatchedRulesetProvider, isolation *ScanIsolation) *WorkerScanner {
+	ws := &WorkerScanner{provider: provider}
+	if isolation != nil {
+		ws.isolated = isolation.Worker()
+	}
+	return ws
+}
+
+//newScratchScanner returns a scanner for the rules of hunts, the rule profiler and the stager, scanning in a scratch child
+//process of isolation unless it is nil. Its Scanner is used with their own rules, it has no Ruleset
+func newScratchScanner(isolation *ScanIsolation) *WorkerScanner {
+	ws := &WorkerScanner{}
+	if isolation != nil {
+		ws.isolated = isolation.Scratch()
+	}
+	return ws
+}
+
+//Ruleset returns the ruleset for the worker's next job, a clone of the provider's current ruleset from its pool, waiting
+//for one to be handed back while MaxRulesetClones are taken, or the provider's ruleset itself when the scans are isolated.
+//The ruleset is kept until Release
+func (ws *WorkerScanner) Ruleset(ctx context.Context) (*Ruleset, error) {
+	if ws.ruleset != nil {
+		return ws.ruleset, nil
+	}
+	provided, err := ws.provider.GetRules()
+	if err != nil {
+		return nil, err
+	}
+	if provided == nil {
+		return nil, fmt.Errorf("got no rules from provider")
+	}
+	if ws.isolated != nil {
+		ws.ruleset = provided
+		return provided, nil
+	}
+	ruleset, err := ws.provider.clonePool().take(ctx, provided)
+	if err != nil {
+		return nil, err
+	}
+	ws.provided, ws.ruleset = provided, ruleset
+	return ruleset, nil
+}
+
+//Release hands the worker's ruleset back, its clone goes back to the pool unless the provider swapped the ruleset since
+func (ws *WorkerScanner) Release() {
+	if ws.ruleset != nil && ws.provided != nil {
+		current, _ := ws.provider.GetRules()
+		ws.provider.clonePool().give(ws.provided, ws.ruleset, current)
+	}
+	ws.provided, ws.ruleset = nil, nil
+}
+
+//Scanner returns the scan of a file with rules, the worker's ruleset or its delta or shadow, and the externals of the binary.
+//kind tells the rulesets of a version apart for the child process
+func (ws *WorkerScanner) Scanner(ctx context.Context, rules *Ruleset, kind string, externals Externals) func(string) ([]yara.MatchRule, error) {
+	if ws.isolated != nil {
+		return func(path string) ([]yara.MatchRule, error) {
+			return ws.isolated.Scan(ctx, rules, kind, path, externals)
+		}
+	}
+	return func(path string) ([]yara.MatchRule, error) {
+		rules.DefineExternals(externals)
+		return rules.ScanContext(ctx, path)
+	}
+}
+
+//Close stops the worker's child process and hands its ruleset back
+func (ws *WorkerScanner) Close() {
+	if ws.isolated != nil {
+		ws.isolated.Close()
+	}
+	ws.Release()
+}
+
+//clonePool holds the clones of the provider's ruleset not taken by a worker, and a slot for each clone alive,
+//free or taken. Clones of a ruleset the provider swapped are destroyed rather than kept, as are all of them once closed
+type clonePool struct {
+	slots chan struct{}
+	sync.Mutex
+	provided *Ruleset
+	free     []*Ruleset
+	closed   bool
+}
+
+func newClonePool(max int) *clonePool {
+	if max < 1 {
+		max = 1
+	}
+	return &clonePool{slots: make(chan struct{}, max)}
+}
+
+//take returns a clone of provided, a free one or a new one once a slot is had, until ctx is done
+func (pool *clonePool) take(ctx context.Context, provided *Ruleset) (*Ruleset, error) {
+	select {
+	case pool.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	pool.Lock()
+	pool.swapped(provided)
+	if last := len(pool.free) - 1; last >= 0 {
+		clone := pool.free[last]
+		pool.free = pool.free[:last]
+		pool.Unlock()
+		return clone, nil
+	}
+	pool.Unlock()
+	clone, err := provided.Clone()
+	if err != nil {
+		<-pool.slots
+		return nil, fmt.Errorf("cloning ruleset %s - %v", provided.Hash, err)
+	}
+	return clone, nil
+}
+
+//give hands back a clone of provided and frees its slot, current is the provider's ruleset now
+func (pool *clonePool) give(provided, clone, current *Ruleset) {
+	pool.Lock()
+	pool.swapped(current)
+	if provided == pool.provided && !pool.closed {
+		pool.free = append(pool.free, clone)
+	} else {
+		clone.Destroy()
+	}
+	pool.Unlock()
+	<-pool.slots
+}
+
+//swapped destroys the free clones once provided replaced the ruleset they were cloned from, the pool is locked
+func (pool *clonePool) swapped(provided *Ruleset) {
+	if provided != pool.provided {
+		pool.drain()
+		pool.provided = provided
+	}
+}
+
+//close destroys the free clones and those handed back later
+func (pool *clonePool) close() {
+	pool.Lock()
+	defer pool.Unlock()
+	pool.drain()
+	pool.closed = true
+}
+
+//drain destroys the free clones, the pool is locked
+func (pool *clonePool) drain() {
+	for _, clone := range pool.free {
+		clone.Destroy()
+	}
+	pool.free = nil
+}